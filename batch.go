@@ -1,56 +1,62 @@
 package yojoudb
 
 import (
-	"fmt"
-	"github.com/bwmarrin/snowflake"
 	"sync"
 )
 
 // Batch is a batch operation of the database.
 // A batch can be read-only, calling Get() to get data.
 // Otherwise, calling Delete() or Put() to put data.
-// You must call Commit() to commit the batch, otherwise
-// the deadlock happens.
+// The writes are buffered in the batch without holding any lock of
+// the database, until Commit() is called. Call Discard() to drop a
+// batch which is not going to be committed.
 //
 // Batch is not a transaction, for it does not guarantee isolation.
-// But it can guarantee atomicity, consistency and durability.
+// But it can guarantee atomicity, consistency and durability. The keys
+// of a batch are applied to the index one by one after it's written,
+// a concurrent reader may see some of them before Commit returns, while
+// a batch is recovered all or nothing after a crash.
 type Batch struct {
 	db            *DB
 	opt           BatchOptions
 	mu            sync.RWMutex
-	batchId       *snowflake.Node
 	committed     bool
-	rollbacked    bool
+	discarded     bool
+	size          int64
 	pendingWrites map[string]*LR
+	savepoints    []savepoint
+	undoLog       []undoEntry
+}
+
+// savepoint records the state of a batch by the length of the undo log.
+type savepoint struct {
+	undoLen int
+	size    int64
+}
+
+// undoEntry is the record of a key replaced since the last savepoint,
+// prev is nil if the key was not pending.
+type undoEntry struct {
+	key  string
+	prev *LR
 }
 
 func (db *DB) NewBatch(options BatchOptions) *Batch {
 	batch := &Batch{
-		db:         db,
-		opt:        options,
-		committed:  false,
-		rollbacked: false,
+		db:        db,
+		opt:       options,
+		committed: false,
+		discarded: false,
 	}
 	if !options.ReadOnly {
 		batch.pendingWrites = make(map[string]*LR)
-		node, err := snowflake.NewNode(1)
-		if err != nil {
-			panic(fmt.Sprintf("snowflake.NewNode(1) failed: %v", err))
-		}
-		batch.batchId = node
 	}
-	batch.lock()
 	return batch
 }
 
 func makeBatch() interface{} {
-	node, err := snowflake.NewNode(1)
-	if err != nil {
-		panic(fmt.Sprintf("snowflake.NewNode(1) failed: %v", err))
-	}
 	return &Batch{
-		opt:     DefaultBatchOptions,
-		batchId: node,
+		opt: DefaultBatchOptions,
 	}
 }
 
@@ -58,7 +64,6 @@ func (b *Batch) init(readOnly, sync bool, db *DB) *Batch {
 	b.opt.ReadOnly = readOnly
 	b.opt.Sync = sync
 	b.db = db
-	b.lock()
 	return b
 }
 
@@ -71,66 +76,137 @@ func (b *Batch) reset() {
 	b.db = nil
 	b.pendingWrites = nil
 	b.committed = false
-	b.rollbacked = false
+	b.discarded = false
+	b.size = 0
+	b.savepoints = nil
+	b.undoLog = nil
 }
 
+// lock shares the db lock with other batches, only Close and
+// Merge take it exclusively. Writes are ordered by db.committer.
 func (b *Batch) lock() {
-	if b.opt.ReadOnly {
-		b.db.mu.RLock()
-	} else {
-		b.db.mu.Lock()
-	}
+	b.db.mu.RLock()
 }
 
 func (b *Batch) unlock() {
+	b.db.mu.RUnlock()
+}
+
+// checkWritable checks if the batch could take more writes.
+// The caller must hold b.mu.
+func (b *Batch) checkWritable() error {
 	if b.opt.ReadOnly {
-		b.db.mu.RUnlock()
-	} else {
-		b.db.mu.Unlock()
+		return ErrReadOnlyBatch
+	}
+	if b.committed {
+		return ErrBatchCommitted
+	}
+	if b.discarded {
+		return ErrBatchDiscarded
+	}
+	return nil
+}
+
+// addPendingWrite buffers the record, replacing the previous one
+// of the same key. The caller must hold b.mu.
+func (b *Batch) addPendingWrite(record *LR) error {
+	size := int64(len(record.Key) + len(record.Val))
+	old := b.pendingWrites[string(record.Key)]
+	if old != nil {
+		size -= int64(len(old.Key) + len(old.Val))
+	}
+	if b.opt.MaxSize > 0 && b.size+size > b.opt.MaxSize {
+		return ErrBatchTooLarge
+	}
+	if len(b.savepoints) > 0 {
+		b.undoLog = append(b.undoLog, undoEntry{key: string(record.Key), prev: old})
+	}
+	b.pendingWrites[string(record.Key)] = record
+	b.size += size
+	return nil
+}
+
+// SetSavepoint marks the current state of the pending writes, the later
+// writes could be undone by RollbackToSavepoint. Savepoints are stacked,
+// so they could be nested.
+func (b *Batch) SetSavepoint() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	b.savepoints = append(b.savepoints, savepoint{
+		undoLen: len(b.undoLog),
+		size:    b.size,
+	})
+	return nil
+}
+
+// RollbackToSavepoint restores the pending writes to the state of the
+// most recent savepoint, and removes the savepoint from the stack.
+// Returns ErrNoSavepoint if there's no savepoint.
+func (b *Batch) RollbackToSavepoint() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	if len(b.savepoints) == 0 {
+		return ErrNoSavepoint
 	}
+
+	sp := b.savepoints[len(b.savepoints)-1]
+	b.savepoints = b.savepoints[:len(b.savepoints)-1]
+	// undo the writes in reverse order
+	for i := len(b.undoLog) - 1; i >= sp.undoLen; i-- {
+		entry := b.undoLog[i]
+		if entry.prev == nil {
+			delete(b.pendingWrites, entry.key)
+		} else {
+			b.pendingWrites[entry.key] = entry.prev
+		}
+	}
+	b.undoLog = b.undoLog[:sp.undoLen]
+	b.size = sp.size
+	return nil
 }
 
 // Put adds a key/val to the batch for pending write.
+// Returns ErrBatchTooLarge if the batch would exceed its MaxSize.
 func (b *Batch) Put(key K, value V) error {
 	if len(key) == 0 {
 		return ErrKeyEmpty
 	}
-	if b.opt.ReadOnly {
-		return ErrReadOnlyBatch
-	}
 
 	b.mu.Lock()
-	b.pendingWrites[string(key)] = &LR{
+	defer b.mu.Unlock()
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	return b.addPendingWrite(&LR{
 		Key:  key,
 		Val:  value,
 		Type: LRNormal,
-	}
-	b.mu.Unlock()
-
-	return nil
+	})
 }
 
 // Delete adds a key to the batch for pending delete.
+// The delete is always written even if the key is not in the index
+// now, since the key may be put by another batch before the commit.
 func (b *Batch) Delete(key K) error {
 	if len(key) == 0 {
 		return ErrKeyEmpty
 	}
-	if b.opt.ReadOnly {
-		return ErrReadOnlyBatch
-	}
 
 	b.mu.Lock()
-	if loc := b.db.index.Get(key); loc != nil {
-		b.pendingWrites[string(key)] = &LR{
-			Key:  key,
-			Type: LRDeleted,
-		}
-	} else {
-		delete(b.pendingWrites, string(key))
+	defer b.mu.Unlock()
+	if err := b.checkWritable(); err != nil {
+		return err
 	}
-	b.mu.Unlock()
-
-	return nil
+	return b.addPendingWrite(&LR{
+		Key:  key,
+		Type: LRDeleted,
+	})
 }
 
 // Get gets the value of the given key.
@@ -157,6 +233,11 @@ func (b *Batch) Get(key K) (V, error) {
 	}
 
 	// get from WAL
+	b.lock()
+	defer b.unlock()
+	if b.db.closed {
+		return nil, ErrDBClosed
+	}
 	loc := b.db.index.Get(key)
 	if loc == nil {
 		return nil, ErrKeyNotFound
@@ -169,7 +250,7 @@ func (b *Batch) Get(key K) (V, error) {
 	if record.Type == LRDeleted {
 		panic("Deleted data cannot exist in the in-memory index")
 	}
-	return record.Val, nil
+	return b.db.readValue(record)
 }
 
 // Exist checks if the key exists in the database.
@@ -192,71 +273,114 @@ func (b *Batch) Exist(key K) (bool, error) {
 }
 
 // Commit commits the batch, if the batch is readonly or empty, return.
-// It will iterate the pendingWrites and write the data to the db, then
-// write a record to indicate the end of batch to guarantee atomicity.
-// Finally, index will be updated.
+// The db lock is only held while committing. The pendingWrites are
+// handed to the committer, which writes them to the db followed by a
+// record indicating the end of batch to guarantee atomicity, then
+// updates the index. Concurrent commits are grouped to share a single
+// fsync.
 func (b *Batch) Commit() error {
-	defer b.unlock()
-
-	if b.opt.ReadOnly || len(b.pendingWrites) == 0 {
-		return nil
-	}
-
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	batchId := b.batchId.Generate()
-	locations := make(map[string]*Loc)
-
-	// write to WAL
-	for _, rec := range b.pendingWrites {
-		rec.BatchId = uint64(batchId)
-		encRec := encodeLR(rec)
-		loc, err := b.db.dataFiles.Write(encRec)
-		if err != nil {
-			return err
-		}
-		locations[string(rec.Key)] = loc
+	if b.opt.ReadOnly {
+		return nil
 	}
-
-	// write an end-of-batch record
-	encRec := encodeLR(&LR{
-		Key:  batchId.Bytes(),
-		Type: LRBatchFin,
-	})
-	if _, err := b.db.dataFiles.Write(encRec); err != nil {
+	if err := b.checkWritable(); err != nil {
 		return err
 	}
+	if len(b.pendingWrites) == 0 {
+		b.committed = true
+		return nil
+	}
 
-	// flush WAL if needed
-	if b.opt.Sync && !b.db.options.Sync {
-		if err := b.db.dataFiles.Sync(); err != nil {
-			return err
-		}
+	b.lock()
+	defer b.unlock()
+	if b.db.closed {
+		return ErrDBClosed
+	}
+	if b.db.readOnly {
+		return ErrReadOnlyDB
 	}
 
-	// update index
-	for key, rec := range b.pendingWrites {
-		if rec.Type == LRDeleted {
-			b.db.index.Delete(rec.Key)
-		} else {
-			b.db.index.Put(rec.Key, locations[key])
-		}
+	if err := b.db.committer.commit(b.records(), b.opt.Sync); err != nil {
+		return err
 	}
 
 	b.committed = true
 	return nil
 }
 
-// Rollback discards a uncommitted batch instance.
-// It will clear pendingWrites and release db.lock.
-func (b *Batch) Rollback() error {
+// commitAsync hands the batch to the committer without waiting for
+// the result, cb is called with it, see DB.BatchAsync.
+func (b *Batch) commitAsync(cb func(error)) {
+	if queued, err := b.enqueue(cb); !queued {
+		cb(err)
+	}
+}
+
+// enqueue queues the batch to the committer. If the batch is finished
+// without queuing, the caller should call cb with the returned error
+// after the locks are released.
+func (b *Batch) enqueue(cb func(error)) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.opt.ReadOnly {
+		return false, nil
+	}
+	if err := b.checkWritable(); err != nil {
+		return false, err
+	}
+	if len(b.pendingWrites) == 0 {
+		b.committed = true
+		return false, nil
+	}
+
+	b.lock()
 	defer b.unlock()
+	if b.db.closed {
+		return false, ErrDBClosed
+	}
+	if b.db.readOnly {
+		return false, ErrReadOnlyDB
+	}
 
+	if err := b.db.committer.commitAsync(b.records(), b.opt.Sync, cb); err != nil {
+		return false, err
+	}
+	b.committed = true
+	return true, nil
+}
+
+func (b *Batch) records() []*LR {
+	records := make([]*LR, 0, len(b.pendingWrites))
+	for _, rec := range b.pendingWrites {
+		records = append(records, rec)
+	}
+	return records
+}
+
+// Discard drops all the pending writes of the batch. It never blocks
+// on the database, and it's a no-op if the batch is already committed
+// or discarded, so it's safe to defer it right after NewBatch.
+func (b *Batch) Discard() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.committed || b.discarded {
+		return
+	}
 	if !b.opt.ReadOnly {
 		b.pendingWrites = nil
 	}
+	b.size = 0
+	b.savepoints, b.undoLog = nil, nil
+	b.discarded = true
+}
 
-	b.rollbacked = true
+// Rollback discards a uncommitted batch instance, including all the
+// pending writes before any savepoint. It's the same as Discard.
+func (b *Batch) Rollback() error {
+	b.Discard()
 	return nil
 }
@@ -3,7 +3,9 @@ package yojoudb
 import (
 	"github.com/berylyvos/yojoudb/utils"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestBatch_Put_Normal(t *testing.T) {
@@ -112,6 +114,148 @@ func TestBatch_Rollback(t *testing.T) {
 	assert.Empty(t, resp)
 }
 
+func TestBatch_Savepoint(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	batch := db.NewBatch(BatchOptions{MaxSize: 100})
+	defer batch.Discard()
+	assert.Equal(t, ErrNoSavepoint, batch.RollbackToSavepoint())
+
+	assert.Nil(t, batch.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, batch.SetSavepoint())
+	assert.Nil(t, batch.Put([]byte("a"), []byte("2")))
+	assert.Nil(t, batch.Put([]byte("b"), []byte("2")))
+	// nested
+	assert.Nil(t, batch.SetSavepoint())
+	assert.Nil(t, batch.Delete([]byte("a")))
+	assert.Nil(t, batch.Put([]byte("c"), make([]byte, 90)))
+	assert.Equal(t, ErrBatchTooLarge, batch.Put([]byte("d"), make([]byte, 10)))
+
+	assert.Nil(t, batch.RollbackToSavepoint())
+	val, err := batch.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), val)
+	_, err = batch.Get([]byte("c"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, batch.Put([]byte("d"), make([]byte, 10)))
+
+	assert.Nil(t, batch.RollbackToSavepoint())
+	val, err = batch.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), val)
+	for _, key := range []string{"b", "d"} {
+		_, err = batch.Get([]byte(key))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	assert.Equal(t, ErrNoSavepoint, batch.RollbackToSavepoint())
+
+	assert.Nil(t, batch.Commit())
+	assertKeyExistOrNot(t, db, []byte("a"), true)
+	assertKeyExistOrNot(t, db, []byte("b"), false)
+	assert.Equal(t, ErrBatchCommitted, batch.SetSavepoint())
+}
+
+func TestBatch_Lock_At_Commit(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// an open batch does not block other writes or Close
+	batch := db.NewBatch(DefaultBatchOptions)
+	defer batch.Discard()
+	err = batch.Put(utils.TestKey(1), utils.RandValue(128))
+	assert.Nil(t, err)
+	err = db.Put(utils.TestKey(2), utils.RandValue(128))
+	assert.Nil(t, err)
+	err = batch.Delete(utils.TestKey(2))
+	assert.Nil(t, err)
+	err = batch.Commit()
+	assert.Nil(t, err)
+	assertKeyExistOrNot(t, db, utils.TestKey(1), true)
+	assertKeyExistOrNot(t, db, utils.TestKey(2), false)
+	assert.Equal(t, ErrBatchCommitted, batch.Put(utils.TestKey(3), nil))
+	assert.Equal(t, ErrBatchCommitted, batch.Commit())
+
+	batch2 := db.NewBatch(DefaultBatchOptions)
+	err = batch2.Put(utils.TestKey(3), utils.RandValue(128))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, ErrDBClosed, batch2.Commit())
+	batch2.Discard()
+	batch2.Discard()
+	assert.Equal(t, ErrBatchDiscarded, batch2.Put(utils.TestKey(3), nil))
+	assert.Equal(t, ErrBatchDiscarded, batch2.Commit())
+}
+
+func TestBatch_MaxSize(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	batch := db.NewBatch(BatchOptions{MaxSize: 100})
+	err = batch.Put([]byte("key"), make([]byte, 90))
+	assert.Nil(t, err)
+	err = batch.Put([]byte("key2"), make([]byte, 10))
+	assert.Equal(t, ErrBatchTooLarge, err)
+	// replace the value of the same key
+	err = batch.Put([]byte("key"), make([]byte, 97))
+	assert.Nil(t, err)
+	err = batch.Delete([]byte("key"))
+	assert.Nil(t, err)
+	err = batch.Put([]byte("key2"), make([]byte, 10))
+	assert.Nil(t, err)
+	assert.Nil(t, batch.Commit())
+
+	assertKeyExistOrNot(t, db, []byte("key"), false)
+	assertKeyExistOrNot(t, db, []byte("key2"), true)
+}
+
+func TestBatch_Commit_Group(t *testing.T) {
+	options := DefaultOptions
+	options.Sync = true
+	options.MaxGroupCommitDelay = time.Millisecond
+	options.MaxGroupSize = 4
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				batch := db.NewBatch(DefaultBatchOptions)
+				for j := 0; j < 10; j++ {
+					err := batch.Put(utils.TestKey(g*10000+i*10+j), utils.RandValue(128))
+					assert.Nil(t, err)
+				}
+				assert.Nil(t, batch.Commit())
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, 16*50*10, db.index.Size())
+
+	_ = db.Close()
+	batch := db.NewBatch(DefaultBatchOptions)
+	_ = batch.Put(utils.TestKey(1), utils.RandValue(128))
+	assert.Equal(t, ErrDBClosed, batch.Commit())
+
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 16*50*10, db2.index.Size())
+}
+
 func batchPutAndIterate(t *testing.T, segmentSize int64, size int, valueLen int) {
 	options := DefaultOptions
 	options.SegmentSize = segmentSize
@@ -0,0 +1,56 @@
+package benchmark
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/berylyvos/yojoudb/meta"
+	"github.com/berylyvos/yojoudb/utils"
+)
+
+const indexKeyNum = 500000
+
+// Benchmark_Index_Get compares the point-lookup throughput and the
+// memory usage per entry of the hash index and the ART index.
+//
+// Benchmark_Index_Get/hash-4   1000000   159.3 ns/op   107.9 heap-B/entry   0 B/op   0 allocs/op
+// Benchmark_Index_Get/art-4    1000000   270.1 ns/op   133.3 heap-B/entry   0 B/op   0 allocs/op
+func Benchmark_Index_Get(b *testing.B) {
+	b.Run("hash", func(b *testing.B) {
+		benchmarkIndexGet(b, meta.IndexHash)
+	})
+	b.Run("art", func(b *testing.B) {
+		benchmarkIndexGet(b, meta.IndexART)
+	})
+}
+
+func benchmarkIndexGet(b *testing.B, typ meta.IndexType) {
+	keys := make([][]byte, indexKeyNum)
+	for i := range keys {
+		keys[i] = utils.TestKey(i)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	index := meta.NewIndexer(typ)
+	for i, key := range keys {
+		index.Put(key, &meta.Loc1{SegId: 1, ChunkOffset: int64(i)})
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if index.Get(keys[i%indexKeyNum]) == nil {
+				b.Fatal("key not found")
+			}
+			i++
+		}
+	})
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/indexKeyNum, "heap-B/entry")
+	runtime.KeepAlive(index)
+}
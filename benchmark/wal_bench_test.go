@@ -70,3 +70,19 @@ func BenchmarkWAL_WriteLargeSize(b *testing.B) {
 		assert.Nil(b, err)
 	}
 }
+
+// BenchmarkWAL_WriteBatch-4   	   47252	     22002 ns/op	    9528 B/op	     110 allocs/op
+func BenchmarkWAL_WriteBatch(b *testing.B) {
+	data := make([][]byte, 100)
+	for i := range data {
+		data[i] = []byte("Hello World")
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		_, err := w.WriteBatch(data)
+		assert.Nil(b, err)
+	}
+}
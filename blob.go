@@ -0,0 +1,245 @@
+package yojoudb
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/berylyvos/yojoudb/wal"
+)
+
+// blobRefs counts the references of the blob files from the index, that
+// is the number of the keys whose current value is in the blob file.
+// A sealed blob file without references is never referred again, it's
+// deleted by Merge.
+type blobRefs struct {
+	mu   sync.Mutex
+	keys map[string]wal.SegmentID // the blob file of the current value of the key.
+	refs map[wal.SegmentID]int
+}
+
+func newBlobRefs() *blobRefs {
+	return &blobRefs{
+		keys: make(map[string]wal.SegmentID),
+		refs: make(map[wal.SegmentID]int),
+	}
+}
+
+// set records the location of the current value of the key in the blob
+// files, the reference of the previous value is dropped. A nil blob
+// means the value is not separated, or the key is deleted.
+func (r *blobRefs) set(key K, blob *Loc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.keys[string(key)]; ok {
+		r.refs[old]--
+		if r.refs[old] == 0 {
+			delete(r.refs, old)
+		}
+		delete(r.keys, string(key))
+	}
+	if blob != nil {
+		r.keys[string(key)] = blob.SegId
+		r.refs[blob.SegId]++
+	}
+}
+
+// unreferenced returns the blob files without references among the given ones.
+func (r *blobRefs) unreferenced(ids []wal.SegmentID) []wal.SegmentID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unused []wal.SegmentID
+	for _, id := range ids {
+		if r.refs[id] == 0 {
+			unused = append(unused, id)
+		}
+	}
+	return unused
+}
+
+// openBlobFiles opens the blob files if the values are separated, or
+// there are blob files written before. Returns nil if neither.
+func openBlobFiles(options Options) (*wal.WAL, error) {
+	if options.BlobThreshold <= 0 {
+		entries, err := options.fs().ReadDir(options.DirPath)
+		if err != nil {
+			return nil, err
+		}
+		var found bool
+		for _, entry := range entries {
+			found = found || strings.HasSuffix(entry.Name(), blobFileSuffix)
+		}
+		if !found {
+			return nil, nil
+		}
+	}
+	// the blob files are rotated by writeBlob, so that a value
+	// larger than SegmentSize fits into a blob file of its own.
+	// They have no sync policy of their own, but are synced before
+	// every sync of the data files, see wal.Options.BeforeSync.
+	return wal.Open(wal.Options{
+		DirPath:         options.DirPath,
+		SegmentSize:     math.MaxInt64,
+		SegmentFileExt:  blobFileSuffix,
+		FS:              options.FS,
+		MmapReads:       options.MmapReads,
+		MaxOpenSegments: options.MaxOpenSegments,
+	})
+}
+
+// separated reports whether the value of the record should be written
+// to the blob files. The values are not separated if multiple versions
+// are kept, since the blob files only know the current versions.
+func (db *DB) separated(rec *LR) bool {
+	return rec.Type == LRNormal && db.separatedSize(int64(len(rec.Val)))
+}
+
+// separatedSize reports whether a value of the given size is separated.
+func (db *DB) separatedSize(size int64) bool {
+	return db.blobFiles != nil && db.options.BlobThreshold > 0 &&
+		!db.options.versioned() && size > db.options.BlobThreshold
+}
+
+// writeBlob writes the value to the active blob file. A new blob file is
+// created if the value doesn't fit into the active one, so a value larger
+// than SegmentSize takes a blob file of its own.
+// Only called by the committer.
+func (db *DB) writeBlob(val V) (*Loc, error) {
+	size := db.blobFiles.ActiveSegSize()
+	if size > 0 && size+int64(len(val)) > db.options.SegmentSize {
+		if err := db.blobFiles.OpenNewActiveSeg(); err != nil {
+			return nil, err
+		}
+	}
+	return db.blobFiles.Write(val)
+}
+
+// readValue returns the value of the record, which is read from the
+// blob files if it's separated.
+func (db *DB) readValue(rec *LR) (V, error) {
+	if rec.Blob == nil {
+		return rec.Val, nil
+	}
+	if db.blobFiles == nil {
+		return nil, ErrBlobNotFound
+	}
+	return db.blobFiles.Read(rec.Blob)
+}
+
+// trackBlob updates the reference of the key to the blob files along
+// with the index.
+func (db *DB) trackBlob(key K, blob *Loc) {
+	if db.blobRefs != nil {
+		db.blobRefs.set(key, blob)
+	}
+}
+
+// unreferencedBlobs returns the sealed blob files without references.
+func (db *DB) unreferencedBlobs() []wal.SegmentID {
+	if db.blobFiles == nil || db.options.versioned() {
+		return nil
+	}
+	ids := db.blobFiles.SegmentIDs()
+	return db.blobRefs.unreferenced(ids[:len(ids)-1])
+}
+
+// PutReader puts the value of the given size read from r. The value is
+// streamed into a blob file of its own chunk by chunk, so it's never held
+// in memory as a whole. Exactly size bytes are read from r.
+// The value is read into memory and put by Put if it's not separated,
+// i.e. its size doesn't exceed Options.BlobThreshold, or multiple
+// versions are kept.
+func (db *DB) PutReader(key K, r io.Reader, size int64) error {
+	if len(key) == 0 {
+		return ErrKeyEmpty
+	}
+	if size < 0 {
+		return ErrNegativeSize
+	}
+
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return ErrDBClosed
+	}
+	if db.readOnly {
+		db.mu.RUnlock()
+		return ErrReadOnlyDB
+	}
+	if !db.separatedSize(size) {
+		db.mu.RUnlock()
+		val := make(V, size)
+		if _, err := io.ReadFull(r, val); err != nil {
+			return err
+		}
+		return db.Put(key, val)
+	}
+	sw, err := db.blobFiles.NewStreamWriter()
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// the stream is written without holding db.mu, which would block
+	// Merge and Close until it's done.
+	blob, err := sw.Write(r, size)
+	if err != nil {
+		_ = sw.Abort()
+		return err
+	}
+
+	// the blob file joins the others along with the record referring
+	// to it, so that Merge never takes it as unreferenced.
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		_ = sw.Abort()
+		return ErrDBClosed
+	}
+	if err := sw.Commit(); err != nil {
+		_ = sw.Abort()
+		return err
+	}
+	return db.committer.commit([]*LR{{
+		Key:  key,
+		Type: LRNormal,
+		Blob: blob,
+	}}, false)
+}
+
+// GetReader returns a reader of the value of the given key, which must
+// be closed once done. A separated value is streamed from the blob file
+// chunk by chunk, and the checksum of a chunk is checked when it's read.
+// The blob file is kept until the reader is closed, but the reads fail
+// once the database is closed.
+func (db *DB) GetReader(key K) (io.ReadCloser, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyEmpty
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+	loc := db.index.Get(key)
+	if loc == nil {
+		return nil, ErrKeyNotFound
+	}
+	chunk, err := db.dataFiles.Read(loc)
+	if err != nil {
+		return nil, err
+	}
+	record := decodeLR(chunk)
+	if record.Type == LRDeleted {
+		panic("Deleted data cannot exist in the in-memory index")
+	}
+	if record.Blob == nil {
+		return io.NopCloser(bytes.NewReader(record.Val)), nil
+	}
+	if db.blobFiles == nil {
+		return nil, ErrBlobNotFound
+	}
+	return db.blobFiles.NewStreamReader(record.Blob)
+}
@@ -0,0 +1,351 @@
+package yojoudb
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/berylyvos/yojoudb/utils"
+	"github.com/berylyvos/yojoudb/vfs"
+	"github.com/berylyvos/yojoudb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Blob(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 64 * KB
+	options.BlobThreshold = KB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	values := map[int][]byte{
+		0: utils.RandValue(100),
+		1: utils.RandValue(2 * KB),
+		2: utils.RandValue(40 * KB),
+		// larger than SegmentSize, which takes a blob file of its own.
+		3: utils.RandValue(200 * KB),
+		4: utils.RandValue(KB),
+	}
+	for i, value := range values {
+		assert.Nil(t, db.Put(utils.TestKey(i), value))
+	}
+	// only the location of the separated value is in the data file.
+	assert.Equal(t, 1, len(db.dataFiles.SegmentIDs()))
+	assert.True(t, len(db.blobFiles.SegmentIDs()) > 1)
+
+	check := func(db *DB) {
+		for i, value := range values {
+			val, err := db.Get(utils.TestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+			view, release, err := db.GetView(utils.TestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, value, view)
+			release()
+		}
+		iter := db.NewIterator(DefaultIteratorOptions)
+		defer iter.Close()
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			val, err := iter.Value()
+			assert.Nil(t, err)
+			assert.Equal(t, values[count], val)
+			count++
+		}
+		assert.Equal(t, len(values), count)
+	}
+	check(db)
+
+	// the blob files are read even if the values are no longer separated.
+	assert.Nil(t, db.Close())
+	options.BlobThreshold = 0
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	check(db2)
+	values[5] = utils.RandValue(2 * KB)
+	assert.Nil(t, db2.Put(utils.TestKey(5), values[5]))
+	_, separated := db2.blobRefs.keys[string(utils.TestKey(5))]
+	assert.False(t, separated)
+	check(db2)
+}
+
+func TestDB_Blob_Sync(t *testing.T) {
+	policies := map[string]func(db *DB) error{
+		"every n": func(db *DB) error {
+			return db.SetSyncPolicy(SyncEveryN, 4*KB, 0)
+		},
+		"interval": func(db *DB) error {
+			return db.SetSyncPolicy(SyncInterval, 0, time.Millisecond)
+		},
+		// synced by DB.Sync
+		"never": func(*DB) error { return nil },
+	}
+	for name, setPolicy := range policies {
+		t.Run(name, func(t *testing.T) {
+			for seed := int64(1); seed <= 10; seed++ {
+				testBlobSync(t, vfs.NewFault(seed), setPolicy)
+			}
+		})
+	}
+}
+
+func testBlobSync(t *testing.T, fs *vfs.FaultFS, setPolicy func(db *DB) error) {
+	options := DefaultOptions
+	options.DirPath = "/yojoudb-blob-sync"
+	options.SegmentSize = 64 * KB
+	options.BlobThreshold = KB
+	options.FS = fs
+	db, err := Open(options)
+	assert.Nil(t, err)
+	assert.Nil(t, setPolicy(db))
+
+	// the values in the active blob file are only synced
+	// along with the records.
+	values := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key, value := utils.TestKey(i), utils.RandValue(2*KB)
+		values[string(key)] = value
+		assert.Nil(t, db.Put(key, value))
+	}
+	time.Sleep(10 * time.Millisecond)
+	if db.dataFiles.SyncPolicy() == wal.SyncNever {
+		_, err = db.Sync()
+		assert.Nil(t, err)
+	}
+	durable := db.dataFiles.DurableLoc()
+
+	// every durable record refers to a durable value, the records
+	// after them may also survive the crash, but they may not.
+	options.FS = fs.Crash()
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	var count int
+	for key, value := range values {
+		if loc := db2.index.Get([]byte(key)); loc == nil || !locBefore(loc, durable) {
+			continue
+		}
+		val, err := db2.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+		count++
+	}
+	assert.True(t, count > 0)
+	_ = db.Close()
+}
+
+// locBefore reports whether the location a is before b.
+func locBefore(a, b *Loc) bool {
+	if a.SegId != b.SegId {
+		return a.SegId < b.SegId
+	}
+	if a.BlockIndex != b.BlockIndex {
+		return a.BlockIndex < b.BlockIndex
+	}
+	return a.ChunkOffset < b.ChunkOffset
+}
+
+func TestDB_Blob_GC(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 64 * KB
+	options.BlobThreshold = KB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.TestKey(i), utils.RandValue(4*KB)))
+	}
+	old := db.blobFiles.SegmentIDs()
+	assert.True(t, len(old) > 4)
+
+	// the values in the old blob files are overwritten or deleted,
+	// except for the last key.
+	values := make(map[int][]byte)
+	for i := 0; i < 99; i++ {
+		if i%2 == 0 {
+			assert.Nil(t, db.Delete(utils.TestKey(i)))
+			continue
+		}
+		values[i] = utils.RandValue(4 * KB)
+		assert.Nil(t, db.Put(utils.TestKey(i), values[i]))
+	}
+	assert.Nil(t, db.DeleteRange(utils.TestKey(90), utils.TestKey(99)))
+	for i := 90; i < 99; i++ {
+		delete(values, i)
+	}
+	last, err := db.Get(utils.TestKey(99))
+	assert.Nil(t, err)
+	values[99] = last
+
+	// the merge deletes the sealed blob files without references.
+	assert.Nil(t, db.Merge())
+	lastBlobFile := old[len(old)-1]
+	for _, id := range old {
+		_, err := os.Stat(wal.SegmentFileName(options.DirPath, blobFileSuffix, id))
+		if id == lastBlobFile {
+			assert.Nil(t, err)
+		} else {
+			assert.True(t, os.IsNotExist(err), "blob file %d", id)
+		}
+	}
+
+	check := func(db *DB) {
+		for i := 0; i < 100; i++ {
+			val, err := db.Get(utils.TestKey(i))
+			if value, ok := values[i]; ok {
+				assert.Nil(t, err)
+				assert.Equal(t, value, val)
+			} else {
+				assert.Equal(t, ErrKeyNotFound, err)
+			}
+		}
+	}
+	check(db)
+
+	// the references are restored from the hint file.
+	refs := db.blobRefs.refs[lastBlobFile]
+	assert.True(t, refs > 0)
+	assert.Nil(t, db.Close())
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	check(db2)
+	assert.Equal(t, refs, db2.blobRefs.refs[lastBlobFile])
+	assert.Nil(t, db2.Merge())
+	check(db2)
+
+	assert.Nil(t, db2.Close())
+	db3, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db3.Close()
+	}()
+	check(db3)
+}
+
+func TestDB_PutReader(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 64 * KB
+	options.BlobThreshold = KB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	values := map[int][]byte{
+		// streamed into a blob file of its own.
+		0: utils.RandValue(300 * KB),
+		1: utils.RandValue(2 * KB),
+		// not separated, which is put by Put.
+		2: utils.RandValue(100),
+	}
+	for i, value := range values {
+		assert.Nil(t, db.PutReader(utils.TestKey(i), bytes.NewReader(value), int64(len(value))))
+	}
+	assert.Nil(t, db.Put(utils.TestKey(3), utils.RandValue(4*KB)))
+	values[3], _ = db.Get(utils.TestKey(3))
+	_, separated := db.blobRefs.keys[string(utils.TestKey(2))]
+	assert.False(t, separated)
+
+	check := func(db *DB) {
+		for i, value := range values {
+			val, err := db.Get(utils.TestKey(i))
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(value, val))
+			r, err := db.GetReader(utils.TestKey(i))
+			assert.Nil(t, err)
+			val, err = io.ReadAll(r)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(value, val))
+			assert.Nil(t, r.Close())
+		}
+	}
+	check(db)
+	_, err = db.GetReader(utils.TestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the value is not put if the reader ends earlier.
+	err = db.PutReader(utils.TestKey(10), bytes.NewReader(values[0]), int64(len(values[0])+1))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = db.Get(utils.TestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the blob file held by a reader is kept after the value is
+	// overwritten and the blob file is deleted by Merge.
+	r, err := db.GetReader(utils.TestKey(0))
+	assert.Nil(t, err)
+	old, oldBlobFile := values[0], db.blobRefs.keys[string(utils.TestKey(0))]
+	values[0] = utils.RandValue(200 * KB)
+	assert.Nil(t, db.PutReader(utils.TestKey(0), bytes.NewReader(values[0]), int64(len(values[0]))))
+	assert.Nil(t, db.Merge())
+	val, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(old, val))
+	assert.Nil(t, r.Close())
+	_, err = os.Stat(wal.SegmentFileName(options.DirPath, blobFileSuffix, oldBlobFile))
+	assert.True(t, os.IsNotExist(err))
+	check(db)
+
+	assert.Nil(t, db.Close())
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	check(db2)
+}
+
+func TestDB_PutReader_SyncPolicy(t *testing.T) {
+	options := DefaultOptions
+	options.Sync = true
+	options.BlobThreshold = KB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// the record follows the sync policy set at runtime, the blob
+	// file is synced on its own.
+	assert.Nil(t, db.SetSyncPolicy(SyncNever, 0, 0))
+	durable := db.dataFiles.DurableLoc()
+	value := utils.RandValue(2 * KB)
+	assert.Nil(t, db.PutReader(utils.TestKey(0), bytes.NewReader(value), int64(len(value))))
+	assert.Equal(t, durable, db.dataFiles.DurableLoc())
+	assert.NotEqual(t, db.dataFiles.EndLoc(), db.dataFiles.DurableLoc())
+}
+
+func TestDB_Blob_Versioned(t *testing.T) {
+	options := DefaultOptions
+	options.BlobThreshold = KB
+	options.KeepVersions = 2
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	value := utils.RandValue(2 * KB)
+	assert.Nil(t, db.Put(utils.TestKey(0), value))
+	assert.Equal(t, 0, len(db.blobRefs.keys))
+	val, err := db.Get(utils.TestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+
+	// the value is put by Put, since it's not separated.
+	value = utils.RandValue(4 * KB)
+	assert.Nil(t, db.PutReader(utils.TestKey(1), bytes.NewReader(value), int64(len(value))))
+	assert.Equal(t, 0, len(db.blobRefs.keys))
+	r, err := db.GetReader(utils.TestKey(1))
+	assert.Nil(t, err)
+	val, err = io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+	assert.Nil(t, r.Close())
+}
@@ -0,0 +1,391 @@
+package yojoudb
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/berylyvos/yojoudb/wal"
+)
+
+const defaultMaxGroupSize = 128
+
+// commitRequest is a batch waiting to be written by the committer.
+// The result is sent to done, or passed to cb for an async commit.
+// A barrier has nothing to write, it's done once the requests queued
+// before it are done, see committer.drain.
+type commitRequest struct {
+	records []*LR
+	sync    bool
+	seq     uint64
+	done    chan error
+	cb      func(error)
+	barrier bool
+}
+
+func (r *commitRequest) finish(err error) {
+	if r.cb != nil {
+		r.cb(err)
+		return
+	}
+	r.done <- err
+}
+
+// committer is the write pipeline of the db.
+//
+// Concurrent commits are queued, the committer goroutine acts as the
+// leader of a group: it takes the queued requests, writes all their
+// records to the WAL in one append, syncs the WAL once for the group,
+// then updates the index in the order of the WAL and wakes the waiters.
+// Since there is only one writer, the index always agrees with the WAL.
+type committer struct {
+	db      *DB
+	reqs    chan *commitRequest
+	stopped chan struct{}
+	seq     uint64 // the last sequence number assigned.
+	// failed is the error which stopped the writes, after which the
+	// state of the WAL is unknown, see write. It's only accessed by
+	// the committer goroutine.
+	failed error
+	// closed is set once the committer is stopped, even if closing the
+	// db fails after that. It's guarded by db.mu.
+	closed bool
+}
+
+func newCommitter(db *DB, seq uint64) *committer {
+	c := &committer{
+		db:      db,
+		seq:     seq,
+		reqs:    make(chan *commitRequest, db.maxGroupSize()),
+		stopped: make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// commit queues the records of a batch and waits until they are
+// written and applied to the index.
+// The caller must hold db.mu.RLock and make sure db is not closed.
+func (c *committer) commit(records []*LR, sync bool) error {
+	if c.closed {
+		return ErrDBClosed
+	}
+	req := &commitRequest{
+		records: records,
+		sync:    sync,
+		done:    make(chan error, 1),
+	}
+	c.reqs <- req
+	return <-req.done
+}
+
+// commitAsync queues the records of a batch without waiting, cb is
+// called on the committer goroutine once they are written and applied
+// to the index. The requests are written in the order they are queued.
+// It blocks only if the queue is full. If the committer is stopped,
+// nothing is queued and the error is returned instead.
+// The caller must hold db.mu.RLock and make sure db is not closed.
+func (c *committer) commitAsync(records []*LR, sync bool, cb func(error)) error {
+	if c.closed {
+		return ErrDBClosed
+	}
+	c.reqs <- &commitRequest{
+		records: records,
+		sync:    sync,
+		cb:      cb,
+	}
+	return nil
+}
+
+// drain waits until all queued requests are written and applied to the
+// index, including the async ones whose callers have already returned.
+// The caller must hold db.mu.Lock so that no more requests come.
+func (c *committer) drain() {
+	if c.closed {
+		return
+	}
+	req := &commitRequest{
+		barrier: true,
+		done:    make(chan error, 1),
+	}
+	c.reqs <- req
+	<-req.done
+}
+
+// stop stops the committer after all queued requests are done, it's
+// a no-op if the committer is already stopped.
+// The caller must hold db.mu.Lock so that no more requests come.
+func (c *committer) stop() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.reqs)
+	<-c.stopped
+}
+
+func (c *committer) run() {
+	defer close(c.stopped)
+	for req := range c.reqs {
+		c.write(c.collect(req))
+	}
+}
+
+// collect collects the queued requests into a group led by the given one.
+// If the group needs to be synced, it waits at most MaxGroupCommitDelay
+// for more requests to share the fsync.
+func (c *committer) collect(req *commitRequest) []*commitRequest {
+	var (
+		group    = []*commitRequest{req}
+		maxSize  = c.db.maxGroupSize()
+		needSync = c.db.dataFiles.SyncPolicy() == wal.SyncEveryWrite || req.sync
+		delay    = c.db.options.MaxGroupCommitDelay
+		timer    *time.Timer
+	)
+	for len(group) < maxSize {
+		// take the queued requests without waiting
+		select {
+		case r, ok := <-c.reqs:
+			if !ok {
+				return group
+			}
+			group = append(group, r)
+			needSync = needSync || r.sync
+			continue
+		default:
+		}
+
+		// nothing queued, wait for more only if the group is to be synced
+		if !needSync || delay <= 0 {
+			return group
+		}
+		if timer == nil {
+			timer = time.NewTimer(delay)
+			defer timer.Stop()
+		}
+		select {
+		case r, ok := <-c.reqs:
+			if !ok {
+				return group
+			}
+			group = append(group, r)
+		case <-timer.C:
+			return group
+		}
+	}
+	return group
+}
+
+// write writes a group of requests to the WAL with a single append,
+// syncs it if needed, then applies the batches to the index in order.
+func (c *committer) write(group []*commitRequest) {
+	// the data of a failed write or sync may or may not be on the disk,
+	// no more writes are trusted until the db is reopened.
+	if c.failed != nil {
+		for _, req := range group {
+			req.finish(c.failed)
+		}
+		return
+	}
+
+	var (
+		db        = c.db
+		needSync  bool
+		versioned = db.options.versioned()
+		ts        = time.Now().UnixNano()
+		run       = newCommitRun(versioned)
+		start     = db.dataFiles.EndLoc() // where the group is written.
+		flushed   bool                    // whether any run is written.
+		// the latest locations of the keys written by the group,
+		// nil if the key is deleted.
+		written map[string]*Loc
+		// the range deletions of the group.
+		ranges []*LR
+		locs   []*Loc
+		blobs  bool // whether any value is written to the blob files.
+		err    error
+	)
+	if versioned {
+		written = make(map[string]*Loc)
+	}
+
+	flush := func() {
+		if err != nil || len(run.chunks) == 0 {
+			return
+		}
+		var runLocs []*Loc
+		flushed = true
+		if runLocs, err = db.dataFiles.WriteBatch(run.chunks); err != nil {
+			return
+		}
+		for i, rec := range run.records {
+			if !versioned || rec == nil || rec.Type == LRRangeDel {
+				continue
+			}
+			if rec.Type == LRDeleted {
+				written[string(rec.Key)] = nil
+			} else {
+				written[string(rec.Key)] = runLocs[i]
+			}
+		}
+		locs = append(locs, runLocs...)
+		run = newCommitRun(versioned)
+	}
+
+	// every batch is assigned the next sequence number, which is never
+	// reused even if the write fails, and followed by an end-of-batch
+	// record. With multiple versions, the group is split into runs without
+	// repeated keys, so the locations of the previous versions are known.
+	for _, req := range group {
+		if req.barrier {
+			continue
+		}
+		needSync = needSync || req.sync
+		c.seq++
+		req.seq = c.seq
+		if versioned && run.overlaps(req.records) {
+			flush()
+		}
+		for _, rec := range req.records {
+			rec.BatchId = req.seq
+			if versioned && rec.Type == LRRangeDel {
+				// the keys written before are deleted by the range,
+				// so are the keys in the index.
+				flush()
+				for key := range written {
+					if inRange(K(key), rec.Key, rec.Val) {
+						written[key] = nil
+					}
+				}
+				ranges = append(ranges, rec)
+			}
+			// the separated value is written to the blob files first,
+			// the record only keeps the location of it.
+			if err == nil && db.separated(rec) {
+				if rec.Blob, err = db.writeBlob(rec.Val); err == nil {
+					blobs = true
+				}
+			}
+			if versioned && rec.Type == LRNormal {
+				rec.Timestamp = ts
+				var ok bool
+				if rec.Prev, ok = written[string(rec.Key)]; !ok && !covered(ranges, rec.Key) {
+					rec.Prev = db.index.Get(rec.Key)
+				}
+			}
+			run.add(rec, encodeLR(rec))
+		}
+		// an end-of-batch record with the commit time
+		run.add(nil, encodeLR(&LR{
+			Type:      LRBatchFin,
+			BatchId:   req.seq,
+			Timestamp: ts,
+		}))
+	}
+
+	// the blob files are synced before the records referring to them.
+	if err == nil && blobs && (needSync || db.dataFiles.SyncPolicy() == wal.SyncEveryWrite) {
+		if err = db.blobFiles.Sync(); err != nil {
+			c.fail(err)
+		}
+	}
+
+	// write to WAL, and flush it once for the whole group if needed,
+	// the WAL has already been synced if its policy is SyncEveryWrite.
+	flush()
+	if err == nil && needSync {
+		err = db.dataFiles.Sync()
+	}
+	// the written records are discarded, so that the failed batches
+	// don't come back after a reopen.
+	if err != nil && flushed {
+		if terr := db.dataFiles.TruncateAt(start); terr != nil {
+			err = fmt.Errorf("%w, and failed to discard the written records: %v", err, terr)
+		}
+		c.fail(err)
+	}
+
+	// the records of a batch are applied one by one, the readers may see
+	// a batch partly applied until it's finished, see Batch.
+	for _, req := range group {
+		if err == nil && !req.barrier {
+			for _, rec := range req.records {
+				switch rec.Type {
+				case LRDeleted:
+					db.index.Delete(rec.Key)
+					db.trackBlob(rec.Key, nil)
+				case LRRangeDel:
+					// never fails, since DeleteRange refuses the index
+					// types which can't find the keys.
+					_ = db.deleteRange(rec.Key, rec.Val)
+				default:
+					db.index.Put(rec.Key, locs[0])
+					db.trackBlob(rec.Key, rec.Blob)
+				}
+				locs = locs[1:]
+			}
+			// skip the end-of-batch record
+			locs = locs[1:]
+			atomic.StoreUint64(&db.seq, req.seq)
+		}
+		req.finish(err)
+	}
+}
+
+// fail stops the writes with the given error, see write.
+func (c *committer) fail(err error) {
+	if c.failed == nil {
+		c.failed = fmt.Errorf("%w: %v", ErrWriteFailed, err)
+	}
+}
+
+// commitRun is the records of a group written with a single append.
+// The keys are only tracked if multiple versions are kept.
+type commitRun struct {
+	chunks  [][]byte
+	records []*LR // nil for the end-of-batch record.
+	keys    map[string]struct{}
+}
+
+func newCommitRun(trackKeys bool) *commitRun {
+	r := &commitRun{}
+	if trackKeys {
+		r.keys = make(map[string]struct{})
+	}
+	return r
+}
+
+func (r *commitRun) add(rec *LR, chunk []byte) {
+	r.chunks = append(r.chunks, chunk)
+	r.records = append(r.records, rec)
+	if rec != nil && r.keys != nil {
+		r.keys[string(rec.Key)] = struct{}{}
+	}
+}
+
+// overlaps reports whether any of the records has a key in the run.
+func (r *commitRun) overlaps(records []*LR) bool {
+	for _, rec := range records {
+		if _, ok := r.keys[string(rec.Key)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// covered reports whether the key is deleted by any of the range deletions.
+func covered(ranges []*LR, key K) bool {
+	for _, rec := range ranges {
+		if inRange(key, rec.Key, rec.Val) {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *DB) maxGroupSize() int {
+	if db.options.MaxGroupSize > 0 {
+		return db.options.MaxGroupSize
+	}
+	return defaultMaxGroupSize
+}
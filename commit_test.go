@@ -0,0 +1,70 @@
+package yojoudb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/berylyvos/yojoudb/utils"
+	"github.com/berylyvos/yojoudb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Commit_SyncFailed(t *testing.T) {
+	fs := vfs.NewFault(0)
+	options := DefaultOptions
+	options.DirPath = "/yojoudb-commit"
+	options.Sync = true
+	options.FS = fs
+	options.KeepVersions = 3
+	db, err := Open(options)
+	assert.Nil(t, err)
+
+	key := []byte("key")
+	assert.Nil(t, db.Put(key, []byte("v1")))
+
+	// the writes queued along with the failed one are discarded,
+	// whether or not they are written in the same group.
+	fs.FailNext(vfs.OpSync)
+	done := make(chan error, 3)
+	for i := 2; i <= 4; i++ {
+		db.PutAsync(key, []byte(fmt.Sprintf("v%d", i)), func(err error) {
+			done <- err
+		})
+	}
+	for i := 0; i < 3; i++ {
+		assert.NotNil(t, <-done)
+	}
+
+	// no more writes are trusted after a failed sync, even if the
+	// syncs would succeed now.
+	assert.ErrorIs(t, db.Put(utils.TestKey(1), utils.RandValue(128)), ErrWriteFailed)
+	batch := db.NewBatch(DefaultBatchOptions)
+	assert.Nil(t, batch.Put(utils.TestKey(2), utils.RandValue(128)))
+	assert.ErrorIs(t, batch.Commit(), ErrWriteFailed)
+	assert.ErrorIs(t, db.Delete(key), ErrWriteFailed)
+
+	assertValues := func(db *DB, values ...string) {
+		versions, err := db.GetHistory(key, 0)
+		assert.Nil(t, err)
+		var got []string
+		for _, v := range versions {
+			got = append(got, string(v.Value))
+		}
+		assert.Equal(t, values, got)
+	}
+	assertValues(db, "v1")
+	assert.Nil(t, db.Close())
+
+	// the failed writes don't come back after reopening, which
+	// accepts the writes again.
+	db, err = Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+	assertValues(db, "v1")
+	assertKeyExistOrNot(t, db, utils.TestKey(1), false)
+	assertKeyExistOrNot(t, db, utils.TestKey(2), false)
+	assert.Nil(t, db.Put(key, []byte("v5")))
+	assertValues(db, "v5", "v1")
+}
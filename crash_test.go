@@ -0,0 +1,284 @@
+package yojoudb
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/berylyvos/yojoudb/utils"
+	"github.com/berylyvos/yojoudb/vfs"
+	"github.com/berylyvos/yojoudb/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// crashStep is a step of the crash workload, which changes the
+// data of the model along with the db.
+type crashStep struct {
+	name  string
+	apply func(db *DB) (*DB, error)
+	model func(m map[string]string)
+}
+
+func crashOptions(fs vfs.FS, configure func(*Options)) Options {
+	options := DefaultOptions
+	options.DirPath = "/yojoudb-crash"
+	options.SegmentSize = 64 * KB
+	options.Sync = true
+	options.FS = fs
+	configure(&options)
+	return options
+}
+
+// crashWorkload returns the steps of puts, deletes, a batch, a merge,
+// and reopening which moves the merged files.
+func crashWorkload() []crashStep {
+	var steps []crashStep
+	put := func(i int, value []byte) {
+		key := utils.TestKey(i)
+		steps = append(steps, crashStep{
+			name: "put " + string(key),
+			apply: func(db *DB) (*DB, error) {
+				return db, db.Put(key, value)
+			},
+			model: func(m map[string]string) {
+				m[string(key)] = string(value)
+			},
+		})
+	}
+	del := func(i int) {
+		key := utils.TestKey(i)
+		steps = append(steps, crashStep{
+			name: "delete " + string(key),
+			apply: func(db *DB) (*DB, error) {
+				return db, db.Delete(key)
+			},
+			model: func(m map[string]string) {
+				delete(m, string(key))
+			},
+		})
+	}
+
+	for i := 0; i < 40; i++ {
+		put(i, utils.RandValue(2*KB))
+	}
+	values := make([][]byte, 10)
+	for i := range values {
+		values[i] = utils.RandValue(KB)
+	}
+	steps = append(steps, crashStep{
+		name: "batch",
+		apply: func(db *DB) (*DB, error) {
+			batch := db.NewBatch(DefaultBatchOptions)
+			for i, value := range values {
+				_ = batch.Put(utils.TestKey(40+i), value)
+			}
+			for i := 0; i < 5; i++ {
+				_ = batch.Delete(utils.TestKey(i))
+			}
+			return db, batch.Commit()
+		},
+		model: func(m map[string]string) {
+			for i, value := range values {
+				m[string(utils.TestKey(40+i))] = string(value)
+			}
+			for i := 0; i < 5; i++ {
+				delete(m, string(utils.TestKey(i)))
+			}
+		},
+	})
+	for i := 5; i < 20; i++ {
+		del(i)
+	}
+	steps = append(steps, crashStep{
+		name:  "merge",
+		apply: func(db *DB) (*DB, error) { return db, db.Merge() },
+		model: func(map[string]string) {},
+	}, crashStep{
+		name: "reopen",
+		apply: func(db *DB) (*DB, error) {
+			if err := db.Close(); err != nil {
+				return db, err
+			}
+			return Open(db.options)
+		},
+		model: func(map[string]string) {},
+	})
+	for i := 20; i < 30; i++ {
+		put(i, utils.RandValue(KB))
+	}
+	return steps
+}
+
+// runCrashWorkload runs the steps until one of them fails, returns
+// the number of the acknowledged steps.
+func runCrashWorkload(options Options, steps []crashStep) int {
+	db, err := Open(options)
+	if err != nil {
+		return 0
+	}
+	acked := 0
+	for _, step := range steps {
+		next, err := step.apply(db)
+		if err != nil {
+			break
+		}
+		db = next
+		acked++
+	}
+	_ = db.Close()
+	return acked
+}
+
+// crashStates returns the data of the model after every step.
+func crashStates(steps []crashStep) []map[string]string {
+	states := []map[string]string{{}}
+	for _, step := range steps {
+		m := make(map[string]string)
+		for k, v := range states[len(states)-1] {
+			m[k] = v
+		}
+		step.model(m)
+		states = append(states, m)
+	}
+	return states
+}
+
+// matchState reports whether the data of the db is the same as the state.
+func matchState(db *DB, state map[string]string) bool {
+	if db.index.Size() != len(state) {
+		return false
+	}
+	for key, value := range state {
+		val, err := db.Get([]byte(key))
+		if err != nil || string(val) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDB_CrashConsistency(t *testing.T) {
+	t.Run("append", func(t *testing.T) {
+		testCrashConsistency(t, func(*Options) {})
+	})
+	t.Run("preallocate", func(t *testing.T) {
+		testCrashConsistency(t, func(o *Options) {
+			o.PreallocateSegments = true
+		})
+	})
+	t.Run("blob", func(t *testing.T) {
+		testCrashConsistency(t, func(o *Options) {
+			o.BlobThreshold = 1536
+		})
+	})
+}
+
+func testCrashConsistency(t *testing.T, configure func(*Options)) {
+	steps := crashWorkload()
+	states := crashStates(steps)
+
+	fs := vfs.NewFault(0)
+	assert.Equal(t, len(steps), runCrashWorkload(crashOptions(fs, configure), steps))
+	total := fs.Ops()
+
+	for seed := int64(1); seed <= 3; seed++ {
+		for n := 0; n < total; n++ {
+			fs := vfs.NewFault(seed*int64(total) + int64(n))
+			fs.CrashAfter(n)
+			acked := runCrashWorkload(crashOptions(fs, configure), steps)
+			options := crashOptions(fs.Crash(), configure)
+
+			// every acknowledged step is durable, the failed one is
+			// all-or-nothing, and the later ones never happen.
+			db, err := Open(options)
+			if !assert.Nil(t, err, "crash after %d ops, seed %d", n, seed) {
+				continue
+			}
+			ok := matchState(db, states[acked])
+			if !ok && acked < len(steps) {
+				ok = matchState(db, states[acked+1])
+				acked++
+			}
+			if !assert.True(t, ok, "crash after %d ops in step %d, seed %d", n, acked, seed) {
+				_ = db.Close()
+				continue
+			}
+
+			// the db is still writable, and the new data is not mixed
+			// up with the torn tail.
+			state := make(map[string]string)
+			for k, v := range states[acked] {
+				state[k] = v
+			}
+			key, value := utils.TestKey(100), utils.RandValue(KB)
+			state[string(key)] = string(value)
+			assert.Nil(t, db.Put(key, value))
+			assert.Nil(t, db.Close())
+			db, err = Open(options)
+			if !assert.Nil(t, err, "crash after %d ops, seed %d", n, seed) {
+				continue
+			}
+			assert.True(t, matchState(db, state), "crash after %d ops in step %d, seed %d", n, acked, seed)
+			_ = db.Close()
+		}
+	}
+}
+
+func TestDB_Open_Corrupted(t *testing.T) {
+	t.Run("append", func(t *testing.T) {
+		testOpenCorrupted(t, func(*Options) {})
+	})
+	t.Run("preallocate", func(t *testing.T) {
+		testOpenCorrupted(t, func(o *Options) {
+			o.PreallocateSegments = true
+		})
+	})
+}
+
+func testOpenCorrupted(t *testing.T, configure func(*Options)) {
+	fs := vfs.NewFault(0)
+	options := crashOptions(fs, configure)
+	db, err := Open(options)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Put(utils.TestKey(i), utils.RandValue(KB)))
+	}
+	end := db.dataFiles.EndLoc()
+	assert.Equal(t, wal.SegmentID(1), end.SegId)
+	assert.Nil(t, db.Close())
+
+	// flips a byte of the data in the active segment, at the offset
+	// from the start of the data.
+	flip := func(fs vfs.FS, offset int64) {
+		name := wal.SegmentFileName(options.DirPath, dataFileSuffix, 1)
+		f, err := fs.OpenFile(name, os.O_RDWR, 0644)
+		assert.Nil(t, err)
+		b := make([]byte, 1)
+		_, err = f.ReadAt(b, wal.SegmentHeaderSize+offset)
+		assert.Nil(t, err)
+		_, err = f.Seek(wal.SegmentHeaderSize+offset, io.SeekStart)
+		assert.Nil(t, err)
+		_, err = f.Write([]byte{b[0] ^ 0x40})
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+	}
+
+	// a synced record corrupted in the middle is not a torn tail,
+	// the records after it must not be discarded silently.
+	crashed := fs.Crash()
+	flip(crashed, 10*KB)
+	_, err = Open(crashOptions(crashed, configure))
+	assert.ErrorIs(t, err, wal.ErrInvalidCRC)
+
+	// the last record corrupted is taken as torn.
+	crashed = fs.Crash()
+	flip(crashed, int64(end.BlockIndex)*32*KB+end.ChunkOffset-10)
+	db, err = Open(crashOptions(crashed, configure))
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+	for i := 0; i < 20; i++ {
+		assertKeyExistOrNot(t, db, utils.TestKey(i), i < 19)
+	}
+}
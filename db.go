@@ -1,17 +1,19 @@
 package yojoudb
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/berylyvos/yojoudb/meta"
 	"github.com/berylyvos/yojoudb/utils"
+	"github.com/berylyvos/yojoudb/vfs"
 	"github.com/berylyvos/yojoudb/wal"
-	"github.com/bwmarrin/snowflake"
-	"github.com/gofrs/flock"
 )
 
 const (
@@ -19,6 +21,7 @@ const (
 	dataFileSuffix = ".SEG"
 	hintFileSuffix = ".HINT"
 	mergeFinSuffix = ".MERGE_FIN"
+	blobFileSuffix = ".BLOB"
 )
 
 // DB is a database instance.
@@ -27,14 +30,27 @@ const (
 // An in-memory index is for holding the keys and the
 // corresponding locations. The index is rebuilt each
 // time the database is restarted.
+//
+// Reads and writes only share the mu, which is held exclusively
+// by Close and the beginning of Merge. All commits go through the
+// committer, which writes them to the WAL in groups and updates
+// the index in the same order, key by key, so the readers may see
+// a batch partly applied, see Batch.
 type DB struct {
 	dataFiles    *wal.WAL
 	hintFile     *wal.WAL
+	blobFiles    *wal.WAL  // nil if there is no blob file.
+	blobRefs     *blobRefs // references to the blob files, nil if there is no blob file.
 	index        meta.Indexer
 	options      Options
-	fileLock     *flock.Flock
+	fileLock     io.Closer
 	mu           sync.RWMutex
+	committer    *committer
+	seq          uint64          // sequence number of the last committed batch.
+	mergedSegId  wal.SegmentID   // id of the last merged segment when opened.
+	mergedHeads  map[string]*Loc // see DB.prevLoc.
 	closed       bool
+	readOnly     bool // recovered to a point in the past.
 	mergeRunning uint32
 	reclaimSize  int64
 	batchPool    sync.Pool
@@ -66,66 +82,226 @@ func Open(options Options) (*DB, error) {
 		return nil, err
 	}
 
-	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
-		if err = os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+	fs := options.fs()
+	if _, err := fs.Stat(options.DirPath); os.IsNotExist(err) {
+		if err = fs.MkdirAll(options.DirPath, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
 
 	// prevent multiple processes from occupying the same database.
-	fileLock := flock.New(filepath.Join(options.DirPath, fileLockName))
-	hold, err := fileLock.TryLock()
+	fileLock, err := lockDir(fs, options.DirPath)
 	if err != nil {
 		return nil, err
 	}
-	if !hold {
+
+	db, err := open(options, fileLock)
+	if err != nil {
+		// release file lock, so that the directory could be
+		// opened again, i.e. after upgrading the data files.
+		_ = fileLock.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// lockDir acquires the file lock of the database directory.
+func lockDir(fs vfs.FS, dirPath string) (io.Closer, error) {
+	fileLock, err := fs.Lock(filepath.Join(dirPath, fileLockName))
+	if err == vfs.ErrLocked {
 		return nil, ErrDatabaseIsUsing
 	}
+	return fileLock, err
+}
 
+func open(options Options, fileLock io.Closer) (*DB, error) {
 	// load merged files if exists
-	if err := loadMergedFiles(options.DirPath); err != nil {
+	if err := loadMergedFiles(options.fs(), options.DirPath); err != nil {
+		return nil, err
+	}
+
+	// open blob files if the values are separated
+	blobFiles, err := openBlobFiles(options)
+	if err != nil {
 		return nil, err
 	}
 
-	// open data files in WAL
+	// open data files in WAL, the blob files are synced before them,
+	// so a durable record never refers to a lost value.
+	var beforeSync func() error
+	if blobFiles != nil {
+		beforeSync = blobFiles.Sync
+	}
 	dataFiles, err := wal.Open(wal.Options{
-		DirPath:        options.DirPath,
-		SegmentSize:    options.SegmentSize,
-		SegmentFileExt: dataFileSuffix,
-		Sync:           options.Sync,
-		BytesPerSync:   options.BytesPerSync,
+		DirPath:         options.DirPath,
+		SegmentSize:     options.SegmentSize,
+		SegmentFileExt:  dataFileSuffix,
+		Sync:            options.Sync,
+		BytesPerSync:    options.BytesPerSync,
+		SyncPolicy:      options.SyncPolicy,
+		SyncInterval:    options.SyncInterval,
+		FS:              options.FS,
+		Preallocate:     options.PreallocateSegments,
+		MmapReads:       options.MmapReads,
+		MaxOpenSegments: options.MaxOpenSegments,
+		BeforeSync:      beforeSync,
 	})
 	if err != nil {
+		if blobFiles != nil {
+			_ = blobFiles.Close()
+		}
 		return nil, err
 	}
 
 	// init db instance
 	db := &DB{
 		dataFiles: dataFiles,
+		blobFiles: blobFiles,
 		options:   options,
-		index:     meta.NewIndexer(options.IndexType),
+		index:     meta.NewShardedIndexer(options.IndexType, options.IndexShards),
 		fileLock:  fileLock,
+		readOnly:  options.RecoverUntil != nil,
 		batchPool: sync.Pool{New: makeBatch},
 	}
+	if blobFiles != nil {
+		db.blobRefs = newBlobRefs()
+	}
 
 	// load index from hint file if there's a merged db
 	if err := db.loadIndexerFromHint(); err != nil {
+		db.closeFiles()
 		return nil, err
 	}
 
 	// load index from data files
-	if err := db.loadIndexer(); err != nil {
+	maxSeq, err := db.loadIndexer()
+	if err != nil {
+		db.closeFiles()
 		return nil, err
 	}
+	db.pruneMergedHeads()
 
+	db.committer = newCommitter(db, maxSeq)
 	return db, nil
 }
 
+// closeFiles closes the data files and blob files on a failed open.
+func (db *DB) closeFiles() {
+	_ = db.dataFiles.Close()
+	if db.blobFiles != nil {
+		_ = db.blobFiles.Close()
+	}
+}
+
+// Fork writes the current data of the database to a new database in the
+// given directory, which must be empty. It's mostly used with a database
+// recovered by Options.RecoverUntil, to continue writing from the point.
+// Only the current version of every key is written. It's not supported
+// by IndexSKL, which can't be iterated.
+func (db *DB) Fork(dirPath string) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrDBClosed
+	}
+	iter := db.index.Iterator(meta.IteratorOpt{})
+	if iter == nil {
+		return ErrIterUnsupported
+	}
+	defer iter.Close()
+
+	// the target is checked before it's opened, which may change the
+	// files in it, i.e. by loading the merged files.
+	fs := db.options.fs()
+	for _, dir := range []string{dirPath, mergeDirPath(dirPath)} {
+		entries, err := fs.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(entries) > 0 {
+			return ErrDirNotEmpty
+		}
+	}
+
+	options := db.options
+	options.DirPath = dirPath
+	options.RecoverUntil = nil
+	fork, err := Open(options)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = fork.Close()
+	}()
+
+	// write the data in batches of about forkBatchSize bytes.
+	const forkBatchSize = 4 * MB
+	batch := fork.NewBatch(BatchOptions{})
+	for ; iter.Valid(); iter.Next() {
+		chunk, err := db.dataFiles.Read(iter.Value())
+		if err != nil {
+			return err
+		}
+		record := decodeLR(chunk)
+		val, err := db.readValue(record)
+		if err != nil {
+			return err
+		}
+		if err = batch.Put(record.Key, val); err != nil {
+			return err
+		}
+		if batch.size >= forkBatchSize {
+			if err = batch.Commit(); err != nil {
+				return err
+			}
+			batch = fork.NewBatch(BatchOptions{})
+		}
+	}
+	if err = batch.Commit(); err != nil {
+		return err
+	}
+	_, err = fork.Sync()
+	return err
+}
+
+// Upgrade upgrades the data files in options.DirPath of options.FS in
+// place, which are written by an old version without the file header.
+// Open returns wal.ErrNoSegmentHeader for such a directory. The database
+// must not be opened while upgrading, and it's safe to run it again
+// after a crash.
+func Upgrade(options Options) error {
+	if err := checkOptions(options); err != nil {
+		return err
+	}
+	fs := options.fs()
+	dirPath := options.DirPath
+	fileLock, err := lockDir(fs, dirPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = fileLock.Close()
+	}()
+
+	dirs := []string{dirPath}
+	if _, err := fs.Stat(mergeDirPath(dirPath)); err == nil {
+		dirs = append(dirs, mergeDirPath(dirPath))
+	}
+	for _, dir := range dirs {
+		for _, ext := range []string{dataFileSuffix, hintFileSuffix, mergeFinSuffix} {
+			if err := wal.Upgrade(fs, dir, ext); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (db *DB) Stat() *Stat {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	dirSize, err := utils.DirSize(db.options.DirPath)
+	dirSize, err := utils.DirSize(db.options.fs(), db.options.DirPath)
 	if err != nil {
 		panic(fmt.Sprintf("failed to get dir size : %v", err))
 	}
@@ -141,11 +317,25 @@ func (db *DB) Close() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.closed {
+		return nil
+	}
+
+	// no more commits since the lock is held, nor after a failed close.
+	db.committer.stop()
+
 	// close wal
 	if err := db.dataFiles.Close(); err != nil {
 		return err
 	}
 
+	// close blob files if exists
+	if db.blobFiles != nil {
+		if err := db.blobFiles.Close(); err != nil {
+			return err
+		}
+	}
+
 	// close hint file if exists
 	if db.hintFile != nil {
 		if err := db.hintFile.Close(); err != nil {
@@ -154,7 +344,7 @@ func (db *DB) Close() error {
 	}
 
 	// release file lock
-	if err := db.fileLock.Unlock(); err != nil {
+	if err := db.fileLock.Close(); err != nil {
 		return err
 	}
 
@@ -163,10 +353,42 @@ func (db *DB) Close() error {
 }
 
 // Sync syncs all data files into disk.
-func (db *DB) Sync() error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.dataFiles.Sync()
+// Returns the end location of the durable data, all the
+// batches committed before it survive a machine crash.
+func (db *DB) Sync() (*Loc, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	// the blob files are synced before the records referring to them.
+	if db.blobFiles != nil {
+		if err := db.blobFiles.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.dataFiles.Sync(); err != nil {
+		return nil, err
+	}
+	return db.dataFiles.DurableLoc(), nil
+}
+
+// LastSequence returns the sequence number of the last committed batch.
+// Every batch is assigned a monotonically increasing sequence number on
+// commit, which is persisted with its records and restored on Open.
+// Returns 0 if nothing has been committed.
+func (db *DB) LastSequence() uint64 {
+	return atomic.LoadUint64(&db.seq)
+}
+
+// SetSyncPolicy changes the sync policy of the data files at runtime.
+// The bytesPerSync is only used by SyncEveryN, and the interval is
+// only used by SyncInterval. The blob files follow the policy, since
+// they are synced before every sync of the data files.
+func (db *DB) SetSyncPolicy(policy SyncPolicy, bytesPerSync uint32, interval time.Duration) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrDBClosed
+	}
+	return db.dataFiles.SetSyncPolicy(policy, bytesPerSync, interval)
 }
 
 // Put puts the given key/val.
@@ -178,7 +400,7 @@ func (db *DB) Put(key K, val V) error {
 	}()
 	batch.init(false, false, db).withPendingWrites()
 	if err := batch.Put(key, val); err != nil {
-		_ = batch.Rollback()
+		batch.Discard()
 		return err
 	}
 	return batch.Commit()
@@ -197,6 +419,45 @@ func (db *DB) Get(key K) (V, error) {
 	return batch.Get(key)
 }
 
+// GetView gets the value of the given key like Get, but without copying
+// it if possible, i.e. with Options.MmapReads, the value in a sealed data
+// file is a slice of the mapping. The value must not be modified, and is
+// only valid until release is called, which must be called once done
+// with the value if the error is nil.
+func (db *DB) GetView(key K) (val V, release func(), err error) {
+	if len(key) == 0 {
+		return nil, nil, ErrKeyEmpty
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, nil, ErrDBClosed
+	}
+	loc := db.index.Get(key)
+	if loc == nil {
+		return nil, nil, ErrKeyNotFound
+	}
+	chunk, release, err := db.dataFiles.ReadView(loc)
+	if err != nil {
+		return nil, nil, err
+	}
+	record := decodeLRView(chunk)
+	if record.Type == LRDeleted {
+		panic("Deleted data cannot exist in the in-memory index")
+	}
+	if record.Blob == nil {
+		return record.Val, release, nil
+	}
+
+	// the separated value is a view of the blob file.
+	blob := record.Blob
+	release()
+	if db.blobFiles == nil {
+		return nil, nil, ErrBlobNotFound
+	}
+	return db.blobFiles.ReadView(blob)
+}
+
 // Delete deletes the given key.
 func (db *DB) Delete(key K) error {
 	batch := db.batchPool.Get().(*Batch)
@@ -206,12 +467,161 @@ func (db *DB) Delete(key K) error {
 	}()
 	batch.init(false, false, db).withPendingWrites()
 	if err := batch.Delete(key); err != nil {
-		_ = batch.Rollback()
+		batch.Discard()
 		return err
 	}
 	return batch.Commit()
 }
 
+// DeleteRange deletes all keys in [start, end) atomically, the range
+// is unbounded above if end is empty. A single range tombstone is
+// written no matter how many keys are covered. It's not supported by
+// IndexSKL, which can't be iterated.
+func (db *DB) DeleteRange(start, end K) error {
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return ErrInvalidRange
+	}
+	// the covered keys are found by iterating the index.
+	if db.options.IndexType == IndexSKL {
+		return ErrRangeDelUnsupported
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrDBClosed
+	}
+	if db.readOnly {
+		return ErrReadOnlyDB
+	}
+	return db.committer.commit([]*LR{{
+		Key:  start,
+		Val:  end,
+		Type: LRRangeDel,
+	}}, false)
+}
+
+// DeletePrefix deletes all keys with the given prefix atomically.
+func (db *DB) DeletePrefix(prefix K) error {
+	if len(prefix) == 0 {
+		return ErrKeyEmpty
+	}
+	return db.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// deleteRange deletes the keys in [start, end) from the index,
+// the range is unbounded above if end is empty. The keys are found
+// by the ordered index without a full scan, or by iterating the index
+// if it can't find them, i.e. IndexHash. Returns ErrRangeDelUnsupported
+// if neither is supported, i.e. IndexSKL.
+func (db *DB) deleteRange(start, end K) error {
+	var keys []K
+	r, ok := db.index.(meta.Ranger)
+	if ok {
+		keys, ok = r.Range(start, end)
+	}
+	if !ok {
+		iter := db.index.Iterator(meta.IteratorOpt{})
+		if iter == nil {
+			return ErrRangeDelUnsupported
+		}
+		defer iter.Close()
+		for ; iter.Valid(); iter.Next() {
+			if key := iter.Key(); inRange(key, start, end) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	for _, key := range keys {
+		db.index.Delete(key)
+		db.trackBlob(key, nil)
+	}
+	return nil
+}
+
+// inRange reports whether the key is in [start, end),
+// the range is unbounded above if end is empty.
+func inRange(key, start, end K) bool {
+	return bytes.Compare(key, start) >= 0 &&
+		(len(end) == 0 || bytes.Compare(key, end) < 0)
+}
+
+// prefixEnd returns the smallest key greater than all keys with the
+// given prefix, or nil if there is no such key.
+func prefixEnd(prefix K) K {
+	end := append(K{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// PutAsync puts the given key/val without waiting, cb is called with
+// the result once it's written. See BatchAsync for the details.
+func (db *DB) PutAsync(key K, val V, cb func(error)) {
+	batch := db.batchPool.Get().(*Batch)
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	batch.init(false, false, db).withPendingWrites()
+	if err := batch.Put(key, val); err != nil {
+		batch.Discard()
+		callback(cb, err)
+		return
+	}
+	batch.commitAsync(asyncCallback(cb))
+}
+
+// DeleteAsync deletes the given key without waiting, cb is called with
+// the result once it's written. See BatchAsync for the details.
+func (db *DB) DeleteAsync(key K, cb func(error)) {
+	batch := db.batchPool.Get().(*Batch)
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	batch.init(false, false, db).withPendingWrites()
+	if err := batch.Delete(key); err != nil {
+		batch.Discard()
+		callback(cb, err)
+		return
+	}
+	batch.commitAsync(asyncCallback(cb))
+}
+
+// BatchAsync commits the batch without waiting, cb is called with the
+// result once the batch is written and visible to reads. The batch is
+// done after the call, as if Commit has been called.
+//
+// The async writes are queued into the write pipeline in the order of
+// the calls, and written in the same order, so the writes of a key from
+// the same goroutine are never reordered. The key and val must not be
+// modified until cb is called.
+//
+// cb is called on the write pipeline goroutine, it must not block or
+// call back into the db. Close and Merge wait for all queued writes
+// and calls their cb, the async writes after Close fail immediately
+// with ErrDBClosed. The cb could be nil if the result is not needed.
+func (db *DB) BatchAsync(batch *Batch, cb func(error)) {
+	batch.commitAsync(asyncCallback(cb))
+}
+
+func asyncCallback(cb func(error)) func(error) {
+	if cb == nil {
+		return func(error) {}
+	}
+	return cb
+}
+
+func callback(cb func(error), err error) {
+	if cb != nil {
+		cb(err)
+	}
+}
+
 // Exist checks if the given key exists.
 func (db *DB) Exist(key K) (bool, error) {
 	batch := db.batchPool.Get().(*Batch)
@@ -226,13 +636,12 @@ func (db *DB) Exist(key K) (bool, error) {
 
 // ListKeys returns all keys in db instance.
 func (db *DB) ListKeys() [][]byte {
-	keys := make([][]byte, db.index.Size())
+	// the size is only a hint, the keys may be added concurrently.
+	keys := make([][]byte, 0, db.index.Size())
 	it := db.NewIterator(DefaultIteratorOptions)
 	defer it.Close()
-	idx := 0
 	for it.Rewind(); it.Valid(); it.Next() {
-		keys[idx] = it.Key()
-		idx++
+		keys = append(keys, it.Key())
 	}
 	return keys
 }
@@ -256,66 +665,6 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 	return nil
 }
 
-// loadIndexer loads index from WAL.
-// It will iterate all over the WAL files and
-// read data from them to rebuild the index.
-func (db *DB) loadIndexer() error {
-	mergeFinSegId, err := getMergeFinSegId(db.options.DirPath)
-	if err != nil {
-		return err
-	}
-
-	// batchId => indexRecords
-	indexRecords := make(map[uint64][]*IndexRecord)
-
-	reader := db.dataFiles.NewReader()
-	for {
-		// skip the segments which segId is less than or equal to mergeFinSegId,
-		// their indexes has already been loaded through hint file.
-		if reader.CurrSegId() <= mergeFinSegId {
-			reader.Skip()
-			continue
-		}
-
-		chunk, loc, err := reader.Next()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-		record := decodeLR(chunk)
-
-		// if reaching to end-of-batch,
-		// put or delete all records in the batch to index.
-		if record.Type == LRBatchFin {
-			snowflakeId, err := snowflake.ParseBytes(record.Key)
-			if err != nil {
-				return err
-			}
-			batchId := uint64(snowflakeId)
-			for _, idxRec := range indexRecords[batchId] {
-				if idxRec.typ == LRNormal {
-					db.index.Put(idxRec.key, idxRec.loc)
-				}
-				if idxRec.typ == LRDeleted {
-					db.index.Delete(idxRec.key)
-				}
-			}
-			delete(indexRecords, batchId)
-		} else {
-			indexRecords[record.BatchId] = append(indexRecords[record.BatchId],
-				&IndexRecord{
-					key: record.Key,
-					typ: record.Type,
-					loc: loc,
-				})
-		}
-	}
-
-	return nil
-}
-
 func checkOptions(options Options) error {
 	if options.DirPath == "" {
 		return ErrDirPathIsEmpty
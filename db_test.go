@@ -1,12 +1,19 @@
 package yojoudb
 
 import (
+	"fmt"
 	"github.com/berylyvos/yojoudb/utils"
+	"github.com/berylyvos/yojoudb/vfs"
+	"github.com/berylyvos/yojoudb/wal"
+	"github.com/bwmarrin/snowflake"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 )
 
 func destroyDB(db *DB) {
@@ -77,10 +84,614 @@ func TestDB_Close_Sync(t *testing.T) {
 	assert.Nil(t, err)
 	defer destroyDB(db)
 
-	err = db.Sync()
+	_, err = db.Sync()
 	assert.Nil(t, err)
 }
 
+func TestDB_Close_Failed(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Nil(t, db.Put(utils.TestKey(1), utils.RandValue(128)))
+
+	// a close failing after the committer is stopped leaves the db
+	// open, the writes are rejected and the close can be retried.
+	db.mu.Lock()
+	db.committer.stop()
+	db.mu.Unlock()
+	assert.Equal(t, ErrDBClosed, db.Put(utils.TestKey(2), utils.RandValue(128)))
+	done := make(chan error, 1)
+	db.PutAsync(utils.TestKey(2), utils.RandValue(128), func(err error) {
+		done <- err
+	})
+	assert.Equal(t, ErrDBClosed, <-done)
+	assert.Nil(t, db.Merge())
+	assertKeyExistOrNot(t, db, utils.TestKey(1), true)
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_SetSyncPolicy(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	err = db.Put(utils.TestKey(1), utils.RandValue(128))
+	assert.Nil(t, err)
+	loc, err := db.Sync()
+	assert.Nil(t, err)
+	assert.True(t, loc.ChunkOffset > 0)
+
+	err = db.SetSyncPolicy(SyncEveryN, 0, 0)
+	assert.Equal(t, wal.ErrInvalidSyncPolicy, err)
+	err = db.SetSyncPolicy(SyncInterval, 0, 10*time.Millisecond)
+	assert.Nil(t, err)
+	err = db.Put(utils.TestKey(2), utils.RandValue(128))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return db.dataFiles.DurableLoc().ChunkOffset > loc.ChunkOffset
+	}, time.Second, 5*time.Millisecond)
+
+	err = db.SetSyncPolicy(SyncEveryWrite, 0, 0)
+	assert.Nil(t, err)
+	err = db.Put(utils.TestKey(3), utils.RandValue(128))
+	assert.Nil(t, err)
+	loc = db.dataFiles.DurableLoc()
+	synced, err := db.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, loc, synced)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	err = db.SetSyncPolicy(SyncNever, 0, 0)
+	assert.Equal(t, ErrDBClosed, err)
+}
+
+func TestDB_PutAsync(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// the writes of a key are kept in order
+	var results []error
+	n := 1000
+	for i := 0; i < n; i++ {
+		db.PutAsync(utils.TestKey(i%10), utils.TestKey(i), func(err error) {
+			results = append(results, err)
+		})
+	}
+	db.DeleteAsync(utils.TestKey(0), func(err error) {
+		results = append(results, err)
+	})
+	batch := db.NewBatch(DefaultBatchOptions)
+	assert.Nil(t, batch.Put(utils.TestKey(1), []byte("batch")))
+	db.BatchAsync(batch, func(err error) {
+		results = append(results, err)
+	})
+	db.PutAsync(nil, nil, func(err error) {
+		assert.Equal(t, ErrKeyEmpty, err)
+	})
+	db.PutAsync(utils.TestKey(2), []byte("no callback"), nil)
+
+	// Close waits for all pending writes
+	err = db.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, n+2, len(results))
+	for _, err := range results {
+		assert.Nil(t, err)
+	}
+	db.PutAsync(utils.TestKey(3), []byte("closed"), func(err error) {
+		assert.Equal(t, ErrDBClosed, err)
+	})
+
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	_, err = db2.Get(utils.TestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.TestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("batch"), val)
+	val, err = db2.Get(utils.TestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("no callback"), val)
+	for i := 3; i < 10; i++ {
+		val, err = db2.Get(utils.TestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.TestKey(n-10+i), val)
+	}
+}
+
+func TestDB_LastSequence(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 4 * MB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Equal(t, uint64(0), db.LastSequence())
+
+	generateData(t, db, 0, 10000, 1024)
+	assert.Equal(t, uint64(10000), db.LastSequence())
+	batch := db.NewBatch(DefaultBatchOptions)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, batch.Put(utils.TestKey(i), utils.RandValue(16)))
+	}
+	assert.Nil(t, batch.Commit())
+	assert.Equal(t, uint64(10001), db.LastSequence())
+	// nothing to commit
+	assert.Nil(t, db.NewBatch(DefaultBatchOptions).Commit())
+	assert.Equal(t, uint64(10001), db.LastSequence())
+
+	// restored on reopen
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10001), db.LastSequence())
+
+	// restored after merge, without the end-of-batch records
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10001), db.LastSequence())
+	assert.Nil(t, db.Delete(utils.TestKey(1)))
+	assert.Equal(t, uint64(10002), db.LastSequence())
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10002), db.LastSequence())
+	assertKeyExistOrNot(t, db, utils.TestKey(1), false)
+	assertKeyExistOrNot(t, db, utils.TestKey(2), true)
+
+	// the sequence number of a batch without an end is not reused
+	_, err = db.dataFiles.Write(encodeLR(&LR{Key: []byte("torn"), Val: []byte("v"), BatchId: 10003}))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10002), db.LastSequence())
+	assert.Nil(t, db.Put([]byte("next"), []byte("v")))
+	assert.Equal(t, uint64(10004), db.LastSequence())
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assertKeyExistOrNot(t, db, []byte("torn"), false)
+	assertKeyExistOrNot(t, db, []byte("next"), true)
+}
+
+func TestDB_Upgrade(t *testing.T) {
+	fs := vfs.NewMem()
+	options := DefaultOptions
+	options.DirPath = "/yojoudb-upgrade"
+	options.SegmentSize = 4 * MB
+	options.FS = fs
+	db, err := Open(options)
+	assert.Nil(t, err)
+	generateData(t, db, 0, 5000, 1024)
+	assert.Nil(t, db.Merge())
+	generateData(t, db, 5000, 10000, 1024)
+	assert.Nil(t, db.Close())
+
+	// reopen to load the merged files, then strip the headers
+	// of all files to make a legacy directory
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	assert.True(t, stripHeaders(t, fs, options.DirPath) > 3)
+
+	_, err = Open(options)
+	assert.ErrorIs(t, err, wal.ErrNoSegmentHeader)
+	assert.Nil(t, Upgrade(options))
+
+	db, err = Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	for i := 0; i < 10000; i++ {
+		assertKeyExistOrNot(t, db, utils.TestKey(i), true)
+	}
+	assert.Equal(t, uint64(10000), db.LastSequence())
+}
+
+func TestDB_Upgrade_IncompleteBatch(t *testing.T) {
+	fs := vfs.NewMem()
+	options := DefaultOptions
+	options.DirPath = "/yojoudb-upgrade-incomplete"
+	options.FS = fs
+
+	// the old version writes the batches with snowflake ids, and ends
+	// every batch with a record keyed by the id.
+	dataFiles, err := wal.Open(wal.Options{
+		DirPath:        options.DirPath,
+		SegmentSize:    options.SegmentSize,
+		SegmentFileExt: dataFileSuffix,
+		FS:             fs,
+	})
+	assert.Nil(t, err)
+	node, err := snowflake.NewNode(1)
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		batchId := node.Generate()
+		for j := 0; j < 10; j++ {
+			rec := &LR{Key: utils.TestKey(i*10 + j), Val: utils.RandValue(128), BatchId: uint64(batchId)}
+			_, err = dataFiles.Write(encodeLR(rec))
+			assert.Nil(t, err)
+		}
+		// the last batch is incomplete
+		if i == 0 {
+			_, err = dataFiles.Write(encodeLR(&LR{Key: batchId.Bytes(), Type: LRBatchFin}))
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, dataFiles.Close())
+	assert.Equal(t, 1, stripHeaders(t, fs, options.DirPath))
+	assert.Nil(t, Upgrade(options))
+
+	// the snowflake id of the incomplete batch is not a sequence number
+	for i := 0; i < 2; i++ {
+		db, err := Open(options)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i), db.LastSequence())
+		for j := 0; j < 20; j++ {
+			assertKeyExistOrNot(t, db, utils.TestKey(j), j < 10)
+		}
+		if i == 0 {
+			assert.Nil(t, db.Put(utils.TestKey(20), utils.RandValue(128)))
+			assert.Equal(t, uint64(1), db.LastSequence())
+			assert.Nil(t, db.Close())
+			continue
+		}
+		assertKeyExistOrNot(t, db, utils.TestKey(20), true)
+		destroyDB(db)
+	}
+}
+
+// stripHeaders strips the headers of the data files, the hint files and
+// the MERGE_FIN file in the directory, to make a legacy directory.
+// Returns the number of stripped files.
+func stripHeaders(t *testing.T, fs vfs.FS, dirPath string) int {
+	entries, err := fs.ReadDir(dirPath)
+	assert.Nil(t, err)
+	var stripped int
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if ext != dataFileSuffix && ext != hintFileSuffix && ext != mergeFinSuffix {
+			continue
+		}
+		name := filepath.Join(dirPath, entry.Name())
+		f, err := fs.OpenFile(name, os.O_RDWR, 0644)
+		assert.Nil(t, err)
+		data, err := io.ReadAll(f)
+		assert.Nil(t, err)
+		assert.Nil(t, f.Truncate(0))
+		_, err = f.Seek(0, io.SeekStart)
+		assert.Nil(t, err)
+		_, err = f.Write(data[wal.SegmentHeaderSize:])
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+		stripped++
+	}
+	return stripped
+}
+
+func TestDB_RecoverUntil(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	generateData(t, db, 0, 100, 128)
+	assert.Nil(t, db.Put([]byte("key"), []byte("v1")))
+	seq := db.LastSequence()
+	time.Sleep(10 * time.Millisecond)
+	point := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, db.Put([]byte("key"), []byte("v2")))
+	assert.Nil(t, db.Delete(utils.TestKey(1)))
+	assert.Nil(t, db.Close())
+
+	forkDir, _ := os.MkdirTemp("", "yojoudb-fork-")
+	for _, until := range []*RecoveryPoint{{Seq: seq}, {Time: point}} {
+		options.RecoverUntil = until
+		db, err = Open(options)
+		assert.Nil(t, err)
+		assert.Equal(t, seq, db.LastSequence())
+		val, err := db.Get([]byte("key"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1"), val)
+		assertKeyExistOrNot(t, db, utils.TestKey(1), true)
+
+		// read-only
+		assert.Equal(t, ErrReadOnlyDB, db.Put([]byte("key"), []byte("v3")))
+		db.PutAsync([]byte("key"), []byte("v3"), func(err error) {
+			assert.Equal(t, ErrReadOnlyDB, err)
+		})
+		assert.Equal(t, ErrReadOnlyDB, db.Merge())
+
+		if until.Seq > 0 {
+			assert.Nil(t, db.Fork(forkDir))
+		} else {
+			// the non-empty target is left untouched.
+			files := func() []string {
+				entries, err := os.ReadDir(forkDir)
+				assert.Nil(t, err)
+				var files []string
+				for _, entry := range entries {
+					info, err := entry.Info()
+					assert.Nil(t, err)
+					files = append(files, fmt.Sprint(entry.Name(), info.Size(), info.ModTime()))
+				}
+				return files
+			}
+			// a torn tail would be truncated by opening it.
+			f, err := os.OpenFile(wal.SegmentFileName(forkDir, dataFileSuffix, 1), os.O_WRONLY|os.O_APPEND, 0644)
+			assert.Nil(t, err)
+			_, err = f.Write([]byte("torn"))
+			assert.Nil(t, err)
+			assert.Nil(t, f.Close())
+			before := files()
+			assert.Equal(t, ErrDirNotEmpty, db.Fork(forkDir))
+			assert.Equal(t, before, files())
+		}
+		assert.Nil(t, db.Close())
+	}
+
+	// the fork is writable from the recovery point
+	forkOptions := DefaultOptions
+	forkOptions.DirPath = forkDir
+	fork, err := Open(forkOptions)
+	assert.Nil(t, err)
+	val, err := fork.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	assert.Equal(t, 101, fork.index.Size())
+	assert.Nil(t, fork.Put([]byte("key"), []byte("v3")))
+	destroyDB(fork)
+
+	// the later batches are still there
+	options.RecoverUntil = nil
+	db, err = Open(options)
+	assert.Nil(t, err)
+	val, err = db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	// the skiplist index can't be iterated, nothing is written.
+	sklOptions := options
+	sklOptions.IndexType = IndexSKL
+	db, err = Open(sklOptions)
+	assert.Nil(t, err)
+	sklForkDir, _ := os.MkdirTemp("", "yojoudb-fork-skl-")
+	defer func() {
+		_ = os.RemoveAll(sklForkDir)
+	}()
+	assert.Equal(t, ErrIterUnsupported, db.Fork(sklForkDir))
+	entries, err := os.ReadDir(sklForkDir)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+	assert.Nil(t, db.Close())
+
+	// can't recover the merged data
+	options.RecoverUntil = &RecoveryPoint{Seq: seq}
+	_, err = Open(options)
+	assert.Equal(t, ErrRecoverBeforeMerge, err)
+	options.RecoverUntil = nil
+	db, err = Open(options)
+	assert.Nil(t, err)
+	destroyDB(db)
+}
+
+func TestDB_DeleteRange(t *testing.T) {
+	for _, indexType := range []IndexType{IndexBTree, IndexART, IndexHash} {
+		options := DefaultOptions
+		options.DirPath, _ = os.MkdirTemp("", "yojoudb-range-")
+		options.IndexType = indexType
+		options.KeepVersions = 2
+		db, err := Open(options)
+		assert.Nil(t, err)
+
+		for _, tenant := range []string{"a", "b", "b\xff", "c"} {
+			for i := 0; i < 100; i++ {
+				err = db.Put([]byte(fmt.Sprintf("%s/%03d", tenant, i)), utils.RandValue(128))
+				assert.Nil(t, err)
+			}
+		}
+		assert.Equal(t, ErrKeyEmpty, db.DeletePrefix(nil))
+		assert.Equal(t, ErrInvalidRange, db.DeleteRange([]byte("b"), []byte("a")))
+
+		assert.Nil(t, db.DeletePrefix([]byte("b")))
+		assert.Nil(t, db.DeleteRange([]byte("a/050"), []byte("a/060")))
+		assert.Equal(t, 200-10, db.index.Size())
+		assertKeyExistOrNot(t, db, []byte("b/000"), false)
+		assertKeyExistOrNot(t, db, []byte("b\xff/099"), false)
+		assertKeyExistOrNot(t, db, []byte("a/049"), true)
+		assertKeyExistOrNot(t, db, []byte("a/055"), false)
+		assertKeyExistOrNot(t, db, []byte("a/060"), true)
+
+		// a key written again has no previous version
+		assert.Nil(t, db.Put([]byte("b/000"), []byte("v")))
+		history, err := db.GetHistory([]byte("b/000"), 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(history))
+
+		// the range deletion is replayed
+		assert.Nil(t, db.Close())
+		db, err = Open(options)
+		assert.Nil(t, err)
+		assert.Equal(t, 200-10+1, db.index.Size())
+		assertKeyExistOrNot(t, db, []byte("a/055"), false)
+		assertKeyExistOrNot(t, db, []byte("b/000"), true)
+
+		// unbounded above
+		assert.Nil(t, db.DeleteRange([]byte("c/090"), nil))
+		assertKeyExistOrNot(t, db, []byte("c/089"), true)
+		assertKeyExistOrNot(t, db, []byte("c/099"), false)
+
+		// the covered records are dropped by merge
+		assert.Nil(t, db.Merge())
+		assert.Nil(t, db.Close())
+		db, err = Open(options)
+		assert.Nil(t, err)
+		assert.Equal(t, 200-10+1-10, db.index.Size())
+		assertKeyExistOrNot(t, db, []byte("b/001"), false)
+		assertKeyExistOrNot(t, db, []byte("c/099"), false)
+		destroyDB(db)
+	}
+
+	// the index can't be iterated, nothing is written.
+	options := DefaultOptions
+	options.DirPath, _ = os.MkdirTemp("", "yojoudb-range-")
+	options.IndexType = IndexSKL
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Nil(t, db.Put([]byte("a/000"), []byte("v")))
+	assert.Equal(t, ErrRangeDelUnsupported, db.DeletePrefix([]byte("a")))
+	assert.Equal(t, ErrRangeDelUnsupported, db.DeleteRange([]byte("a"), nil))
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assertKeyExistOrNot(t, db, []byte("a/000"), true)
+
+	// the range deletion written with another index type can't be
+	// replayed, rather than bringing the deleted keys back.
+	assert.Nil(t, db.Close())
+	options.IndexType = IndexBTree
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.Nil(t, db.DeletePrefix([]byte("a")))
+	assert.Nil(t, db.Close())
+	options.IndexType = IndexSKL
+	_, err = Open(options)
+	assert.Equal(t, ErrRangeDelUnsupported, err)
+}
+
+func TestDB_DeleteRange_SyncPolicy(t *testing.T) {
+	options := DefaultOptions
+	options.Sync = true
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// the range deletion follows the sync policy set at runtime
+	assert.Nil(t, db.SetSyncPolicy(SyncNever, 0, 0))
+	durable := db.dataFiles.DurableLoc()
+	assert.Nil(t, db.Put([]byte("a/000"), []byte("v")))
+	assert.Nil(t, db.DeletePrefix([]byte("a")))
+	assert.Equal(t, durable, db.dataFiles.DurableLoc())
+	assert.NotEqual(t, db.dataFiles.EndLoc(), db.dataFiles.DurableLoc())
+}
+
+func TestDB_MemFS(t *testing.T) {
+	options := DefaultOptions
+	options.DirPath = "/yojoudb-mem"
+	options.SegmentSize = 4 * MB
+	options.FS = vfs.NewMem()
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+	_, err = Open(options)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+
+	generateData(t, db, 0, 20000, 512)
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Delete(utils.TestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.True(t, db.Stat().DiskSize > 0)
+	assert.Nil(t, db.Close())
+
+	// nothing on the disk
+	_, err = os.Stat(options.DirPath)
+	assert.True(t, os.IsNotExist(err))
+
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.Equal(t, 10000, db.index.Size())
+	assertKeyExistOrNot(t, db, utils.TestKey(9999), false)
+	assertKeyExistOrNot(t, db, utils.TestKey(10000), true)
+}
+
+func TestDB_GetView(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 64 * KB
+	options.MmapReads = true
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 200, 1024)
+	assert.Nil(t, db.Put(utils.TestKey(200), utils.RandValue(40*KB)))
+	assert.True(t, db.dataFiles.ActiveSegID() > 1)
+	for i := 0; i <= 200; i++ {
+		val, err := db.Get(utils.TestKey(i))
+		assert.Nil(t, err)
+		view, release, err := db.GetView(utils.TestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, val, view)
+		release()
+	}
+
+	_, _, err = db.GetView(utils.TestKey(201))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, _, err = db.GetView(nil)
+	assert.Equal(t, ErrKeyEmpty, err)
+
+	// the value stays valid after the db is closed until released.
+	val, err := db.Get(utils.TestKey(0))
+	assert.Nil(t, err)
+	view, release, err := db.GetView(utils.TestKey(0))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	assert.Equal(t, val, view)
+	release()
+	_, _, err = db.GetView(utils.TestKey(0))
+	assert.Equal(t, ErrDBClosed, err)
+}
+
+func TestDB_MaxOpenSegments(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 64 * KB
+	options.MaxOpenSegments = 3
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 1000, 1024)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.TestKey(i)))
+	}
+	assert.True(t, db.dataFiles.ActiveSegID() > 10)
+	for i := 0; i < 1000; i++ {
+		assertKeyExistOrNot(t, db, utils.TestKey(i), i >= 500)
+	}
+
+	// the merge reads the data files held by its reader, while the
+	// later reads may close them.
+	assert.Nil(t, db.Merge())
+	for i := 0; i < 1000; i++ {
+		assertKeyExistOrNot(t, db, utils.TestKey(i), i >= 500)
+	}
+
+	assert.Nil(t, db.Close())
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	for i := 0; i < 1000; i++ {
+		assertKeyExistOrNot(t, db2, utils.TestKey(i), i >= 500)
+	}
+}
+
 func TestDB_Concurrent_Put(t *testing.T) {
 	options := DefaultOptions
 	db, err := Open(options)
@@ -110,3 +721,119 @@ func TestDB_Concurrent_Put(t *testing.T) {
 	})
 	assert.Equal(t, count, db.index.Size())
 }
+
+func TestDB_Open_LoadIndexer(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 4 * MB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 20000, KB)
+	for i := 0; i < 20000; i += 3 {
+		err := db.Delete(utils.TestKey(i))
+		assert.Nil(t, err)
+	}
+	// a batch spanning several segments
+	batch := db.NewBatch(DefaultBatchOptions)
+	for i := 20000; i < 30000; i++ {
+		err := batch.Put(utils.TestKey(i), utils.RandValue(KB))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, batch.Commit())
+	_ = db.Close()
+
+	var loaded, total int
+	options.OpenProgress = func(l, t int) {
+		loaded, total = l, t
+	}
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.True(t, total > 1)
+	assert.Equal(t, total, loaded)
+
+	for i := 0; i < 30000; i++ {
+		assertKeyExistOrNot(t, db2, utils.TestKey(i), i >= 20000 || i%3 != 0)
+	}
+}
+
+func TestDB_Concurrent_Put_Get(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 1000, 128)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		// writers of the same keys
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 2000; j++ {
+				err := db.Put(utils.TestKey(j%1000), utils.RandValue(128))
+				assert.Nil(t, err)
+			}
+		}()
+		// readers
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 2000; j++ {
+				val, err := db.Get(utils.TestKey(j % 1000))
+				assert.Nil(t, err)
+				assert.Equal(t, 128, len(val))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the index must agree with the WAL after reopening
+	want := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.TestKey(i))
+		assert.Nil(t, err)
+		want[string(utils.TestKey(i))] = val
+	}
+	_ = db.Close()
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	for key, val := range want {
+		got, err := db2.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, val, got)
+	}
+}
+
+func TestDB_ListKeys_Concurrent_Put(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 1000, 128)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1000; i < 5000; i++ {
+			err := db.Put(utils.TestKey(i), utils.RandValue(128))
+			assert.Nil(t, err)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			assert.Equal(t, 5000, len(db.ListKeys()))
+			return
+		default:
+			assert.True(t, len(db.ListKeys()) >= 1000)
+		}
+	}
+}
@@ -3,14 +3,29 @@ package yojoudb
 import "errors"
 
 var (
-	ErrKeyEmpty    = errors.New("the key is empty")
-	ErrKeyNotFound = errors.New("key is not found in database")
+	ErrKeyEmpty     = errors.New("the key is empty")
+	ErrKeyNotFound  = errors.New("key is not found in database")
+	ErrBlobNotFound = errors.New("the blob file of the value is not found")
+	ErrInvalidRange = errors.New("the start of the range must be less than the end")
+	ErrNegativeSize = errors.New("the size of the value is negative")
+
+	ErrRangeDelUnsupported = errors.New("range deletion is not supported by the index type")
+	ErrIterUnsupported     = errors.New("iteration is not supported by the index type")
 
 	ErrDirPathIsEmpty          = errors.New("database dir path is empty")
 	ErrDataFileSizeNotPositive = errors.New("database data file size must be greater than 0")
 	ErrDatabaseIsUsing         = errors.New("the database directory is used by another process")
+	ErrDirNotEmpty             = errors.New("the database directory is not empty")
 
 	ErrDBClosed       = errors.New("the database is closed")
 	ErrReadOnlyBatch  = errors.New("the batch is read only")
+	ErrBatchCommitted = errors.New("the batch is committed")
+	ErrBatchDiscarded = errors.New("the batch is discarded")
+	ErrBatchTooLarge  = errors.New("the batch exceeds its max size")
+	ErrNoSavepoint    = errors.New("there is no savepoint in the batch")
 	ErrMergeIsRunning = errors.New("merge is in progress, try again later")
+	ErrWriteFailed    = errors.New("the database stopped writing after a failed write, reopen it to recover")
+
+	ErrReadOnlyDB         = errors.New("the database is opened read-only")
+	ErrRecoverBeforeMerge = errors.New("the recovery point is before the last merge")
 )
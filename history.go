@@ -0,0 +1,120 @@
+package yojoudb
+
+import (
+	"bytes"
+	"time"
+)
+
+// Version is a version of the value of a key.
+type Version struct {
+	Value V
+	// Seq is the sequence number of the batch which wrote the version.
+	Seq uint64
+	// Timestamp is the commit time of the version,
+	// zero if it's written without multiple versions.
+	Timestamp time.Time
+}
+
+// GetHistory returns the versions of the key from the newest, which
+// is the current value, to the oldest kept one, at most limit versions.
+// If limit is not greater than 0, all kept versions are returned.
+// See Options.KeepVersions for which versions are kept.
+func (db *DB) GetHistory(key K, limit int) ([]*Version, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyEmpty
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	var (
+		versions []*Version
+		readErr  error
+	)
+	err := db.walkVersions(key, db.index.Get(key), time.Now(), func(rec *LR, _ *Loc) bool {
+		if rec.Val, readErr = db.readValue(rec); readErr != nil {
+			return false
+		}
+		versions = append(versions, newVersion(rec))
+		return limit <= 0 || len(versions) < limit
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// GetAt returns the value of the key as of the given sequence number,
+// that is the newest kept version written by a batch whose sequence
+// number is less than or equal to seq.
+func (db *DB) GetAt(key K, seq uint64) (V, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyEmpty
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	var (
+		val     V
+		found   bool
+		readErr error
+	)
+	err := db.walkVersions(key, db.index.Get(key), time.Now(), func(rec *LR, _ *Loc) bool {
+		if rec.BatchId <= seq {
+			val, readErr = db.readValue(rec)
+			found = true
+		}
+		return !found
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+	return val, nil
+}
+
+func newVersion(rec *LR) *Version {
+	v := &Version{Value: rec.Val, Seq: rec.BatchId}
+	if rec.Timestamp != 0 {
+		v.Timestamp = time.Unix(0, rec.Timestamp)
+	}
+	return v
+}
+
+// walkVersions calls fn on the kept versions of the key from the newest
+// one at loc, following the locations of the previous versions, until
+// fn returns false. Returns ErrKeyNotFound if loc is nil.
+func (db *DB) walkVersions(key K, loc *Loc, now time.Time, fn func(rec *LR, loc *Loc) bool) error {
+	if loc == nil {
+		return ErrKeyNotFound
+	}
+	var lastSeq uint64
+	for i := 0; loc != nil; i++ {
+		chunk, err := db.dataFiles.Read(loc)
+		if err != nil {
+			return err
+		}
+		rec := decodeLR(chunk)
+		if i > 0 && (rec.Type != LRNormal || !bytes.Equal(rec.Key, key) || rec.BatchId >= lastSeq) {
+			return nil
+		}
+		if !db.options.retained(i, rec.Timestamp, now) || !fn(rec, loc) {
+			return nil
+		}
+		lastSeq, loc = rec.BatchId, db.prevLoc(key, loc, rec)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package yojoudb
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/berylyvos/yojoudb/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_GetHistory(t *testing.T) {
+	options := DefaultOptions
+	options.KeepVersions = 3
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	key := []byte("key")
+	_, err = db.GetHistory(key, 0)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	var seqs []uint64
+	for i := 1; i <= 5; i++ {
+		assert.Nil(t, db.Put(key, []byte(fmt.Sprintf("v%d", i))))
+		seqs = append(seqs, db.LastSequence())
+	}
+	assert.Nil(t, db.Put([]byte("other"), []byte("other")))
+
+	assertHistory := func(db *DB, values ...string) {
+		versions, err := db.GetHistory(key, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, len(values), len(versions))
+		for i, v := range versions {
+			assert.Equal(t, values[i], string(v.Value))
+			assert.WithinDuration(t, time.Now(), v.Timestamp, time.Minute)
+			if i > 0 {
+				assert.Less(t, v.Seq, versions[i-1].Seq)
+			}
+		}
+	}
+	assertHistory(db, "v5", "v4", "v3")
+	versions, err := db.GetHistory(key, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(versions))
+	assert.Equal(t, seqs[4], versions[0].Seq)
+
+	val, err := db.GetAt(key, seqs[3])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v4"), val)
+	val, err = db.GetAt(key, seqs[4]+10)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v5"), val)
+	// not kept
+	_, err = db.GetAt(key, seqs[0])
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the versions of a key written in the same group
+	var group []*commitRequest
+	for i := 6; i <= 8; i++ {
+		group = append(group, &commitRequest{
+			records: []*LR{{Key: key, Val: []byte(fmt.Sprintf("v%d", i))}},
+			done:    make(chan error, 1),
+		})
+	}
+	db.committer.write(group)
+	for _, req := range group {
+		assert.Nil(t, <-req.done)
+	}
+	assertHistory(db, "v8", "v7", "v6")
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assertHistory(db, "v8", "v7", "v6")
+
+	// preserved by merge
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assertHistory(db, "v8", "v7", "v6")
+	assert.Nil(t, db.Put(key, []byte("v9")))
+	assertHistory(db, "v9", "v8", "v7")
+
+	// delete removes all versions
+	assert.Nil(t, db.Delete(key))
+	_, err = db.GetHistory(key, 0)
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Put(key, []byte("v10")))
+	assertHistory(db, "v10")
+}
+
+func TestDB_GetHistory_WrittenDuringMerge(t *testing.T) {
+	options := DefaultOptions
+	options.KeepVersions = 5
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	const n = 20000
+	value := func(i, v int) []byte {
+		return []byte(fmt.Sprintf("%d-v%d", i, v))
+	}
+	put := func(v int) {
+		for i := 0; i < n; i++ {
+			assert.Nil(t, db.Put(utils.TestKey(i), value(i, v)))
+		}
+	}
+	put(1)
+	put(2)
+	seq := db.LastSequence()
+
+	// the versions written during the merge, and after it before reopen,
+	// link to the versions in the merged segments.
+	merged := make(chan error, 1)
+	go func() {
+		merged <- db.Merge()
+	}()
+	for atomic.LoadUint32(&db.mergeRunning) == 0 && len(merged) == 0 {
+		runtime.Gosched()
+	}
+	put(3)
+	assert.Nil(t, <-merged)
+	put(4)
+
+	assertHistory := func() {
+		for i := 0; i < n; i++ {
+			versions, err := db.GetHistory(utils.TestKey(i), 0)
+			assert.Nil(t, err)
+			assert.Equal(t, 4, len(versions))
+			for j, v := range versions {
+				assert.Equal(t, value(i, 4-j), v.Value)
+			}
+			val, err := db.GetAt(utils.TestKey(i), seq)
+			assert.Nil(t, err)
+			assert.Equal(t, value(i, 2), val)
+		}
+	}
+	for round := 0; round < 2; round++ {
+		assert.Nil(t, db.Close())
+		db, err = Open(options)
+		assert.Nil(t, err)
+		assertHistory()
+		// merged again with the versions linked to the merged ones
+		assert.Nil(t, db.Merge())
+	}
+}
+
+func TestDB_GetHistory_KeepVersionsFor(t *testing.T) {
+	options := DefaultOptions
+	options.KeepVersionsFor = 200 * time.Millisecond
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	key := []byte("key")
+	assert.Nil(t, db.Put(key, []byte("v1")))
+	time.Sleep(300 * time.Millisecond)
+	assert.Nil(t, db.Put(key, []byte("v2")))
+	assert.Nil(t, db.Put(key, []byte("v3")))
+
+	versions, err := db.GetHistory(key, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(versions))
+	assert.Equal(t, []byte("v3"), versions[0].Value)
+	assert.Equal(t, []byte("v2"), versions[1].Value)
+}
+
+func TestDB_GetHistory_Disabled(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	key := []byte("key")
+	assert.Nil(t, db.Put(key, []byte("v1")))
+	assert.Nil(t, db.Put(key, []byte("v2")))
+
+	versions, err := db.GetHistory(key, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(versions))
+	assert.Equal(t, []byte("v2"), versions[0].Value)
+	assert.True(t, versions[0].Timestamp.IsZero())
+	_, err = db.GetAt(key, db.LastSequence()-1)
+	assert.Equal(t, ErrKeyNotFound, err)
+}
@@ -1,6 +1,9 @@
 package yojoudb
 
 import (
+	"bytes"
+	"sort"
+
 	"github.com/berylyvos/yojoudb/meta"
 )
 
@@ -54,7 +57,7 @@ func (it *Iterator) Value() ([]byte, error) {
 	if record.Type == LRDeleted {
 		return nil, ErrKeyNotFound
 	}
-	return record.Val, nil
+	return it.db.readValue(record)
 }
 
 // Valid checks if the iterator is in valid position.
@@ -62,7 +65,184 @@ func (it *Iterator) Valid() bool {
 	return it.IndexIter.Valid()
 }
 
+// Err returns the error of the iterator, i.e. meta.ErrUnorderedSeek
+// after calling Seek on the iterator of an unordered index.
+func (it *Iterator) Err() error {
+	if e, ok := it.IndexIter.(interface{ Err() error }); ok {
+		return e.Err()
+	}
+	return nil
+}
+
 // Close closes the iterator.
 func (it *Iterator) Close() {
 	it.IndexIter.Close()
 }
+
+// BatchIterator iterates over the keys of a batch with read-your-writes
+// semantics. It merges a snapshot of the pendingWrites, taken when the
+// iterator is created, with the iterator of the committed index. The
+// pending writes shadow the committed values of the same keys, and the
+// keys deleted in the batch are skipped.
+type BatchIterator struct {
+	batch     *Batch
+	indexIter *Iterator
+	pending   []*LR          // sorted pending writes matching the prefix.
+	shadowed  map[string]*LR // all pending writes, by key.
+	pos       int            // position in pending.
+	prefix    []byte
+	reverse   bool
+	ordered   bool
+	err       error
+}
+
+// NewIterator returns an iterator over the batch and the committed data.
+// For an unordered index, the pending writes come first, and Seek is not
+// supported. It returns ErrIterUnsupported for IndexSKL, which can't be
+// iterated.
+func (b *Batch) NewIterator(options IteratorOptions) (*BatchIterator, error) {
+	b.lock()
+	if b.db.closed {
+		b.unlock()
+		return nil, ErrDBClosed
+	}
+	indexIter := b.db.NewIterator(options)
+	b.unlock()
+	if indexIter.IndexIter == nil {
+		return nil, ErrIterUnsupported
+	}
+
+	it := &BatchIterator{
+		batch:     b,
+		indexIter: indexIter,
+		shadowed:  make(map[string]*LR),
+		prefix:    options.Prefix,
+		reverse:   options.Reverse,
+		ordered:   b.db.options.IndexType != IndexHash,
+	}
+
+	b.mu.RLock()
+	for key, rec := range b.pendingWrites {
+		it.shadowed[key] = rec
+		if bytes.HasPrefix(rec.Key, options.Prefix) {
+			it.pending = append(it.pending, rec)
+		}
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(it.pending, func(i, j int) bool {
+		return it.less(it.pending[i].Key, it.pending[j].Key)
+	})
+	it.settle()
+	return it, nil
+}
+
+// less reports whether a comes before b in the order of the iterator.
+func (it *BatchIterator) less(a, b []byte) bool {
+	if it.reverse {
+		return bytes.Compare(a, b) > 0
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+// settle skips the deleted pending writes, and the committed keys
+// which are shadowed or not matching the prefix.
+func (it *BatchIterator) settle() {
+	for it.pos < len(it.pending) && it.pending[it.pos].Type == LRDeleted {
+		it.pos++
+	}
+	for it.indexIter.Valid() {
+		key := it.indexIter.Key()
+		if bytes.HasPrefix(key, it.prefix) && it.shadowed[string(key)] == nil {
+			break
+		}
+		it.indexIter.Next()
+	}
+}
+
+// fromPending reports whether the current key is from the pending writes.
+func (it *BatchIterator) fromPending() bool {
+	if it.pos >= len(it.pending) {
+		return false
+	}
+	if !it.ordered || !it.indexIter.Valid() {
+		return true
+	}
+	return it.less(it.pending[it.pos].Key, it.indexIter.Key())
+}
+
+// Rewind seeks the first key in the iterator.
+func (it *BatchIterator) Rewind() {
+	it.pos = 0
+	it.err = nil
+	it.indexIter.Rewind()
+	it.settle()
+}
+
+// Seek moves the iterator to the key which is
+// greater(or less when reverse) than or equal
+// to the specified key.
+func (it *BatchIterator) Seek(key []byte) {
+	if !it.ordered {
+		it.pos = len(it.pending)
+		it.err = meta.ErrUnorderedSeek
+		it.indexIter.Seek(key)
+		return
+	}
+	it.pos = sort.Search(len(it.pending), func(i int) bool {
+		return !it.less(it.pending[i].Key, key)
+	})
+	it.indexIter.Seek(key)
+	it.settle()
+}
+
+// Next moves the iterator to the next key.
+func (it *BatchIterator) Next() {
+	if it.fromPending() {
+		it.pos++
+	} else {
+		it.indexIter.Next()
+	}
+	it.settle()
+}
+
+// Key gets the current key in the iterator.
+func (it *BatchIterator) Key() []byte {
+	if it.fromPending() {
+		return it.pending[it.pos].Key
+	}
+	return it.indexIter.Key()
+}
+
+// Value gets the current val in the iterator.
+func (it *BatchIterator) Value() ([]byte, error) {
+	if it.fromPending() {
+		return it.pending[it.pos].Val, nil
+	}
+	it.batch.lock()
+	defer it.batch.unlock()
+	if it.batch.db.closed {
+		return nil, ErrDBClosed
+	}
+	return it.indexIter.Value()
+}
+
+// Valid checks if the iterator is in valid position.
+func (it *BatchIterator) Valid() bool {
+	return it.pos < len(it.pending) || it.indexIter.Valid()
+}
+
+// Err returns the error of the iterator, i.e. meta.ErrUnorderedSeek
+// after calling Seek on the iterator of an unordered index.
+func (it *BatchIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.indexIter.Err()
+}
+
+// Close closes the iterator.
+func (it *BatchIterator) Close() {
+	it.indexIter.Close()
+	it.pending, it.shadowed = nil, nil
+}
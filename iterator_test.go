@@ -1,6 +1,7 @@
 package yojoudb
 
 import (
+	"github.com/berylyvos/yojoudb/meta"
 	"github.com/berylyvos/yojoudb/utils"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -34,3 +35,137 @@ func TestIterator_Normal(t *testing.T) {
 	}
 	assert.Equal(t, 10000, i)
 }
+
+func TestBatchIterator(t *testing.T) {
+	opts := DefaultOptions
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for _, key := range []string{"a1", "a3", "a5", "b1", "b3"} {
+		err = db.Put([]byte(key), []byte("db-"+key))
+		assert.Nil(t, err)
+	}
+	batch := db.NewBatch(DefaultBatchOptions)
+	defer batch.Discard()
+	for _, key := range []string{"a0", "a3", "a4", "c1"} {
+		err = batch.Put([]byte(key), []byte("batch-"+key))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, batch.Delete([]byte("a5")))
+	assert.Nil(t, batch.Delete([]byte("b2")))
+
+	collect := func(it *BatchIterator) []string {
+		var kvs []string
+		for ; it.Valid(); it.Next() {
+			val, err := it.Value()
+			assert.Nil(t, err)
+			kvs = append(kvs, string(it.Key())+"="+string(val))
+		}
+		return kvs
+	}
+
+	it, err := batch.NewIterator(DefaultIteratorOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a0=batch-a0", "a1=db-a1", "a3=batch-a3", "a4=batch-a4",
+		"b1=db-b1", "b3=db-b3", "c1=batch-c1"}, collect(it))
+	it.Seek([]byte("a2"))
+	assert.Equal(t, []string{"a3=batch-a3", "a4=batch-a4",
+		"b1=db-b1", "b3=db-b3", "c1=batch-c1"}, collect(it))
+	it.Rewind()
+	assert.Equal(t, 7, len(collect(it)))
+	it.Close()
+
+	it, err = batch.NewIterator(IteratorOptions{Prefix: []byte("a"), Reverse: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a4=batch-a4", "a3=batch-a3", "a1=db-a1", "a0=batch-a0"}, collect(it))
+	it.Seek([]byte("a2"))
+	assert.Equal(t, []string{"a1=db-a1", "a0=batch-a0"}, collect(it))
+	it.Close()
+
+	// the later writes of the batch are not in the iterator
+	it, err = batch.NewIterator(IteratorOptions{Prefix: []byte("b")})
+	assert.Nil(t, err)
+	assert.Nil(t, batch.Put([]byte("b2"), []byte("batch-b2")))
+	assert.Equal(t, []string{"b1=db-b1", "b3=db-b3"}, collect(it))
+	it.Close()
+
+	assert.Nil(t, batch.Commit())
+	it, err = db.NewBatch(BatchOptions{ReadOnly: true}).NewIterator(IteratorOptions{Prefix: []byte("b")})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b1=db-b1", "b2=batch-b2", "b3=db-b3"}, collect(it))
+	it.Close()
+
+	// the committed data can't be read after the db is closed.
+	batch = db.NewBatch(DefaultBatchOptions)
+	assert.Nil(t, batch.Put([]byte("a2"), []byte("batch-a2")))
+	it, err = batch.NewIterator(IteratorOptions{Prefix: []byte("a")})
+	assert.Nil(t, err)
+	defer it.Close()
+	assert.Nil(t, db.Close())
+	_, err = batch.NewIterator(DefaultIteratorOptions)
+	assert.Equal(t, ErrDBClosed, err)
+	assert.Equal(t, []byte("a0"), it.Key())
+	_, err = it.Value()
+	assert.Equal(t, ErrDBClosed, err)
+	it.Next()
+	it.Next()
+	assert.Equal(t, []byte("a2"), it.Key())
+	val, err := it.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("batch-a2"), val)
+}
+
+func TestBatchIterator_Skiplist(t *testing.T) {
+	opts := DefaultOptions
+	opts.IndexType = IndexSKL
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("a"), []byte("db-a")))
+	batch := db.NewBatch(DefaultBatchOptions)
+	defer batch.Discard()
+	assert.Nil(t, batch.Put([]byte("b"), []byte("batch-b")))
+	_, err = batch.NewIterator(DefaultIteratorOptions)
+	assert.Equal(t, ErrIterUnsupported, err)
+}
+
+func TestBatchIterator_Unordered(t *testing.T) {
+	opts := DefaultOptions
+	opts.IndexType = IndexHash
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.TestKey(i), utils.RandValue(16)))
+	}
+	batch := db.NewBatch(DefaultBatchOptions)
+	defer batch.Discard()
+	for i := 50; i < 150; i++ {
+		assert.Nil(t, batch.Put(utils.TestKey(i), []byte("batch")))
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, batch.Delete(utils.TestKey(i)))
+	}
+
+	it, err := batch.NewIterator(DefaultIteratorOptions)
+	assert.Nil(t, err)
+	defer it.Close()
+	keys := make(map[string]struct{})
+	for ; it.Valid(); it.Next() {
+		val, err := it.Value()
+		assert.Nil(t, err)
+		if string(val) != "batch" {
+			assert.Less(t, string(it.Key()), string(utils.TestKey(50)))
+		}
+		keys[string(it.Key())] = struct{}{}
+	}
+	assert.Equal(t, 140, len(keys))
+	assert.Nil(t, it.Err())
+
+	it.Seek(utils.TestKey(1))
+	assert.False(t, it.Valid())
+	assert.Equal(t, meta.ErrUnorderedSeek, it.Err())
+}
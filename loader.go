@@ -0,0 +1,239 @@
+package yojoudb
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/berylyvos/yojoudb/wal"
+	"github.com/bwmarrin/snowflake"
+)
+
+// segLoadResult holds the index records decoded from a single segment.
+type segLoadResult struct {
+	records []*IndexRecord
+	torn    *Loc // location of the torn record if any.
+	err     error
+}
+
+// loadIndexer loads index from WAL.
+// The segments are scanned concurrently, and only the header and key
+// of every record is decoded. The scanned results are then applied to
+// the index strictly in segment order, so a batch spanning several
+// segments is still applied only when its end-of-batch record is reached.
+//
+// It restores the last committed sequence number, and returns the max
+// sequence number ever assigned, including the batches without an end,
+// so that they won't be reused.
+//
+// If Options.RecoverUntil is set, it stops at the first batch after
+// the recovery point, the later batches are ignored.
+func (db *DB) loadIndexer() (uint64, error) {
+	fin, err := readMergeFin(db.options.fs(), db.options.DirPath)
+	if err != nil {
+		return 0, err
+	}
+	db.seq = fin.lastSeq
+	db.mergedSegId = fin.segId
+
+	// the merged data can't be recovered to an earlier point.
+	until := db.options.RecoverUntil
+	if until != nil && until.after(fin.lastSeq, fin.lastTime) {
+		return 0, ErrRecoverBeforeMerge
+	}
+
+	// skip the segments which segId is less than or equal to mergeFinSegId,
+	// their indexes has already been loaded through hint file.
+	readers := db.dataFiles.NewReadersGT(fin.segId)
+	total := len(readers)
+	if total == 0 {
+		// the new active segment opened by merge may be lost in a crash,
+		// the later writes must not go to a merged segment.
+		for !db.readOnly && db.dataFiles.ActiveSegID() <= fin.segId {
+			if err := db.dataFiles.OpenNewActiveSeg(); err != nil {
+				return 0, err
+			}
+		}
+		return db.seq, nil
+	}
+
+	results := make([]chan *segLoadResult, total)
+	for i := range results {
+		results[i] = make(chan *segLoadResult, 1)
+	}
+
+	// window limits the number of segments which are scanned but not yet
+	// applied, it bounds both the concurrency and the memory held by the
+	// pending index records.
+	window := make(chan struct{}, runtime.NumCPU())
+	done := make(chan struct{})
+	// the started scans must be done before returning, even on an
+	// error, since they read the segments and decode into the results.
+	var scans sync.WaitGroup
+	defer func() {
+		close(done)
+		scans.Wait()
+		// release the segments which are not scanned through.
+		for _, reader := range readers {
+			reader.Close()
+		}
+	}()
+
+	scans.Add(1)
+	go func() {
+		defer scans.Done()
+		for i := 0; i < total; i++ {
+			select {
+			case window <- struct{}{}:
+			case <-done:
+				return
+			}
+			scans.Add(1)
+			go func(i int) {
+				defer scans.Done()
+				records, torn, err := scanSegment(readers[i])
+				results[i] <- &segLoadResult{records: records, torn: torn, err: err}
+			}(i)
+		}
+	}()
+
+	// batch => indexRecords
+	indexRecords := make(map[batchKey][]*IndexRecord)
+
+	for i := 0; i < total; i++ {
+		res := <-results[i]
+		<-window
+		if res.err != nil {
+			return 0, res.err
+		}
+		// only the last segment could be torn by a crash, the
+		// older ones have been synced before the next is created.
+		if res.torn != nil && i < total-1 {
+			return 0, fmt.Errorf("%w: segment %d is corrupted", wal.ErrInvalidCRC, res.torn.SegId)
+		}
+
+		for _, idxRec := range res.records {
+			// if reaching to end-of-batch,
+			// put or delete all records in the batch to index.
+			if idxRec.typ == LRBatchFin {
+				if until != nil && !idxRec.legacy && until.after(idxRec.batchId, idxRec.ts) {
+					return db.seq, nil
+				}
+				if !idxRec.legacy && idxRec.batchId > db.seq {
+					db.seq = idxRec.batchId
+				}
+				batch := batchKey{idxRec.batchId, idxRec.upgraded}
+				for _, rec := range indexRecords[batch] {
+					switch rec.typ {
+					case LRNormal:
+						db.index.Put(rec.key, rec.loc)
+						db.trackBlob(rec.key, rec.blob)
+					case LRDeleted:
+						db.index.Delete(rec.key)
+						db.trackBlob(rec.key, nil)
+					case LRRangeDel:
+						// the keys deleted by the range must not come
+						// back, i.e. opened by IndexSKL after writing
+						// with another index type.
+						if err := db.deleteRange(rec.key, rec.end); err != nil {
+							return 0, err
+						}
+					}
+				}
+				delete(indexRecords, batch)
+			} else {
+				batch := batchKey{idxRec.batchId, idxRec.upgraded}
+				indexRecords[batch] = append(indexRecords[batch], idxRec)
+			}
+		}
+
+		if db.options.OpenProgress != nil {
+			db.options.OpenProgress(i+1, total)
+		}
+
+		// discard the torn tail, so that it won't be read as a part
+		// of the records written later.
+		if res.torn != nil && !db.readOnly {
+			if err := db.dataFiles.TruncateAt(res.torn); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// the batches without an end are not committed, but their sequence
+	// numbers are on disk. The ids of the batches written by an old
+	// version are not sequence numbers, they are never reused anyway.
+	maxSeq := db.seq
+	for batch := range indexRecords {
+		if !batch.upgraded && batch.id > maxSeq {
+			maxSeq = batch.id
+		}
+	}
+	return maxSeq, nil
+}
+
+// batchKey identifies a batch being loaded. The batches in the segments
+// upgraded from an old version are keyed separately, their ids may be
+// snowflake ids, which must never collide with the sequence numbers.
+type batchKey struct {
+	id       uint64
+	upgraded bool
+}
+
+// scanSegment reads all records of a single segment, and returns
+// their index records in the order they are written. If the segment
+// ends with a torn record, which is written partially before a crash,
+// the location of it is returned. A corrupted record followed by more
+// data fails the scan with wal.ErrInvalidCRC.
+func scanSegment(reader *wal.Reader) ([]*IndexRecord, *Loc, error) {
+	defer reader.Close()
+	upgraded := reader.CurrSegHeader().Flags&wal.FlagUpgraded != 0
+	var records []*IndexRecord
+	for {
+		chunk, loc, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if err == io.ErrUnexpectedEOF || err == wal.ErrInvalidCRC {
+				// a corrupted record followed by more data is not torn,
+				// the records after it must not be discarded.
+				torn, err := reader.TornTail()
+				if err != nil {
+					return nil, nil, err
+				}
+				if !torn {
+					return nil, nil, fmt.Errorf("%w: segment %d is corrupted", wal.ErrInvalidCRC, reader.CurrSegId())
+				}
+				return records, reader.CurrChunkLoc(), nil
+			}
+			return nil, nil, err
+		}
+		record := decodeLRKey(chunk)
+
+		var legacy bool
+		batchId := record.BatchId
+		if record.Type == LRBatchFin && batchId == 0 {
+			// the end-of-batch record written before sequence numbers,
+			// its key is the snowflake id of the batch.
+			snowflakeId, err := snowflake.ParseBytes(record.Key)
+			if err != nil {
+				return nil, nil, err
+			}
+			batchId, legacy = uint64(snowflakeId), true
+		}
+		records = append(records, &IndexRecord{
+			key:      record.Key,
+			end:      record.Val,
+			typ:      record.Type,
+			batchId:  batchId,
+			legacy:   legacy,
+			upgraded: upgraded,
+			ts:       record.Timestamp,
+			loc:      loc,
+			blob:     record.Blob,
+		})
+	}
+	return records, nil, nil
+}
@@ -9,13 +9,14 @@ import (
 	"path"
 	"path/filepath"
 	"sync/atomic"
+	"time"
 
+	"github.com/berylyvos/yojoudb/vfs"
 	"github.com/berylyvos/yojoudb/wal"
 )
 
 const (
-	mergeDirSuffix  = "-merge"
-	mergeFinBatchId = 0
+	mergeDirSuffix = "-merge"
 )
 
 // Merge merges all the data files.
@@ -30,6 +31,10 @@ func (db *DB) Merge() error {
 		db.mu.Unlock()
 		return ErrDBClosed
 	}
+	if db.readOnly {
+		db.mu.Unlock()
+		return ErrReadOnlyDB
+	}
 	if db.dataFiles.IsEmpty() {
 		db.mu.Unlock()
 		return nil
@@ -41,14 +46,40 @@ func (db *DB) Merge() error {
 	atomic.StoreUint32(&db.mergeRunning, 1)
 	defer atomic.StoreUint32(&db.mergeRunning, 0)
 
+	// the async writes may be in the data files to merge, or refer to
+	// the blob files, before their keys are in the index. They must be
+	// in the index, or they would be dropped by the merge.
+	db.committer.drain()
+
 	lastActiveSegId := db.dataFiles.ActiveSegID()
 	if err := db.dataFiles.OpenNewActiveSeg(); err != nil {
+		db.mu.Unlock()
 		return err
 	}
+	// the blob files without references won't be referred again, they
+	// are deleted once the merge is done.
+	unreferenced := db.unreferencedBlobs()
+
+	// the merged data keeps their sequence numbers, the last one
+	// is saved in MERGE_FIN to be restored without the batch ends,
+	// along with the commit time of the last merged batch, which
+	// bounds the recovery point.
+	fin := &mergeFin{
+		segId:   lastActiveSegId,
+		lastSeq: db.LastSequence(),
+	}
 
 	// release lock here
 	db.mu.Unlock()
 
+	// the segments merged last time have no batch ends, the commit
+	// time of their last batch is kept in the MERGE_FIN file.
+	lastFin, err := readMergeFin(db.options.fs(), db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	fin.lastTime = lastFin.lastTime
+
 	// open a merge db to hold the merged data.
 	mergeDB, err := db.openMergeDB()
 	if err != nil {
@@ -58,7 +89,9 @@ func (db *DB) Merge() error {
 		_ = mergeDB.Close()
 	}()
 
+	now := time.Now()
 	reader := db.dataFiles.NewReaderLE(lastActiveSegId)
+	defer reader.Close()
 	for {
 		chunk, loc, err := reader.Next()
 		if err != nil {
@@ -68,21 +101,36 @@ func (db *DB) Merge() error {
 			return err
 		}
 		record := decodeLR(chunk)
-		// Deleted & Batch-Finished logs are not valid.
+		if record.Type == LRBatchFin {
+			if record.BatchId > fin.lastSeq {
+				fin.lastSeq = record.BatchId
+			}
+			if record.Timestamp > fin.lastTime {
+				fin.lastTime = record.Timestamp
+			}
+		}
+		// Deleted & Batch-Finished logs are not valid, so are the range
+		// deletions, the keys they cover are no longer in the index.
 		if record.Type == LRNormal {
 			db.mu.RLock()
 			indexLoc := db.index.Get(record.Key)
 			db.mu.RUnlock()
+			// the newest version before the merge is merged even if the
+			// key is written during the merge, the new version links to it.
+			if indexLoc != nil && db.options.versioned() && indexLoc.SegId > lastActiveSegId {
+				if indexLoc, err = db.versionBefore(record.Key, indexLoc, lastActiveSegId); err != nil {
+					return err
+				}
+			}
 			// if current record is the newest one.
 			if indexLoc != nil && locEqual(indexLoc, loc) {
-				record.BatchId = mergeFinBatchId
-				newLoc, err := mergeDB.dataFiles.Write(encodeLR(record))
+				newLoc, err := db.mergeVersions(mergeDB, record, loc, now)
 				if err != nil {
 					return err
 				}
 				// append key/newLoc to HINT-FILE, which is for rebuilding index
 				// quickly when db is restarted.
-				_, err = mergeDB.hintFile.Write(encodeHintRecord(record.Key, newLoc))
+				_, err = mergeDB.hintFile.Write(encodeHintRecord(record.Key, newLoc, record.Blob))
 				if err != nil {
 					return err
 				}
@@ -90,31 +138,128 @@ func (db *DB) Merge() error {
 		}
 	}
 
+	// the merged data must be durable before the MERGE_FIN file,
+	// otherwise it may be lost after a crash while MERGE_FIN is not.
+	if err = mergeDB.dataFiles.Sync(); err != nil {
+		return err
+	}
+	if err = mergeDB.hintFile.Sync(); err != nil {
+		return err
+	}
+	// so are the separated values of the merged data.
+	if db.blobFiles != nil {
+		if err = db.blobFiles.Sync(); err != nil {
+			return err
+		}
+	}
+	fin.mergedSegId = mergeDB.dataFiles.ActiveSegID()
+
 	// To make sure the completeness of the merged data.
 	// At the end of merging, adding a file to indicate that the merge operation is done.
 	mergeFinFile, err := mergeDB.openMergeFinFile()
 	if err != nil {
 		return err
 	}
-	_, err = mergeFinFile.Write(encodeMergeFinRecord(lastActiveSegId))
-	if err != nil {
+	if _, err = mergeFinFile.Write(fin.encode()); err != nil {
+		_ = mergeFinFile.Close()
+		return err
+	}
+	if err = mergeFinFile.Sync(); err != nil {
+		_ = mergeFinFile.Close()
 		return err
 	}
 	if err = mergeFinFile.Close(); err != nil {
 		return err
 	}
 
+	// the records referring to the unreferenced blob files are all
+	// discarded by the merge.
+	if len(unreferenced) > 0 {
+		return db.blobFiles.RemoveSegments(unreferenced...)
+	}
 	return nil
 }
 
+// mergeVersions writes the current record of a key to the merge db,
+// along with its kept versions, from the oldest to the newest, which
+// link to the new locations of the previous versions.
+// Returns the new location of the current record.
+func (db *DB) mergeVersions(mergeDB *DB, record *LR, loc *Loc, now time.Time) (*Loc, error) {
+	if !db.options.versioned() {
+		return mergeDB.dataFiles.Write(encodeLR(record))
+	}
+
+	var versions []*LR
+	err := db.walkVersions(record.Key, loc, now, func(rec *LR, _ *Loc) bool {
+		versions = append(versions, rec)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var prev *Loc
+	for i := len(versions) - 1; i >= 0; i-- {
+		versions[i].Prev = prev
+		if prev, err = mergeDB.dataFiles.Write(encodeLR(versions[i])); err != nil {
+			return nil, err
+		}
+	}
+	return prev, nil
+}
+
+// versionBefore returns the location of the newest version of the key
+// in the segments up to segId, following the previous versions from the
+// one at loc. Returns nil if there's no such version.
+func (db *DB) versionBefore(key K, loc *Loc, segId wal.SegmentID) (*Loc, error) {
+	for loc != nil && loc.SegId > segId {
+		chunk, err := db.dataFiles.Read(loc)
+		if err != nil {
+			return nil, err
+		}
+		loc = db.prevLoc(key, loc, decodeLR(chunk))
+	}
+	return loc, nil
+}
+
+// prevLoc returns the location of the previous version of the key, of
+// which the record rec is at loc.
+//
+// The records written during the last merge, or after it before reopen,
+// link to the locations in the segments replaced by the merge. Such a
+// location is always the newest version before the merge, which is then
+// the newest merged version of the key, its new location is kept in the
+// hint file.
+func (db *DB) prevLoc(key K, loc *Loc, rec *LR) *Loc {
+	if rec.Prev != nil && loc.SegId > db.mergedSegId && rec.Prev.SegId <= db.mergedSegId {
+		if head, ok := db.mergedHeads[string(key)]; ok {
+			return head
+		}
+	}
+	return rec.Prev
+}
+
+// pruneMergedHeads drops the merged versions which no record written
+// after the merge links to, i.e. the current version is merged.
+func (db *DB) pruneMergedHeads() {
+	for key := range db.mergedHeads {
+		if loc := db.index.Get([]byte(key)); loc == nil || loc.SegId <= db.mergedSegId {
+			delete(db.mergedHeads, key)
+		}
+	}
+}
+
 func (db *DB) openMergeDB() (*DB, error) {
 	mergeDir := mergeDirPath(db.options.DirPath)
-	if err := os.RemoveAll(mergeDir); err != nil {
+	if err := db.options.fs().RemoveAll(mergeDir); err != nil {
 		return nil, err
 	}
 	options := db.options
 	options.Sync, options.BytesPerSync = false, 0
+	options.SyncPolicy = SyncNever
 	options.DirPath = mergeDir
+	// the merged records keep the locations of the separated values.
+	options.BlobThreshold = 0
 	mergeDB, err := Open(options)
 	if err != nil {
 		return nil, err
@@ -127,6 +272,7 @@ func (db *DB) openMergeDB() (*DB, error) {
 		SegmentFileExt: hintFileSuffix,
 		Sync:           false,
 		BytesPerSync:   0,
+		FS:             options.FS,
 	})
 	if err != nil {
 		return nil, err
@@ -142,6 +288,7 @@ func (db *DB) openMergeFinFile() (*wal.WAL, error) {
 		SegmentFileExt: mergeFinSuffix,
 		Sync:           false,
 		BytesPerSync:   0,
+		FS:             db.options.FS,
 	})
 }
 
@@ -150,71 +297,126 @@ func mergeDirPath(path string) string {
 	return filepath.Join(dir, filepath.Base(path)+mergeDirSuffix)
 }
 
-// loadMergedFiles loads all merged files from mergeDB.
-// Copying and overwriting data to DB dir.
-func loadMergedFiles(dirPath string) error {
+// loadMergedFiles moves the merged files from the merge directory to
+// the DB directory, replacing the segments that have been merged.
+//
+// It can be interrupted by a crash at any point and run again, as the
+// MERGE_FIN file is moved at last: the merged segments left in the merge
+// directory are yet to be moved, and those missing have been moved.
+func loadMergedFiles(fs vfs.FS, dirPath string) error {
 	mergeDir := mergeDirPath(dirPath)
-	if _, err := os.Stat(mergeDir); err != nil {
+	if _, err := fs.Stat(mergeDir); err != nil {
 		return nil
 	}
 
-	defer func() {
-		_ = os.RemoveAll(mergeDir)
-	}()
-
-	copySeg := func(suffix string, segId wal.SegmentID) {
-		src := wal.SegmentFileName(mergeDir, suffix, segId)
-		stat, err := os.Stat(src)
-		if os.IsNotExist(err) {
-			return
-		}
-		if err != nil {
-			panic(fmt.Sprintf("failed to get file stat %v", err))
-		}
-		if stat.Size() == 0 {
-			return
-		}
-		dst := wal.SegmentFileName(dirPath, suffix, segId)
-		_ = os.Rename(src, dst)
-	}
-
-	mergeFinSegId, err := getMergeFinSegId(mergeDir)
+	fin, err := readMergeFin(fs, mergeDir)
 	if err != nil {
 		return err
 	}
+	// the merge is unfinished, discard it.
+	if fin.segId == 0 {
+		return fs.RemoveAll(mergeDir)
+	}
 
-	for sid := wal.SegmentID(1); sid <= mergeFinSegId; sid++ {
+	for sid := wal.SegmentID(1); sid <= fin.segId; sid++ {
+		src := wal.SegmentFileName(mergeDir, dataFileSuffix, sid)
 		dst := wal.SegmentFileName(dirPath, dataFileSuffix, sid)
-		if err = os.Remove(dst); err != nil {
+		// the file of a preallocated segment is as large as SegmentSize
+		// even if it's empty, so its data size is checked.
+		size, err := wal.SegmentDataSize(fs, src)
+		switch {
+		case err == nil && size > 0:
+			if err = fs.Rename(src, dst); err != nil {
+				return err
+			}
+		case err == nil:
+			// nothing but the header, the old segment is removed first,
+			// so that it's still removed if we crash before the src.
+			if err = removeIfExists(fs, dst); err != nil {
+				return err
+			}
+			if err = fs.Remove(src); err != nil {
+				return err
+			}
+		case !os.IsNotExist(err):
+			return fmt.Errorf("failed to get the data size: %w", err)
+		case fin.mergedSegId == 0 || sid > fin.mergedSegId:
+			// no merged data for the old segment, which is written
+			// before the number of merged segments is recorded.
+			if err = removeIfExists(fs, dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	hintFile := wal.SegmentFileName(mergeDir, hintFileSuffix, 1)
+	if _, err = fs.Stat(hintFile); err == nil {
+		if err = fs.Rename(hintFile, wal.SegmentFileName(dirPath, hintFileSuffix, 1)); err != nil {
 			return err
 		}
-		copySeg(dataFileSuffix, sid)
+	}
+	if err = fs.SyncDir(dirPath); err != nil {
+		return err
 	}
 
-	copySeg(mergeFinSuffix, 1)
-	copySeg(hintFileSuffix, 1)
+	// the merged files are all in place, it's done once MERGE_FIN is moved.
+	mergeFinFile := wal.SegmentFileName(mergeDir, mergeFinSuffix, 1)
+	if err = fs.Rename(mergeFinFile, wal.SegmentFileName(dirPath, mergeFinSuffix, 1)); err != nil {
+		return err
+	}
+	if err = fs.SyncDir(dirPath); err != nil {
+		return err
+	}
+	return fs.RemoveAll(mergeDir)
+}
 
+// removeIfExists removes the file, it's fine if the file doesn't exist.
+func removeIfExists(fs vfs.FS, name string) error {
+	if err := fs.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
-func getMergeFinSegId(mergeDir string) (wal.SegmentID, error) {
-	mergeFinFile, err := os.Open(wal.SegmentFileName(mergeDir, mergeFinSuffix, 1))
-	if err != nil {
+// mergeFin is the record of the MERGE_FIN file.
+type mergeFin struct {
+	segId       wal.SegmentID // id of the last merged segment.
+	lastSeq     uint64        // the last sequence number of the merged data.
+	lastTime    int64         // the last commit time of the merged data.
+	mergedSegId wal.SegmentID // id of the last segment holding the merged data.
+}
+
+// readMergeFin reads the record from the MERGE_FIN file.
+// Returns a zero record if the merge is unfinished.
+func readMergeFin(fs vfs.FS, dirPath string) (*mergeFin, error) {
+	if _, err := fs.Stat(wal.SegmentFileName(dirPath, mergeFinSuffix, 1)); err != nil {
 		// merge unfinished
-		return 0, nil
+		return &mergeFin{}, nil
+	}
+	mergeFinFile, err := wal.Open(wal.Options{
+		DirPath:        dirPath,
+		SegmentSize:    GB,
+		SegmentFileExt: mergeFinSuffix,
+		FS:             fs,
+	})
+	if err != nil {
+		return nil, err
 	}
 	defer func() {
 		_ = mergeFinFile.Close()
 	}()
 
-	// SegmentID 4B
-	buf := make([]byte, 4)
-	// chunkHeaderSize = 7
-	if _, err := mergeFinFile.ReadAt(buf, 7); err != nil {
-		return 0, err
+	// the record may be torn by a crash before it's synced.
+	reader := mergeFinFile.NewReader()
+	defer reader.Close()
+	data, _, err := reader.Next()
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == wal.ErrInvalidCRC {
+		return &mergeFin{}, nil
+	}
+	if err != nil {
+		return nil, err
 	}
-	mergeFinSegId := binary.LittleEndian.Uint32(buf)
-	return mergeFinSegId, nil
+	return decodeMergeFin(data), nil
 }
 
 func (db *DB) loadIndexerFromHint() error {
@@ -222,6 +424,7 @@ func (db *DB) loadIndexerFromHint() error {
 		DirPath:        db.options.DirPath,
 		SegmentSize:    math.MaxInt64,
 		SegmentFileExt: hintFileSuffix,
+		FS:             db.options.FS,
 	})
 	if err != nil {
 		return err
@@ -231,6 +434,7 @@ func (db *DB) loadIndexerFromHint() error {
 	}()
 
 	reader := hintFile.NewReader()
+	defer reader.Close()
 	for {
 		bytes, _, err := reader.Next()
 		if err != nil {
@@ -239,8 +443,15 @@ func (db *DB) loadIndexerFromHint() error {
 			}
 			return err
 		}
-		key, loc := decodeHintRecord(bytes)
+		key, loc, blob := decodeHintRecord(bytes)
 		db.index.Put(key, loc)
+		db.trackBlob(key, blob)
+		if db.options.versioned() {
+			if db.mergedHeads == nil {
+				db.mergedHeads = make(map[string]*Loc)
+			}
+			db.mergedHeads[string(key)] = loc
+		}
 	}
 
 	return nil
@@ -258,12 +469,21 @@ func locEqual(a, b *Loc) bool {
 		a.ChunkOffset == b.ChunkOffset
 }
 
-func encodeHintRecord(key K, loc *Loc) []byte {
+// encodeHintRecord encodes the new location of the key, along with the
+// location of the separated value if any.
+//
+// The record of a separated value begins with a zero byte and the
+// location of the value, a segment id is never zero.
+func encodeHintRecord(key K, loc *Loc, blob *Loc) []byte {
 	// SegId BlockIndex ChunkOffset ChunkSize  key
 	//    5 +    5     +    10     +    5     +len(key)
+	var blobLoc []byte
+	if blob != nil {
+		blobLoc = append([]byte{0}, blob.Encode()...)
+	}
 	kl := len(key)
-	b := make([]byte, 25+kl)
-	idx := 0
+	b := make([]byte, len(blobLoc)+25+kl)
+	idx := copy(b, blobLoc)
 	idx += binary.PutUvarint(b[idx:], uint64(loc.SegId))
 	idx += binary.PutUvarint(b[idx:], uint64(loc.BlockIndex))
 	idx += binary.PutUvarint(b[idx:], uint64(loc.ChunkOffset))
@@ -274,7 +494,12 @@ func encodeHintRecord(key K, loc *Loc) []byte {
 	return b[:idx]
 }
 
-func decodeHintRecord(b []byte) (K, *Loc) {
+func decodeHintRecord(b []byte) (K, *Loc, *Loc) {
+	var blob *Loc
+	if b[0] == 0 {
+		blob = wal.DecodeChunkLoc(b[1:])
+		b = b[1+len(blob.Encode()):]
+	}
 	idx := 0
 	segId, n := binary.Uvarint(b[idx:])
 	idx += n
@@ -291,11 +516,34 @@ func decodeHintRecord(b []byte) (K, *Loc) {
 		BlockIndex:  uint32(blockIndex),
 		ChunkOffset: int64(chunkOffset),
 		ChunkSize:   uint32(chunkSize),
-	}
+	}, blob
 }
 
-func encodeMergeFinRecord(segId wal.SegmentID) []byte {
-	buf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(buf, segId)
+// encode encodes the MERGE_FIN record.
+//
+//	+--- seg_id ---+--- last_seq ---+--- last_time ---+--- merged_seg_id ---+
+//	+----- 4 ------+------- 8 ------+------- 8 -------+-------- 4 ---------+
+func (fin *mergeFin) encode() []byte {
+	buf := make([]byte, 24)
+	binary.LittleEndian.PutUint32(buf, fin.segId)
+	binary.LittleEndian.PutUint64(buf[4:], fin.lastSeq)
+	binary.LittleEndian.PutUint64(buf[12:], uint64(fin.lastTime))
+	binary.LittleEndian.PutUint32(buf[20:], fin.mergedSegId)
 	return buf
 }
+
+// decodeMergeFin decodes the MERGE_FIN record, the fields are zero
+// if the record is written before they were introduced.
+func decodeMergeFin(b []byte) *mergeFin {
+	fin := &mergeFin{segId: binary.LittleEndian.Uint32(b)}
+	if len(b) >= 12 {
+		fin.lastSeq = binary.LittleEndian.Uint64(b[4:])
+	}
+	if len(b) >= 20 {
+		fin.lastTime = int64(binary.LittleEndian.Uint64(b[12:]))
+	}
+	if len(b) >= 24 {
+		fin.mergedSegId = binary.LittleEndian.Uint32(b[20:])
+	}
+	return fin
+}
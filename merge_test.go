@@ -2,10 +2,14 @@ package yojoudb
 
 import (
 	"github.com/berylyvos/yojoudb/utils"
+	"github.com/berylyvos/yojoudb/vfs"
+	"github.com/berylyvos/yojoudb/wal"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
+	"os"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestDB_Merge_1_Empty(t *testing.T) {
@@ -198,3 +202,147 @@ func TestDB_Merge_6_Appending(t *testing.T) {
 	})
 	assert.Equal(t, uint64(200000+count), stat.KeyNum)
 }
+
+func TestDB_Merge_7_LoadFailed(t *testing.T) {
+	fs := vfs.NewFault(0)
+	options := DefaultOptions
+	options.DirPath = "/yojoudb-merge"
+	options.SegmentSize = 64 * KB
+	options.FS = fs
+	db, err := Open(options)
+	assert.Nil(t, err)
+
+	generateData(t, db, 0, 200, 1024)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.TestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	// the merged files are moved again by the next open.
+	for _, op := range []vfs.Op{vfs.OpRename, vfs.OpRemove, vfs.OpSyncDir} {
+		fs.FailNext(op)
+		_, err = Open(options)
+		assert.ErrorIs(t, err, vfs.ErrInjected)
+	}
+
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 100, db2.index.Size())
+	assertKeyExistOrNot(t, db2, utils.TestKey(99), false)
+	assertKeyExistOrNot(t, db2, utils.TestKey(100), true)
+	assertKeyExistOrNot(t, db2, utils.TestKey(199), true)
+	_, err = fs.Stat(mergeDirPath(options.DirPath))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDB_Merge_8_AsyncWrites(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// the async writes queued before the merge are not dropped by it,
+	// the slow callbacks delay applying the rest of a written group.
+	var wg sync.WaitGroup
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			db.PutAsync(utils.TestKey(round*100+i), utils.RandValue(128), func(err error) {
+				assert.Nil(t, err)
+				time.Sleep(100 * time.Microsecond)
+				wg.Done()
+			})
+		}
+		assert.Nil(t, db.Merge())
+	}
+	wg.Wait()
+
+	_ = db.Close()
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	for i := 0; i < 1000; i++ {
+		assertKeyExistOrNot(t, db2, utils.TestKey(i), true)
+	}
+}
+
+func TestDB_Merge_9_Preallocate(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 64 * KB
+	options.PreallocateSegments = true
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.TestKey(i), utils.RandValue(128)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.TestKey(i)))
+	}
+	lastSegId := db.dataFiles.ActiveSegID()
+	assert.True(t, lastSegId > 2)
+	assert.Nil(t, db.Merge())
+	_ = db.Close()
+
+	// the merged segment without data replaces nothing, though its
+	// file is as large as SegmentSize.
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	for sid := wal.SegmentID(1); sid <= lastSegId; sid++ {
+		_, err = os.Stat(wal.SegmentFileName(options.DirPath, dataFileSuffix, sid))
+		assert.True(t, os.IsNotExist(err), "segment %d", sid)
+	}
+	for i := 0; i < 1000; i++ {
+		assertKeyExistOrNot(t, db2, utils.TestKey(i), false)
+	}
+}
+
+func TestDB_Merge_10_LastTime(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.TestKey(i), utils.RandValue(128)))
+	}
+	committed := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	// the merged data can be recovered to the point after the last
+	// merged batch, though the merge is done later, and so it can
+	// after merging the merged segments again.
+	for round := 0; round < 2; round++ {
+		recovered := options
+		recovered.RecoverUntil = &RecoveryPoint{Time: committed}
+		db, err = Open(recovered)
+		assert.Nil(t, err)
+		assert.Equal(t, 100, db.index.Size())
+		assert.Nil(t, db.Close())
+
+		recovered.RecoverUntil = &RecoveryPoint{Time: committed.Add(-time.Hour)}
+		_, err = Open(recovered)
+		assert.Equal(t, ErrRecoverBeforeMerge, err)
+
+		db, err = Open(options)
+		assert.Nil(t, err)
+		time.Sleep(10 * time.Millisecond)
+		assert.Nil(t, db.Merge())
+		assert.Nil(t, db.Close())
+	}
+
+	db, err = Open(options)
+	assert.Nil(t, err)
+	destroyDB(db)
+}
@@ -56,6 +56,60 @@ func (art *ART) Iterator(opt IteratorOpt) Iterator {
 	return newARTIterator(art.tree, opt)
 }
 
+// Range seeks the start without a seek of the tree: the keys from the
+// start are in the subtree of the start itself, then in the subtrees of
+// start[:i]+c with c > start[i], for i from the last byte to the first,
+// which are walked in order until a subtree reaches the end. So only the
+// keys in the range and the empty children around it are visited.
+func (art *ART) Range(start, end K) ([]K, bool) {
+	var keys []K
+	// walk visits the keys with the prefix, returns false if the
+	// prefix is not less than the end, so are all the later ones.
+	walk := func(prefix K) bool {
+		if len(end) > 0 && bytes.Compare(prefix, end) >= 0 {
+			return false
+		}
+		art.tree.ForEachPrefix(prefix, func(node gart.Node) bool {
+			key := node.Key()
+			// the inner nodes are visited as well.
+			if node.Kind() == gart.Leaf && bytes.HasPrefix(key, prefix) &&
+				bytes.Compare(key, start) >= 0 && (len(end) == 0 || bytes.Compare(key, end) < 0) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		return true
+	}
+	// walkAfter walks the subtrees of base+c with c from the given byte.
+	walkAfter := func(base K, from int) bool {
+		prefix := append(append(K{}, base...), 0)
+		for c := from; c <= 0xff; c++ {
+			prefix[len(base)] = byte(c)
+			if !walk(prefix) {
+				return false
+			}
+		}
+		return true
+	}
+
+	art.mu.RLock()
+	defer art.mu.RUnlock()
+	// ForEachPrefix visits nothing with an empty prefix.
+	if len(start) == 0 {
+		walkAfter(nil, 0)
+		return keys, true
+	}
+	if !walk(start) {
+		return keys, true
+	}
+	for i := len(start) - 1; i >= 0; i-- {
+		if !walkAfter(start[:i], int(start[i])+1) {
+			break
+		}
+	}
+	return keys, true
+}
+
 func (art *ART) Size() int {
 	art.mu.RLock()
 	defer art.mu.RUnlock()
@@ -51,6 +51,8 @@ func (bt *BTree) Get(key K) Loc {
 	item := &Item{
 		key: key,
 	}
+	bt.mu.RLock()
+	defer bt.mu.RUnlock()
 	if v := bt.tree.Get(item); v != nil {
 		return v.(*Item).loc
 	}
@@ -71,7 +73,25 @@ func (bt *BTree) Delete(key K) (Loc, bool) {
 	return oldItem.(*Item).loc, true
 }
 
+func (bt *BTree) Range(start, end K) ([]K, bool) {
+	var keys []K
+	saveKeyFunc := func(it btree.Item) bool {
+		keys = append(keys, it.(*Item).key)
+		return true
+	}
+	bt.mu.RLock()
+	defer bt.mu.RUnlock()
+	if len(end) == 0 {
+		bt.tree.AscendGreaterOrEqual(&Item{key: start}, saveKeyFunc)
+	} else {
+		bt.tree.AscendRange(&Item{key: start}, &Item{key: end}, saveKeyFunc)
+	}
+	return keys, true
+}
+
 func (bt *BTree) Size() int {
+	bt.mu.RLock()
+	defer bt.mu.RUnlock()
 	return bt.tree.Len()
 }
 
@@ -0,0 +1,249 @@
+package meta
+
+import (
+	"bytes"
+	"hash/maphash"
+	"sync"
+)
+
+const (
+	// hashShardBits is the number of the top hash bits used to pick a shard.
+	hashShardBits = 6
+	hashShardNum  = 1 << hashShardBits
+	// hashInitCap is the initial slot number of a shard, must be a power of two.
+	hashInitCap = 16
+)
+
+// hash values reserved for slot states.
+const (
+	hashEmpty uint64 = iota
+	hashTombstone
+	hashMinValid
+)
+
+var hashSeed = maphash.MakeSeed()
+
+// Hash is an unordered in-memory index for point-lookup workloads.
+// It's a sharded open-addressing hash map with linear probing, every
+// shard has its own lock. It keeps no ordering between keys, so the
+// iterator is unordered and Seek is not supported.
+type Hash struct {
+	shards [hashShardNum]*hashShard
+}
+
+type hashShard struct {
+	mu      sync.RWMutex
+	entries []hashEntry
+	count   int
+	tombs   int
+}
+
+type hashEntry struct {
+	hash uint64
+	key  K
+	loc  Loc
+}
+
+func NewHash() *Hash {
+	h := &Hash{}
+	for i := range h.shards {
+		h.shards[i] = &hashShard{entries: make([]hashEntry, hashInitCap)}
+	}
+	return h
+}
+
+func hashKey(key K) uint64 {
+	h := maphash.Bytes(hashSeed, key)
+	if h < hashMinValid {
+		h += hashMinValid
+	}
+	return h
+}
+
+func (h *Hash) shard(hash uint64) *hashShard {
+	return h.shards[hash>>(64-hashShardBits)]
+}
+
+func (h *Hash) Put(key K, loc Loc) Loc {
+	hash := hashKey(key)
+	s := h.shard(hash)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(hash, key, loc)
+}
+
+func (h *Hash) Get(key K) Loc {
+	hash := hashKey(key)
+	s := h.shard(hash)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if i := s.find(hash, key); i >= 0 {
+		return s.entries[i].loc
+	}
+	return nil
+}
+
+func (h *Hash) Delete(key K) (Loc, bool) {
+	hash := hashKey(key)
+	s := h.shard(hash)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(hash, key)
+	if i < 0 {
+		return nil, false
+	}
+	oldLoc := s.entries[i].loc
+	s.entries[i] = hashEntry{hash: hashTombstone}
+	s.count--
+	s.tombs++
+	return oldLoc, true
+}
+
+func (h *Hash) Size() int {
+	var size int
+	for _, s := range h.shards {
+		s.mu.RLock()
+		size += s.count
+		s.mu.RUnlock()
+	}
+	return size
+}
+
+// Iterator returns an unordered iterator of the hash index.
+// The Reverse option is ignored, and the keys not matching
+// the Prefix option are filtered out.
+func (h *Hash) Iterator(opt IteratorOpt) Iterator {
+	var values []*Item
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for i := range s.entries {
+			e := &s.entries[i]
+			if e.hash < hashMinValid || !bytes.HasPrefix(e.key, opt.Prefix) {
+				continue
+			}
+			values = append(values, &Item{key: e.key, loc: e.loc})
+		}
+		s.mu.RUnlock()
+	}
+	return &hashIterator{values: values}
+}
+
+// find returns the slot index of the key, or -1 if not found.
+func (s *hashShard) find(hash uint64, key K) int {
+	mask := len(s.entries) - 1
+	for i := int(hash) & mask; ; i = (i + 1) & mask {
+		e := &s.entries[i]
+		if e.hash == hashEmpty {
+			return -1
+		}
+		if e.hash == hash && bytes.Equal(e.key, key) {
+			return i
+		}
+	}
+}
+
+func (s *hashShard) put(hash uint64, key K, loc Loc) Loc {
+	// keep the load factor (including tombstones) under 3/4,
+	// so that probing always ends at an empty slot.
+	if (s.count+s.tombs+1)*4 > len(s.entries)*3 {
+		s.resize()
+	}
+
+	mask := len(s.entries) - 1
+	slot := -1
+	for i := int(hash) & mask; ; i = (i + 1) & mask {
+		e := &s.entries[i]
+		if e.hash == hashEmpty {
+			if slot < 0 {
+				slot = i
+			}
+			break
+		}
+		if e.hash == hashTombstone {
+			if slot < 0 {
+				slot = i
+			}
+			continue
+		}
+		if e.hash == hash && bytes.Equal(e.key, key) {
+			oldLoc := e.loc
+			e.loc = loc
+			return oldLoc
+		}
+	}
+
+	if s.entries[slot].hash == hashTombstone {
+		s.tombs--
+	}
+	s.entries[slot] = hashEntry{hash: hash, key: key, loc: loc}
+	s.count++
+	return nil
+}
+
+// resize rehashes all entries to drop the tombstones,
+// the capacity is doubled if the shard is at least half full.
+func (s *hashShard) resize() {
+	newCap := len(s.entries)
+	if (s.count+1)*2 >= newCap {
+		newCap *= 2
+	}
+	oldEntries := s.entries
+	s.entries = make([]hashEntry, newCap)
+	s.tombs = 0
+
+	mask := newCap - 1
+	for _, e := range oldEntries {
+		if e.hash < hashMinValid {
+			continue
+		}
+		i := int(e.hash) & mask
+		for s.entries[i].hash != hashEmpty {
+			i = (i + 1) & mask
+		}
+		s.entries[i] = e
+	}
+}
+
+// hashIterator iterates over a snapshot of the hash index in no particular order.
+type hashIterator struct {
+	curIndex int
+	values   []*Item
+	err      error
+}
+
+func (hi *hashIterator) Rewind() {
+	hi.curIndex = 0
+	hi.err = nil
+}
+
+// Seek is not supported since the keys are unordered,
+// it invalidates the iterator and Err returns ErrUnorderedSeek.
+func (hi *hashIterator) Seek(key []byte) {
+	hi.curIndex = len(hi.values)
+	hi.err = ErrUnorderedSeek
+}
+
+func (hi *hashIterator) Next() {
+	hi.curIndex += 1
+}
+
+func (hi *hashIterator) Valid() bool {
+	return hi.curIndex < len(hi.values)
+}
+
+func (hi *hashIterator) Key() []byte {
+	return hi.values[hi.curIndex].key
+}
+
+func (hi *hashIterator) Value() Loc {
+	return hi.values[hi.curIndex].loc
+}
+
+// Err returns the error caused by an unsupported operation.
+func (hi *hashIterator) Err() error {
+	return hi.err
+}
+
+func (hi *hashIterator) Close() {
+	hi.values = nil
+}
@@ -0,0 +1,68 @@
+package meta
+
+import (
+	"testing"
+
+	"github.com/berylyvos/yojoudb/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHash_Put_Get_Delete(t *testing.T) {
+	h := NewHash()
+
+	assert.Nil(t, h.Get(utils.TestKey(1)))
+	assert.Nil(t, h.Put(utils.TestKey(1), &Loc1{BlockIndex: 1, ChunkOffset: 100}))
+	assert.Equal(t, &Loc1{BlockIndex: 1, ChunkOffset: 100},
+		h.Put(utils.TestKey(1), &Loc1{BlockIndex: 2, ChunkOffset: 200}))
+	assert.Equal(t, &Loc1{BlockIndex: 2, ChunkOffset: 200}, h.Get(utils.TestKey(1)))
+
+	loc, ok := h.Delete(utils.TestKey(1))
+	assert.True(t, ok)
+	assert.Equal(t, &Loc1{BlockIndex: 2, ChunkOffset: 200}, loc)
+	loc, ok = h.Delete(utils.TestKey(1))
+	assert.False(t, ok)
+	assert.Nil(t, loc)
+	assert.Equal(t, 0, h.Size())
+
+	// grow and reuse tombstones
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10000; i++ {
+			h.Put(utils.TestKey(i), &Loc1{ChunkOffset: int64(i)})
+		}
+		assert.Equal(t, 10000, h.Size())
+		for i := 0; i < 10000; i++ {
+			assert.Equal(t, int64(i), h.Get(utils.TestKey(i)).ChunkOffset)
+		}
+		for i := 0; i < 10000; i += 2 {
+			_, ok := h.Delete(utils.TestKey(i))
+			assert.True(t, ok)
+		}
+		assert.Equal(t, 5000, h.Size())
+		for i := 0; i < 10000; i++ {
+			assert.Equal(t, i%2 == 1, h.Get(utils.TestKey(i)) != nil)
+		}
+	}
+}
+
+func TestHash_Iterator(t *testing.T) {
+	h := NewHash()
+	for i := 0; i < 1000; i++ {
+		h.Put(utils.TestKey(i), &Loc1{ChunkOffset: int64(i)})
+	}
+	h.Put([]byte("other"), &Loc1{})
+
+	seen := make(map[string]struct{})
+	iter := h.Iterator(IteratorOpt{Prefix: []byte("yojou-key-")})
+	for ; iter.Valid(); iter.Next() {
+		seen[string(iter.Key())] = struct{}{}
+		assert.NotNil(t, iter.Value())
+	}
+	assert.Equal(t, 1000, len(seen))
+
+	iter.Rewind()
+	assert.True(t, iter.Valid())
+	iter.Seek(utils.TestKey(1))
+	assert.False(t, iter.Valid())
+	assert.Equal(t, ErrUnorderedSeek, iter.(*hashIterator).Err())
+	iter.Close()
+}
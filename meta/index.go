@@ -1,6 +1,8 @@
 package meta
 
 import (
+	"errors"
+
 	"github.com/berylyvos/yojoudb/wal"
 )
 
@@ -20,14 +22,28 @@ type Indexer interface {
 	Size() int
 }
 
+// Ranger is implemented by the ordered indexes, which find the keys in
+// a range without scanning the whole index.
+type Ranger interface {
+	// Range returns the keys in [start, end), the range is unbounded
+	// above if end is empty. It returns false if the index can't find
+	// the keys, i.e. Sharded of an index type which isn't a Ranger.
+	Range(start, end K) ([]K, bool)
+}
+
 type IndexType = uint8
 
 const (
 	IndexBTree IndexType = iota
 	IndexART
 	IndexSKL
+	IndexHash
 )
 
+// ErrUnorderedSeek is returned by the iterator of an unordered index,
+// i.e. Hash, after calling Seek on it.
+var ErrUnorderedSeek = errors.New("seek is not supported by an unordered index")
+
 func NewIndexer(indexType IndexType) Indexer {
 	switch indexType {
 	case IndexBTree:
@@ -36,6 +52,8 @@ func NewIndexer(indexType IndexType) Indexer {
 		return NewART()
 	case IndexSKL:
 		return NewSkiplist()
+	case IndexHash:
+		return NewHash()
 	default:
 		panic("unsupported index type")
 	}
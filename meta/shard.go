@@ -0,0 +1,194 @@
+package meta
+
+import (
+	"bytes"
+	"container/heap"
+	"hash/maphash"
+)
+
+// Sharded is an in-memory index partitioned by the hash of the key.
+// Every shard is an independent indexer with its own lock, so the
+// updates of different keys rarely contend with each other.
+// The iterator merges all shards, keeping the order of the keys.
+type Sharded struct {
+	seed   maphash.Seed
+	shards []Indexer
+}
+
+// NewShardedIndexer returns an indexer of the given type partitioned
+// into the given number of shards. IndexHash is already sharded by
+// itself, so a single instance is returned for it, as well as when
+// shards is not greater than one.
+func NewShardedIndexer(indexType IndexType, shards int) Indexer {
+	if shards <= 1 || indexType == IndexHash {
+		return NewIndexer(indexType)
+	}
+	s := &Sharded{
+		seed:   maphash.MakeSeed(),
+		shards: make([]Indexer, shards),
+	}
+	for i := range s.shards {
+		s.shards[i] = NewIndexer(indexType)
+	}
+	return s
+}
+
+func (s *Sharded) shard(key K) Indexer {
+	return s.shards[maphash.Bytes(s.seed, key)%uint64(len(s.shards))]
+}
+
+func (s *Sharded) Put(key K, loc Loc) Loc {
+	return s.shard(key).Put(key, loc)
+}
+
+func (s *Sharded) Get(key K) Loc {
+	return s.shard(key).Get(key)
+}
+
+func (s *Sharded) Delete(key K) (Loc, bool) {
+	return s.shard(key).Delete(key)
+}
+
+func (s *Sharded) Size() int {
+	var size int
+	for _, shard := range s.shards {
+		size += shard.Size()
+	}
+	return size
+}
+
+// Range returns the keys in the range from all shards, which are not
+// ordered across the shards. It returns false if any shard is not a Ranger.
+func (s *Sharded) Range(start, end K) ([]K, bool) {
+	var keys []K
+	for _, shard := range s.shards {
+		r, ok := shard.(Ranger)
+		if !ok {
+			return nil, false
+		}
+		shardKeys, ok := r.Range(start, end)
+		if !ok {
+			return nil, false
+		}
+		keys = append(keys, shardKeys...)
+	}
+	return keys, true
+}
+
+// Iterator returns an iterator merging the iterators of all shards,
+// nil if any shard does not support iterating. Every shard iterator is
+// already ordered, so they are merged by a heap without sorting.
+func (s *Sharded) Iterator(opt IteratorOpt) Iterator {
+	iters := make([]Iterator, 0, len(s.shards))
+	for _, shard := range s.shards {
+		iter := shard.Iterator(opt)
+		if iter == nil {
+			for _, it := range iters {
+				it.Close()
+			}
+			return nil
+		}
+		iters = append(iters, iter)
+	}
+	si := &shardedIterator{
+		iters: iters,
+		heap:  iterHeap{reverse: opt.Reverse},
+	}
+	si.init()
+	return si
+}
+
+// shardedIterator merges the shard iterators, the heap holds the valid
+// ones ordered by their current keys. A key is only in a single shard,
+// so the keys of the heap are distinct.
+type shardedIterator struct {
+	iters []Iterator
+	heap  iterHeap
+}
+
+// init rebuilds the heap after the shard iterators are moved.
+func (si *shardedIterator) init() {
+	si.heap.iters = si.heap.iters[:0]
+	for _, iter := range si.iters {
+		if iter.Valid() {
+			si.heap.iters = append(si.heap.iters, iter)
+		}
+	}
+	heap.Init(&si.heap)
+}
+
+func (si *shardedIterator) Rewind() {
+	for _, iter := range si.iters {
+		iter.Rewind()
+	}
+	si.init()
+}
+
+func (si *shardedIterator) Seek(key []byte) {
+	for _, iter := range si.iters {
+		iter.Seek(key)
+	}
+	si.init()
+}
+
+func (si *shardedIterator) Next() {
+	top := si.heap.iters[0]
+	top.Next()
+	if top.Valid() {
+		heap.Fix(&si.heap, 0)
+	} else {
+		heap.Pop(&si.heap)
+	}
+}
+
+func (si *shardedIterator) Valid() bool {
+	return len(si.heap.iters) > 0
+}
+
+func (si *shardedIterator) Key() []byte {
+	return si.heap.iters[0].Key()
+}
+
+func (si *shardedIterator) Value() Loc {
+	return si.heap.iters[0].Value()
+}
+
+func (si *shardedIterator) Close() {
+	for _, iter := range si.iters {
+		iter.Close()
+	}
+	si.iters = nil
+	si.heap.iters = nil
+}
+
+// iterHeap is a heap of the iterators by their current keys, the
+// smallest key is on the top, or the largest one if reverse.
+type iterHeap struct {
+	iters   []Iterator
+	reverse bool
+}
+
+func (h *iterHeap) Len() int {
+	return len(h.iters)
+}
+
+func (h *iterHeap) Less(i, j int) bool {
+	if h.reverse {
+		return bytes.Compare(h.iters[i].Key(), h.iters[j].Key()) > 0
+	}
+	return bytes.Compare(h.iters[i].Key(), h.iters[j].Key()) < 0
+}
+
+func (h *iterHeap) Swap(i, j int) {
+	h.iters[i], h.iters[j] = h.iters[j], h.iters[i]
+}
+
+func (h *iterHeap) Push(x interface{}) {
+	h.iters = append(h.iters, x.(Iterator))
+}
+
+func (h *iterHeap) Pop() interface{} {
+	last := h.iters[len(h.iters)-1]
+	h.iters = h.iters[:len(h.iters)-1]
+	return last
+}
@@ -0,0 +1,110 @@
+package meta
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/berylyvos/yojoudb/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharded_Iterator(t *testing.T) {
+	index := NewShardedIndexer(IndexBTree, 8)
+	var keys [][]byte
+	for i := 0; i < 1000; i++ {
+		key := utils.RandValue(10)
+		keys = append(keys, key)
+		index.Put(key, &Loc1{ChunkOffset: int64(i)})
+	}
+	assert.Equal(t, 1000, index.Size())
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+
+	iter := index.Iterator(IteratorOpt{})
+	var i int
+	for ; iter.Valid(); iter.Next() {
+		assert.Equal(t, keys[i], iter.Key())
+		i++
+	}
+	assert.Equal(t, 1000, i)
+	iter.Seek(keys[500])
+	assert.Equal(t, keys[500], iter.Key())
+	iter.Next()
+	assert.Equal(t, keys[501], iter.Key())
+	iter.Rewind()
+	assert.Equal(t, keys[0], iter.Key())
+	iter.Close()
+
+	iter = index.Iterator(IteratorOpt{Reverse: true})
+	defer iter.Close()
+	assert.Equal(t, keys[999], iter.Key())
+	iter.Seek(keys[10])
+	for i = 10; iter.Valid(); iter.Next() {
+		assert.Equal(t, keys[i], iter.Key())
+		i--
+	}
+	assert.Equal(t, -1, i)
+
+	for _, key := range keys[:500] {
+		_, ok := index.Delete(key)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 500, index.Size())
+	assert.Nil(t, index.Get(keys[0]))
+	assert.NotNil(t, index.Get(keys[500]))
+}
+
+func TestSharded_Range(t *testing.T) {
+	var keys [][]byte
+	for _, prefix := range []string{"a", "ab", "abc", "b", "ba", "c"} {
+		for i := 0; i < 50; i++ {
+			keys = append(keys, append([]byte(prefix), utils.RandValue(4)...))
+		}
+	}
+	ranges := [][2][]byte{
+		{[]byte("ab"), []byte("ac")},
+		{[]byte("abc"), []byte("abd")},
+		{[]byte("a"), []byte("b")},
+		{[]byte("aa"), []byte("bb")},
+		{[]byte("b"), nil},
+		{nil, nil},
+		{nil, []byte("ab")},
+		{[]byte("abz"), []byte("bb")},
+		{[]byte("ab\xff\xff"), []byte("c\x00")},
+	}
+	for _, indexType := range []IndexType{IndexBTree, IndexART} {
+		for _, shards := range []int{1, 8} {
+			index := NewShardedIndexer(indexType, shards)
+			for i, key := range keys {
+				index.Put(key, &Loc1{ChunkOffset: int64(i)})
+			}
+			for _, r := range ranges {
+				var expect []string
+				for _, key := range keys {
+					if bytes.Compare(key, r[0]) >= 0 && (len(r[1]) == 0 || bytes.Compare(key, r[1]) < 0) {
+						expect = append(expect, string(key))
+					}
+				}
+				var got []string
+				rangeKeys, ok := index.(Ranger).Range(r[0], r[1])
+				assert.True(t, ok)
+				for _, key := range rangeKeys {
+					got = append(got, string(key))
+				}
+				// the keys of a single shard are ordered.
+				if shards == 1 {
+					assert.True(t, sort.StringsAreSorted(got))
+				}
+				sort.Strings(expect)
+				sort.Strings(got)
+				assert.Equal(t, expect, got, "type %d, shards %d, range %q", indexType, shards, r)
+			}
+		}
+	}
+
+	// the shards can't find the keys in a range.
+	_, ok := NewShardedIndexer(IndexSKL, 8).(Ranger).Range([]byte("a"), nil)
+	assert.False(t, ok)
+}
@@ -2,6 +2,10 @@ package yojoudb
 
 import (
 	"os"
+	"time"
+
+	"github.com/berylyvos/yojoudb/vfs"
+	"github.com/berylyvos/yojoudb/wal"
 )
 
 const (
@@ -17,6 +21,17 @@ const (
 	IndexBTree IndexType = iota
 	IndexART
 	IndexSKL
+	IndexHash
+)
+
+// SyncPolicy specifies when the writes are synced to disk.
+type SyncPolicy = wal.SyncPolicy
+
+const (
+	SyncNever      = wal.SyncNever
+	SyncEveryWrite = wal.SyncEveryWrite
+	SyncEveryN     = wal.SyncEveryN
+	SyncInterval   = wal.SyncInterval
 )
 
 type Options struct {
@@ -25,6 +40,116 @@ type Options struct {
 	Sync         bool
 	BytesPerSync uint32
 	IndexType    IndexType
+
+	// SyncPolicy specifies when the data files are synced. If it's
+	// SyncNever, Sync and BytesPerSync decide the policy, that is
+	// SyncEveryWrite if Sync is true, or SyncEveryN if BytesPerSync > 0.
+	SyncPolicy SyncPolicy
+
+	// SyncInterval is the interval of the background sync for SyncInterval.
+	SyncInterval time.Duration
+
+	// IndexShards is the number of shards the index is partitioned
+	// into by the hash of the key, 0 or 1 means no partition.
+	IndexShards int
+
+	// MaxGroupCommitDelay is the longest time a group of concurrent
+	// commits waits for more commits to share a single fsync.
+	// It only takes effect when the group needs to be synced.
+	MaxGroupCommitDelay time.Duration
+
+	// MaxGroupSize is the max number of batches committed in a group,
+	// 0 means the default size 128.
+	MaxGroupSize int
+
+	// KeepVersions is the number of versions kept for every key,
+	// including the current one. KeepVersionsFor keeps the versions
+	// written within the duration. A version is kept if any of them
+	// keeps it, the old versions are readable by GetHistory and GetAt.
+	// Multiple versions are disabled if KeepVersions is not greater
+	// than 1 and KeepVersionsFor is 0. A delete removes all versions.
+	KeepVersions    int
+	KeepVersionsFor time.Duration
+
+	// RecoverUntil opens the database as of a point in the past, the
+	// batches committed after the point are ignored. The database is
+	// read-only then, call DB.Fork to write the data to a new directory.
+	// The point can't be earlier than the last merge. Nil means all.
+	RecoverUntil *RecoveryPoint
+
+	// OpenProgress is called after each data file has been loaded
+	// into the index when opening the database, it's useful to report
+	// the progress of a large store. Could be nil.
+	OpenProgress func(loaded, total int)
+
+	// FS is the file system of the database, nil means vfs.Default,
+	// i.e. the os file system. Use vfs.NewMem() for a database in memory.
+	FS vfs.FS
+
+	// PreallocateSegments specifies whether to allocate the disk space of
+	// a new data file up to SegmentSize when it's created, which saves the
+	// metadata updates of growing the file on every sync.
+	PreallocateSegments bool
+
+	// MmapReads specifies whether to map the sealed data files into memory
+	// read-only, the reads of them slice the mapping instead of calling
+	// read, which suits read-heavy workloads. See also DB.GetView.
+	MmapReads bool
+
+	// MaxOpenSegments specifies the maximum number of the open data files,
+	// the files of the least recently read ones are closed beyond it, and
+	// reopened when read again, which keeps a large store with a small
+	// SegmentSize under the limit of open files. The limit applies to the
+	// data files and the blob files separately, so up to twice as many
+	// files could be open if there are blob files, see BlobThreshold.
+	// 0 means no limit.
+	MaxOpenSegments int
+
+	// BlobThreshold specifies the size above which a value is written to
+	// a blob file, while the data file only keeps the location of it. A
+	// value larger than SegmentSize takes a blob file of its own, and
+	// Merge doesn't rewrite the separated values. A sealed blob file is
+	// deleted by Merge once no key refers to it. The values are not
+	// separated if multiple versions are kept. 0 means never separated.
+	BlobThreshold int64
+}
+
+// RecoveryPoint is a point in the history of the database, specified
+// by a sequence number (see DB.LastSequence), or a commit time, or both.
+// A batch is after the point if either of them is exceeded. The batches
+// written by an old version without them are always before the point.
+type RecoveryPoint struct {
+	Seq  uint64    // 0 means no limit.
+	Time time.Time // zero means no limit.
+}
+
+// after reports whether the batch of the given sequence number
+// and commit time is after the recovery point.
+func (p *RecoveryPoint) after(seq uint64, ts int64) bool {
+	if p.Seq > 0 && seq > p.Seq {
+		return true
+	}
+	return !p.Time.IsZero() && ts > p.Time.UnixNano()
+}
+
+// fs returns the file system of the options.
+func (opt *Options) fs() vfs.FS {
+	if opt.FS != nil {
+		return opt.FS
+	}
+	return vfs.Default
+}
+
+// versioned reports whether multiple versions are kept.
+func (opt *Options) versioned() bool {
+	return opt.KeepVersions > 1 || opt.KeepVersionsFor > 0
+}
+
+// retained reports whether the i-th newest version of a key, written
+// at the given timestamp, is kept at the time now.
+func (opt *Options) retained(i int, ts int64, now time.Time) bool {
+	return i == 0 || i < opt.KeepVersions ||
+		(opt.KeepVersionsFor > 0 && ts > now.Add(-opt.KeepVersionsFor).UnixNano())
 }
 
 type IteratorOptions struct {
@@ -35,6 +160,10 @@ type IteratorOptions struct {
 type BatchOptions struct {
 	Sync     bool
 	ReadOnly bool
+
+	// MaxSize is the max total size of the keys and values pending
+	// in the batch, 0 means no limit.
+	MaxSize int64
 }
 
 var DefaultOptions = Options{
@@ -43,6 +172,7 @@ var DefaultOptions = Options{
 	Sync:         false,
 	BytesPerSync: 0,
 	IndexType:    IndexART,
+	IndexShards:  16,
 }
 
 var DefaultIteratorOptions = IteratorOptions{
@@ -11,24 +11,57 @@ const (
 	LRNormal LRType = iota
 	LRDeleted
 	LRBatchFin
+	// LRRangeDel deletes all keys in [Key, Val), the range
+	// is unbounded above if Val is empty.
+	LRRangeDel
 )
 
-const maxLogRecordHeaderSize = 0x15
+// lrVersioned is the flag bit of the type byte, which indicates that
+// the record carries its commit timestamp and the previous version.
+const lrVersioned LRType = 0x80
+
+// lrBlob is the flag bit of the type byte, which indicates that the val
+// is the location of the value in the blob files, see Options.BlobThreshold.
+const lrBlob LRType = 0x40
+
+const (
+	maxLogRecordHeaderSize = 0x15
+	// timestamp(10) + prev_size(1) + prev(25)
+	maxVersionHeaderSize = 0x24
+)
 
 // LogRecord is the log record of the key/val.
+// The BatchId is the sequence number of the batch the record belongs
+// to, which is assigned monotonically on commit.
+//
+// A versioned record also has the commit Timestamp, and the location
+// of the Prev version of the key, they are only written when the db
+// keeps multiple versions, which is indicated by a non-zero Timestamp.
+//
+// If the value is separated into the blob files, Blob is the location
+// of it, which is written instead of the Val.
 type LogRecord struct {
-	Key     K
-	Val     V
-	Type    LRType
-	BatchId uint64
+	Key       K
+	Val       V
+	Type      LRType
+	BatchId   uint64
+	Timestamp int64
+	Prev      *wal.ChunkLoc
+	Blob      *wal.ChunkLoc
 }
 
 // IndexRecord is the index record of the key.
 // Only used in start up to build in-mem index.
 type IndexRecord struct {
-	key K
-	typ LRType
-	loc *wal.ChunkLoc
+	key      K
+	end      K // end of the range deletion.
+	typ      LRType
+	batchId  uint64
+	legacy   bool  // batchId is a snowflake id rather than a sequence number.
+	upgraded bool  // written by an old version, see Upgrade.
+	ts       int64 // commit time of the batch, only for the end-of-batch record.
+	loc      *wal.ChunkLoc
+	blob     *wal.ChunkLoc // location of the value in the blob files if any.
 }
 
 // encodeLR encodes a LogRecord into bytes.
@@ -38,27 +71,51 @@ type IndexRecord struct {
 //	|   typ   |   batch_id   |  key_size  |  val_size  |    key     |    val     |
 //	+--- 1 ---+----var(10)---+-- var(5) --+-- var(5) --+------------+------------+
 //	+
+//
+// If the lrVersioned bit of typ is set, the version header follows val_size.
+// If the lrBlob bit is set, the val is the encoded location of the value
+// in the blob files.
+//
+//	+--------------+-------------+------------+
+//	|  timestamp   |  prev_size  |    prev    |
+//	+---var(10)----+-- var(1) ---+-- var(25) -+
 func encodeLR(lr *LogRecord) []byte {
-	header := make([]byte, maxLogRecordHeaderSize)
+	header := make([]byte, maxLogRecordHeaderSize+maxVersionHeaderSize)
 
 	header[0] = lr.Type
+	val := lr.Val
+	if lr.Blob != nil {
+		header[0] |= lrBlob
+		val = lr.Blob.Encode()
+	}
 	idx := 1
-	ksz, vsz := len(lr.Key), len(lr.Val)
+	ksz, vsz := len(lr.Key), len(val)
 	idx += binary.PutUvarint(header[idx:], lr.BatchId)
 	idx += binary.PutVarint(header[idx:], int64(ksz))
 	idx += binary.PutVarint(header[idx:], int64(vsz))
+	if lr.Timestamp != 0 {
+		header[0] |= lrVersioned
+		idx += binary.PutVarint(header[idx:], lr.Timestamp)
+		var prev []byte
+		if lr.Prev != nil {
+			prev = lr.Prev.Encode()
+		}
+		idx += binary.PutUvarint(header[idx:], uint64(len(prev)))
+		idx += copy(header[idx:], prev)
+	}
 
 	b := make([]byte, idx+ksz+vsz)
 	copy(b[:idx], header[:idx])
 	copy(b[idx:], lr.Key)
-	copy(b[idx+ksz:], lr.Val)
+	copy(b[idx+ksz:], val)
 
 	return b
 }
 
-// decodeLR decodes the log record from the given bytes.
-func decodeLR(b []byte) *LogRecord {
-	typ := b[0]
+// decodeLRHeader decodes the header of the log record, returns the
+// record without key and val, their sizes and the header size.
+func decodeLRHeader(b []byte) (*LogRecord, int64, int64, int) {
+	lr := &LogRecord{Type: b[0] &^ (lrVersioned | lrBlob)}
 
 	idx := 1
 	batchId, n := binary.Uvarint(b[idx:])
@@ -67,18 +124,66 @@ func decodeLR(b []byte) *LogRecord {
 	idx += n
 	valSize, n := binary.Varint(b[idx:])
 	idx += n
+	lr.BatchId = batchId
+
+	if b[0]&lrVersioned != 0 {
+		lr.Timestamp, n = binary.Varint(b[idx:])
+		idx += n
+		prevSize, n := binary.Uvarint(b[idx:])
+		idx += n
+		lr.Prev = wal.DecodeChunkLoc(b[idx : idx+int(prevSize)])
+		idx += int(prevSize)
+	}
+	return lr, keySize, valSize, idx
+}
+
+// decodeLR decodes the log record from the given bytes.
+func decodeLR(b []byte) *LogRecord {
+	lr, keySize, valSize, idx := decodeLRHeader(b)
 
 	key := make([]byte, keySize)
 	copy(key[:], b[idx:idx+int(keySize)])
 	idx += int(keySize)
 
+	if b[0]&lrBlob != 0 {
+		lr.Key, lr.Blob = key, wal.DecodeChunkLoc(b[idx:idx+int(valSize)])
+		return lr
+	}
 	val := make([]byte, valSize)
 	copy(val[:], b[idx:idx+int(valSize)])
 
-	return &LogRecord{
-		Key:     key,
-		Val:     val,
-		Type:    typ,
-		BatchId: batchId,
+	lr.Key, lr.Val = key, val
+	return lr
+}
+
+// decodeLRView decodes the log record from the given bytes without
+// copying, the key and val refer to the bytes.
+func decodeLRView(b []byte) *LogRecord {
+	lr, keySize, valSize, idx := decodeLRHeader(b)
+	keyEnd := idx + int(keySize)
+	valEnd := keyEnd + int(valSize)
+	lr.Key = b[idx:keyEnd:keyEnd]
+	if b[0]&lrBlob != 0 {
+		lr.Blob = wal.DecodeChunkLoc(b[keyEnd:valEnd])
+	} else {
+		lr.Val = b[keyEnd:valEnd:valEnd]
+	}
+	return lr
+}
+
+// decodeLRKey decodes the header and key of the log record from the
+// given bytes, the value is skipped without copying, except for the
+// end of a range deletion and the location of a blob.
+// Only used in start up to build in-mem index.
+func decodeLRKey(b []byte) *LogRecord {
+	lr, keySize, _, idx := decodeLRHeader(b)
+	if lr.Type == LRRangeDel || b[0]&lrBlob != 0 {
+		return decodeLR(b)
 	}
+
+	key := make([]byte, keySize)
+	copy(key[:], b[idx:idx+int(keySize)])
+
+	lr.Key = key
+	return lr
 }
@@ -1,23 +1,37 @@
 package utils
 
 import (
-	"io/fs"
 	"path/filepath"
 	"syscall"
+
+	"github.com/berylyvos/yojoudb/vfs"
 )
 
-func DirSize(dirPath string) (int64, error) {
+// DirSize returns the total size of the files in the directory of
+// the given file system, including the sub directories.
+func DirSize(fs vfs.FS, dirPath string) (int64, error) {
+	entries, err := fs.ReadDir(dirPath)
+	if err != nil {
+		return 0, err
+	}
 	var size int64
-	err := filepath.Walk(dirPath, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
+	for _, entry := range entries {
+		path := filepath.Join(dirPath, entry.Name())
+		if entry.IsDir() {
+			n, err := DirSize(fs, path)
+			if err != nil {
+				return 0, err
+			}
+			size += n
+			continue
 		}
-		if !info.IsDir() {
-			size += info.Size()
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
 		}
-		return nil
-	})
-	return size, err
+		size += info.Size()
+	}
+	return size, nil
 }
 
 func AvailableDiskSize() (uint64, error) {
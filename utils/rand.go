@@ -3,10 +3,12 @@ package utils
 import (
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 )
 
 var (
+	randMu  sync.Mutex
 	randStr = rand.New(rand.NewSource(time.Now().Unix()))
 	letters = []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 )
@@ -17,6 +19,8 @@ func TestKey(i int) []byte {
 
 func RandValue(n int) []byte {
 	b := make([]byte, n)
+	randMu.Lock()
+	defer randMu.Unlock()
 	for i := range b {
 		b[i] = letters[randStr.Intn(len(letters))]
 	}
@@ -0,0 +1,16 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate allocates the disk space of the file with fallocate,
+// it falls back to extending the file on the file systems without it.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return extend(osFile{f}, size)
+	}
+	return err
+}
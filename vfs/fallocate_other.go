@@ -0,0 +1,10 @@
+//go:build !linux
+
+package vfs
+
+import "os"
+
+// preallocate extends the file on the platforms without fallocate.
+func preallocate(f *os.File, size int64) error {
+	return extend(osFile{f}, size)
+}
@@ -0,0 +1,293 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrInjected is returned by the operations failed by FaultFS.
+var ErrInjected = errors.New("injected fault")
+
+// Op is the kind of the mutating operations of FaultFS.
+type Op int
+
+const (
+	OpCreate Op = iota
+	OpWrite
+	OpSync
+	OpTruncate
+	OpRename
+	OpRemove
+	OpSyncDir
+)
+
+// FaultFS is a file system in memory which injects faults into the
+// mutating operations, and simulates the state after a power loss,
+// for testing the crash consistency.
+//
+// It keeps track of what has been made durable: the content of a file
+// is durable once it's synced, and the entries of a directory, i.e. the
+// created, renamed and removed files, are durable once the directory
+// is synced. Creating and removing directories are durable at once.
+type FaultFS struct {
+	mem *memFS
+
+	mu         sync.Mutex
+	rand       *rand.Rand
+	ops        int
+	crashAfter int
+	failNext   map[Op]bool
+	entries    map[string]*memNode // the durable directory entries.
+	synced     map[*memNode][]byte // the durable content of the files.
+}
+
+// NewFault returns an empty FaultFS, the seed decides the data
+// kept by Crash.
+func NewFault(seed int64) *FaultFS {
+	return &FaultFS{
+		mem:        NewMem().(*memFS),
+		rand:       rand.New(rand.NewSource(seed)),
+		crashAfter: -1,
+		failNext:   make(map[Op]bool),
+		entries:    make(map[string]*memNode),
+		synced:     make(map[*memNode][]byte),
+	}
+}
+
+// Ops returns the number of the mutating operations done so far,
+// including the failed ones.
+func (f *FaultFS) Ops() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ops
+}
+
+// CrashAfter makes all the mutating operations fail with ErrInjected
+// once n of them have been done, as if the machine crashed at that
+// point. A negative n disables it.
+func (f *FaultFS) CrashAfter(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crashAfter = n
+}
+
+// FailNext makes the next operation of the given kind fail once.
+func (f *FaultFS) FailNext(op Op) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failNext[op] = true
+}
+
+// Crash returns a new FaultFS with the durable state of this one, as
+// what is left after a power loss. The file written after the last sync
+// keeps a random part of the data written since then, from the first
+// changed byte, simulating a torn write, while the one truncated goes
+// back to the synced content.
+func (f *FaultFS) Crash() *FaultFS {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+
+	crashed := NewFault(f.rand.Int63())
+	for dir, modTime := range f.mem.dirs {
+		crashed.mem.dirs[dir] = modTime
+	}
+	for name, node := range f.entries {
+		if !crashed.mem.isDir(filepath.Dir(name)) {
+			continue
+		}
+		node.mu.RLock()
+		data := f.crashData(node)
+		node.mu.RUnlock()
+
+		n := &memNode{data: data, modTime: time.Now()}
+		crashed.mem.files[name] = n
+		crashed.entries[name] = n
+		crashed.synced[n] = append([]byte(nil), data...)
+	}
+	return crashed
+}
+
+// crashData returns the content of the file after a crash.
+// The caller must hold f.mu and node.mu.
+func (f *FaultFS) crashData(node *memNode) []byte {
+	synced := f.synced[node]
+	if len(node.data) < len(synced) {
+		return append([]byte(nil), synced...)
+	}
+	changed := 0
+	for changed < len(synced) && node.data[changed] == synced[changed] {
+		changed++
+	}
+	n := changed + f.rand.Intn(len(node.data)-changed+1)
+	data := append([]byte(nil), node.data[:n]...)
+	if n < len(synced) {
+		data = append(data, synced[n:]...)
+	}
+	return data
+}
+
+// inject counts the operation and reports whether it should fail.
+func (f *FaultFS) inject(op Op) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ops++
+	if f.crashAfter >= 0 && f.ops > f.crashAfter {
+		return ErrInjected
+	}
+	if f.failNext[op] {
+		delete(f.failNext, op)
+		return ErrInjected
+	}
+	return nil
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&os.O_CREATE != 0 || (flag&os.O_TRUNC != 0 && writable(flag)) {
+		if err := f.inject(OpCreate); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	file, err := f.mem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{memFile: file.(*memFile), fs: f}, nil
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if err := f.inject(OpRename); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	f.mem.mu.Lock()
+	_, isFile := f.mem.files[oldpath]
+	isDir := !isFile && f.mem.isDir(oldpath)
+	f.mem.mu.Unlock()
+	if err := f.mem.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	// renaming a directory is durable at once, along with its entries.
+	if isDir {
+		f.mu.Lock()
+		for name, node := range f.entries {
+			if rel, ok := relPath(oldpath, name); ok {
+				delete(f.entries, name)
+				f.entries[filepath.Join(newpath, rel)] = node
+			}
+		}
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if err := f.inject(OpRemove); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return f.mem.Remove(name)
+}
+
+func (f *FaultFS) RemoveAll(path string) error {
+	if err := f.inject(OpRemove); err != nil {
+		return &os.PathError{Op: "removeall", Path: path, Err: err}
+	}
+	if err := f.mem.RemoveAll(path); err != nil {
+		return err
+	}
+
+	path = filepath.Clean(path)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name := range f.entries {
+		if _, ok := relPath(path, name); ok || name == path {
+			delete(f.entries, name)
+		}
+	}
+	return nil
+}
+
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	return f.mem.MkdirAll(path, perm)
+}
+
+func (f *FaultFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return f.mem.ReadDir(name)
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	return f.mem.Stat(name)
+}
+
+func (f *FaultFS) Lock(name string) (io.Closer, error) {
+	return f.mem.Lock(name)
+}
+
+func (f *FaultFS) SyncDir(name string) error {
+	if err := f.inject(OpSyncDir); err != nil {
+		return &os.PathError{Op: "sync", Path: name, Err: err}
+	}
+	if err := f.mem.SyncDir(name); err != nil {
+		return err
+	}
+
+	name = filepath.Clean(name)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+	for path := range f.entries {
+		if filepath.Dir(path) == name {
+			delete(f.entries, path)
+		}
+	}
+	for path, node := range f.mem.files {
+		if filepath.Dir(path) == name {
+			f.entries[path] = node
+		}
+	}
+	return nil
+}
+
+// faultFile is an open file of FaultFS.
+type faultFile struct {
+	*memFile
+	fs *FaultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.inject(OpWrite); err != nil {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: err}
+	}
+	return f.memFile.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.inject(OpSync); err != nil {
+		return &os.PathError{Op: "sync", Path: f.name, Err: err}
+	}
+	if err := f.memFile.Sync(); err != nil {
+		return err
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+	f.fs.synced[f.node] = append([]byte(nil), f.node.data...)
+	return nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fs.inject(OpTruncate); err != nil {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: err}
+	}
+	return f.memFile.Truncate(size)
+}
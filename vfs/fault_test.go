@@ -0,0 +1,91 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAll(t *testing.T, fs FS, name string) string {
+	f, err := Open(fs, name)
+	assert.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+	}()
+	data, err := io.ReadAll(f)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func TestFaultFS_Crash(t *testing.T) {
+	fs := NewFault(1)
+	assert.Nil(t, fs.MkdirAll("/a", os.ModePerm))
+
+	f, err := fs.OpenFile("/a/synced", os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	_, err = f.Write([]byte(" world"))
+	assert.Nil(t, err)
+
+	g, err := fs.OpenFile("/a/overwritten", os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	assert.Nil(t, Preallocate(g, 6))
+	assert.Nil(t, g.Sync())
+	assert.Nil(t, fs.SyncDir("/a"))
+
+	// the entry of the new file is not durable.
+	h, err := fs.OpenFile("/a/new", os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	assert.Nil(t, h.Sync())
+	// the preallocated space is overwritten.
+	_, err = g.Write([]byte("xyz"))
+	assert.Nil(t, err)
+	assert.Equal(t, 11, fs.Ops())
+
+	crashed := fs.Crash()
+	entries, err := crashed.ReadDir("/a")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	data := readAll(t, crashed, "/a/synced")
+	assert.True(t, len(data) >= 5)
+	assert.Equal(t, "hello world"[:len(data)], data)
+	torn := readAll(t, crashed, "/a/overwritten")
+	assert.Equal(t, 6, len(torn))
+	n := strings.IndexByte(torn, 0)
+	assert.Equal(t, "xyz\x00\x00\x00"[:n], torn[:n])
+
+	// the renamed file is back after a crash if the dir isn't synced.
+	assert.Nil(t, crashed.Rename("/a/synced", "/a/renamed"))
+	_, err = crashed.Stat("/a/renamed")
+	assert.Nil(t, err)
+	crashed = crashed.Crash()
+	_, err = crashed.Stat("/a/renamed")
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, data, readAll(t, crashed, "/a/synced"))
+}
+
+func TestFaultFS_Inject(t *testing.T) {
+	fs := NewFault(1)
+	assert.Nil(t, fs.MkdirAll("/a", os.ModePerm))
+	f, err := fs.OpenFile("/a/b", os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+
+	fs.FailNext(OpSync)
+	_, err = f.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.ErrorIs(t, f.Sync(), ErrInjected)
+	assert.Nil(t, f.Sync())
+
+	fs.CrashAfter(fs.Ops() + 1)
+	_, err = f.Write([]byte(" world"))
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("!"))
+	assert.ErrorIs(t, err, ErrInjected)
+	assert.ErrorIs(t, fs.Rename("/a/b", "/a/c"), ErrInjected)
+	assert.Equal(t, "hello world", readAll(t, fs, "/a/b"))
+}
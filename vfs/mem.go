@@ -0,0 +1,475 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memFS is a file system in memory, which is useful for tests and
+// ephemeral databases. The files keep their data after being removed
+// or renamed as long as they are open, like the unix file systems.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]time.Time // dir => modTime
+	locks map[string]bool
+}
+
+// memNode is the content of a file.
+type memNode struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+// memFile is an open file of memFS.
+type memFile struct {
+	name   string
+	node   *memNode
+	flag   int
+	mu     sync.Mutex
+	pos    int64
+	closed bool
+}
+
+// NewMem returns an empty file system in memory.
+func NewMem() FS {
+	return &memFS{
+		files: make(map[string]*memNode),
+		dirs:  make(map[string]time.Time),
+		locks: make(map[string]bool),
+	}
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.isDir(name) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	node, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if !m.isDir(filepath.Dir(name)) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		node = &memNode{modTime: time.Now()}
+		m.files[name] = node
+	}
+	if flag&os.O_TRUNC != 0 && writable(flag) {
+		node.mu.Lock()
+		node.data = node.data[:0]
+		node.mu.Unlock()
+	}
+	return &memFile{name: name, node: node, flag: flag}, nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.isDir(filepath.Dir(newpath)) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if node, ok := m.files[oldpath]; ok {
+		if m.isDir(newpath) {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errIsDir}
+		}
+		delete(m.files, oldpath)
+		m.files[newpath] = node
+		return nil
+	}
+	if !m.isDir(oldpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	// move the directory along with everything in it
+	for name, node := range m.files {
+		if rel, ok := relPath(oldpath, name); ok {
+			delete(m.files, name)
+			m.files[filepath.Join(newpath, rel)] = node
+		}
+	}
+	for dir, modTime := range m.dirs {
+		if rel, ok := relPath(oldpath, dir); ok {
+			delete(m.dirs, dir)
+			m.dirs[filepath.Join(newpath, rel)] = modTime
+		}
+	}
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.isDir(name) {
+		return &os.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if len(m.children(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *memFS) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name := range m.files {
+		if _, ok := relPath(path, name); ok || name == path {
+			delete(m.files, name)
+		}
+	}
+	for dir := range m.dirs {
+		if _, ok := relPath(path, dir); ok || dir == path {
+			delete(m.dirs, dir)
+		}
+	}
+	return nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for dir := path; !m.isDir(dir); dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errNotDir}
+		}
+		m.dirs[dir] = time.Now()
+	}
+	return nil
+}
+
+func (m *memFS) ReadDir(name string) ([]os.DirEntry, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.isDir(name) {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	children := m.children(name)
+	entries := make([]os.DirEntry, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(m.stat(child)))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if info := m.stat(name); info != nil {
+		return info, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *memFS) Lock(name string) (io.Closer, error) {
+	f, err := m.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_ = f.Close()
+
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locks[name] {
+		return nil, ErrLocked
+	}
+	m.locks[name] = true
+	return &memLock{fs: m, name: name}, nil
+}
+
+func (m *memFS) SyncDir(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isDir(name) {
+		return &os.PathError{Op: "sync", Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+// isDir reports whether the path is a directory, the root and
+// the current directory always exist. The caller must hold m.mu.
+func (m *memFS) isDir(path string) bool {
+	if path == "." || filepath.Dir(path) == path {
+		return true
+	}
+	_, ok := m.dirs[path]
+	return ok
+}
+
+// children returns the paths of the files and directories directly
+// in the given directory. The caller must hold m.mu.
+func (m *memFS) children(dir string) []string {
+	var paths []string
+	for name := range m.files {
+		if filepath.Dir(name) == dir {
+			paths = append(paths, name)
+		}
+	}
+	for d := range m.dirs {
+		if d != dir && filepath.Dir(d) == dir {
+			paths = append(paths, d)
+		}
+	}
+	return paths
+}
+
+// stat returns the info of the path, or nil if not exists.
+// The caller must hold m.mu.
+func (m *memFS) stat(path string) os.FileInfo {
+	if node, ok := m.files[path]; ok {
+		node.mu.RLock()
+		defer node.mu.RUnlock()
+		return &memFileInfo{
+			name:    filepath.Base(path),
+			size:    int64(len(node.data)),
+			modTime: node.modTime,
+		}
+	}
+	if m.isDir(path) {
+		return &memFileInfo{
+			name:    filepath.Base(path),
+			modTime: m.dirs[path],
+			dir:     true,
+		}
+	}
+	return nil
+}
+
+// relPath returns the path relative to the dir if it's in the dir.
+func relPath(dir, path string) (string, bool) {
+	prefix := dir + string(filepath.Separator)
+	if dir == string(filepath.Separator) {
+		prefix = dir
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	return path[len(prefix):], true
+}
+
+func writable(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	n, err := f.readAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	closed := f.closed
+	f.mu.Unlock()
+	if closed {
+		return 0, os.ErrClosed
+	}
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !writable(f.flag) {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.node.data))
+	}
+	end := f.pos + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		f.node.grow(end)
+	}
+	copy(f.node.data[f.pos:], p)
+	f.pos = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.node.mu.RLock()
+		offset += int64(len(f.node.data))
+		f.node.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+	return &memFileInfo{
+		name:    filepath.Base(f.name),
+		size:    int64(len(f.node.data)),
+		modTime: f.node.modTime,
+	}, nil
+}
+
+func (f *memFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if size > int64(len(f.node.data)) {
+		f.node.grow(size)
+	} else {
+		f.node.data = f.node.data[:size]
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+// grow extends the data to the given size with zeros.
+// The caller must hold n.mu.
+func (n *memNode) grow(size int64) {
+	if size <= int64(cap(n.data)) {
+		old := len(n.data)
+		n.data = n.data[:size]
+		for i := old; i < len(n.data); i++ {
+			n.data[i] = 0
+		}
+		return
+	}
+	data := make([]byte, size, size*2)
+	copy(data, n.data)
+	n.data = data
+}
+
+type memLock struct {
+	fs   *memFS
+	name string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		delete(l.fs.locks, l.name)
+		l.fs.mu.Unlock()
+	})
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.dir }
+func (i *memFileInfo) Sys() interface{}   { return nil }
+
+func (i *memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+var (
+	errIsDir    = errors.New("is a directory")
+	errNotDir   = errors.New("not a directory")
+	errNotEmpty = errors.New("directory not empty")
+)
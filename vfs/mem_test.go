@@ -0,0 +1,119 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFS_File(t *testing.T) {
+	fs := NewMem()
+	_, err := fs.OpenFile("/a/b", os.O_CREATE|os.O_RDWR, 0644)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, fs.MkdirAll("/a", os.ModePerm))
+
+	f, err := fs.OpenFile("/a/b", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("hello"))
+	assert.Nil(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte(" world"))
+	assert.Nil(t, err)
+
+	buf := make([]byte, 5)
+	n, err := f.ReadAt(buf, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(buf[:n]))
+	n, err = f.ReadAt(buf, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "rld", string(buf[:n]))
+
+	assert.Nil(t, f.Truncate(2))
+	assert.Nil(t, f.Truncate(4))
+	info, err := f.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), info.Size())
+	n, _ = f.ReadAt(buf, 0)
+	assert.Equal(t, []byte{'h', 'e', 0, 0}, buf[:n])
+	assert.Nil(t, f.Close())
+	_, err = f.Write([]byte("x"))
+	assert.Equal(t, os.ErrClosed, err)
+
+	// read only
+	f, err = Open(fs, "/a/b")
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("x"))
+	assert.NotNil(t, err)
+	data, err := io.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(data))
+
+	// an open file is still readable after removed
+	assert.Nil(t, fs.Remove("/a/b"))
+	_, err = fs.Stat("/a/b")
+	assert.True(t, os.IsNotExist(err))
+	n, _ = f.ReadAt(buf, 0)
+	assert.Equal(t, 4, n)
+}
+
+func TestMemFS_Mmap(t *testing.T) {
+	fs := NewMem()
+	f, err := fs.OpenFile("/a", os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("hello"))
+	assert.Nil(t, err)
+
+	// the files are read by ReadAt, there is nothing to map.
+	_, _, err = Mmap(f, 5)
+	assert.Equal(t, ErrMmapUnsupported, err)
+}
+
+func TestMemFS_Dir(t *testing.T) {
+	fs := NewMem()
+	assert.Nil(t, fs.MkdirAll("/a/b/c", os.ModePerm))
+	for _, name := range []string{"/a/2", "/a/1", "/a/b/3"} {
+		f, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, _ = f.Write([]byte(name))
+		_ = f.Close()
+	}
+
+	entries, err := fs.ReadDir("/a")
+	assert.Nil(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"1", "2", "b"}, names)
+	assert.True(t, entries[2].IsDir())
+
+	assert.NotNil(t, fs.Remove("/a/b"))
+	assert.Nil(t, fs.Rename("/a/1", "/a/b/1"))
+	assert.Nil(t, fs.Rename("/a/b", "/d"))
+	info, err := fs.Stat("/d/1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), info.Size())
+	_, err = fs.Stat("/d/c")
+	assert.Nil(t, err)
+
+	assert.Nil(t, fs.RemoveAll("/d"))
+	_, err = fs.Stat("/d/b/3")
+	assert.True(t, os.IsNotExist(err))
+	assert.NotNil(t, fs.SyncDir("/d"))
+	assert.Nil(t, fs.SyncDir("/a"))
+}
+
+func TestMemFS_Lock(t *testing.T) {
+	fs := NewMem()
+	lock, err := fs.Lock("/LOCK")
+	assert.Nil(t, err)
+	_, err = fs.Lock("/LOCK")
+	assert.Equal(t, ErrLocked, err)
+	assert.Nil(t, lock.Close())
+	lock, err = fs.Lock("/LOCK")
+	assert.Nil(t, err)
+	assert.Nil(t, lock.Close())
+}
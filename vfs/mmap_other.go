@@ -0,0 +1,10 @@
+//go:build !unix
+
+package vfs
+
+import "os"
+
+// mmap is not supported on the platforms other than unix.
+func mmap(f *os.File, size int64) ([]byte, func() error, error) {
+	return nil, nil, ErrMmapUnsupported
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap maps the first size bytes of the file read-only.
+func mmap(f *os.File, size int64) ([]byte, func() error, error) {
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error {
+		return syscall.Munmap(data)
+	}, nil
+}
@@ -0,0 +1,92 @@
+package vfs
+
+import (
+	"io"
+	"os"
+
+	"github.com/gofrs/flock"
+)
+
+// OS is the file system of the operating system.
+var OS FS = osFS{}
+
+type osFS struct{}
+
+type osFile struct {
+	*os.File
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	fileLock := flock.New(name)
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, ErrLocked
+	}
+	return osLock{fileLock}, nil
+}
+
+func (osFS) SyncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	return dir.Sync()
+}
+
+func (f osFile) Datasync() error {
+	return datasync(f.File)
+}
+
+func (f osFile) Preallocate(size int64) error {
+	return preallocate(f.File, size)
+}
+
+func (f osFile) Mmap(size int64) ([]byte, func() error, error) {
+	return mmap(f.File, size)
+}
+
+type osLock struct {
+	*flock.Flock
+}
+
+func (l osLock) Close() error {
+	return l.Unlock()
+}
@@ -0,0 +1,12 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// datasync flushes the data of the file and only the metadata
+// needed to read it back, i.e. the file size, skipping timestamps.
+func datasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
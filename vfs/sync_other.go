@@ -0,0 +1,10 @@
+//go:build !linux
+
+package vfs
+
+import "os"
+
+// datasync falls back to fsync on the platforms without fdatasync.
+func datasync(f *os.File) error {
+	return f.Sync()
+}
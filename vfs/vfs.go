@@ -0,0 +1,104 @@
+// Package vfs is the file system used by the database and the WAL,
+// so that the files can be kept in memory, or faults can be injected.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	// ErrLocked is returned by FS.Lock if the lock is held by others.
+	ErrLocked = errors.New("the lock file is held by another process")
+
+	// ErrMmapUnsupported is returned by Mmap if the file can't be mapped.
+	ErrMmapUnsupported = errors.New("the file doesn't support mmap")
+)
+
+// File is an open file of a FS.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS is the file system interface, the semantics of the methods
+// follow the functions of the same names in the os package.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	MkdirAll(path string, perm os.FileMode) error
+	ReadDir(name string) ([]os.DirEntry, error)
+	Stat(name string) (os.FileInfo, error)
+
+	// Lock acquires the exclusive lock of the given file, which is
+	// created if not exists, it returns ErrLocked if the lock is held.
+	// Closing the returned io.Closer releases the lock.
+	Lock(name string) (io.Closer, error)
+
+	// SyncDir syncs the directory, making the entries of the newly
+	// created, renamed or removed files durable.
+	SyncDir(name string) error
+}
+
+// Default is the file system of the operating system.
+var Default FS = OS
+
+// Open opens the named file for reading.
+func Open(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Datasync flushes the data of the file and only the metadata needed
+// to read it back, i.e. the file size, skipping timestamps. It falls
+// back to Sync if the file doesn't support it.
+func Datasync(f File) error {
+	if d, ok := f.(interface{ Datasync() error }); ok {
+		return d.Datasync()
+	}
+	return f.Sync()
+}
+
+// Preallocate allocates the disk space of the file up to the size,
+// the file is extended with zeros if it's smaller, so that the later
+// writes within the size won't change the file size. It falls back to
+// extending the file by Truncate if the file doesn't support it.
+func Preallocate(f File, size int64) error {
+	if p, ok := f.(interface{ Preallocate(size int64) error }); ok {
+		return p.Preallocate(size)
+	}
+	return extend(f, size)
+}
+
+// extend extends the file to the size with zeros, it never shrinks the file.
+func extend(f File, size int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= size {
+		return nil
+	}
+	return f.Truncate(size)
+}
+
+// Mmap maps the first size bytes of the file into memory read-only,
+// the returned function unmaps it, after which the data must not be
+// accessed. It returns ErrMmapUnsupported if the file doesn't support it.
+func Mmap(f File, size int64) ([]byte, func() error, error) {
+	if m, ok := f.(interface {
+		Mmap(size int64) ([]byte, func() error, error)
+	}); ok {
+		return m.Mmap(size)
+	}
+	return nil, nil, ErrMmapUnsupported
+}
@@ -0,0 +1,72 @@
+package wal
+
+import (
+	"container/list"
+	"sync"
+)
+
+// fdCache bounds the number of the open files of the sealed segments,
+// see Options.MaxOpenSegments. The files of the least recently read
+// segments are closed, and they are reopened when read again.
+//
+// The lock order is c.mu, then segment.fdMu. The cache is never
+// called with segment.fdMu held.
+type fdCache struct {
+	mu       sync.Mutex
+	capacity int
+	lru      *list.List // the segments with an open file, the front is the most recently read.
+}
+
+func newFDCache(capacity int) *fdCache {
+	return &fdCache{
+		capacity: capacity,
+		lru:      list.New(),
+	}
+}
+
+// manage makes the file of the sealed segment closable by the cache,
+// it's regarded as the most recently read.
+func (c *fdCache) manage(s *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.managed = true
+	c.touchLocked(s)
+}
+
+// unmanage stops closing the file of the segment, i.e. it becomes the
+// active segment again, or it's closed.
+func (c *fdCache) unmanage(s *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.managed = false
+	if s.elem != nil {
+		c.lru.Remove(s.elem)
+		s.elem = nil
+	}
+}
+
+// touch marks the segment as the most recently read, it's a no-op if
+// the segment is not managed by the cache.
+func (c *fdCache) touch(s *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.managed {
+		c.touchLocked(s)
+	}
+}
+
+// touchLocked moves the segment to the front, and closes the files of
+// the least recently read segments beyond the capacity.
+// The caller must hold c.mu.
+func (c *fdCache) touchLocked(s *segment) {
+	if s.elem != nil {
+		c.lru.MoveToFront(s.elem)
+	} else {
+		s.elem = c.lru.PushFront(s)
+	}
+	for c.lru.Len() > c.capacity {
+		victim := c.lru.Remove(c.lru.Back()).(*segment)
+		victim.elem = nil
+		victim.closeIdleFile()
+	}
+}
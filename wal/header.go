@@ -0,0 +1,364 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/berylyvos/yojoudb/vfs"
+)
+
+const (
+	// SegmentHeaderSize is the size of the header at the beginning of
+	// every segment file, the chunks are written after it.
+	SegmentHeaderSize = 32
+
+	// SegmentVersion is the current version of the segment file format.
+	SegmentVersion uint16 = 1
+
+	// segmentMagic identifies a segment file.
+	segmentMagic uint32 = 0x4f4a4f59 // "YOJO"
+
+	// FlagPreallocated marks the segment file preallocated, of which the
+	// file size is not the end of the data, see Options.Preallocate.
+	FlagPreallocated uint16 = 1 << 0
+
+	// FlagUpgraded marks the segment file written by an old version
+	// without the header, which is added by Upgrade.
+	FlagUpgraded uint16 = 1 << 1
+
+	// supportedFlags is the flags understood by this version.
+	supportedFlags = FlagPreallocated | FlagUpgraded
+
+	// segmentFooterSize is the size of the footer appended to a sealed
+	// preallocated segment file, which records the end of the data.
+	segmentFooterSize = 16
+
+	// footerMagic identifies a segment footer.
+	footerMagic uint32 = 0x464a4f59 // "YOJF"
+)
+
+var (
+	ErrNoSegmentHeader      = errors.New("the segment file has no header, it may be written by an old version, call Upgrade first")
+	ErrInvalidSegmentHeader = errors.New("invalid segment file header, the file may be corrupted")
+	ErrUnsupportedVersion   = errors.New("unsupported segment file version or codec flags")
+)
+
+// SegmentHeader is the metadata of a segment file.
+//
+//	+---------+-----------+---------+----------+--------------+------------+-------+
+//	|  magic  |  version  |  flags  |  seg_id  |  created_at  |  reserved  |  crc  |
+//	+--- 4 ---+---- 2 ----+--- 2 ---+--- 4 ----+----- 8 ------+---- 8 -----+-- 4 --+
+type SegmentHeader struct {
+	Version   uint16
+	Flags     uint16 // flags of the segment file, e.g. FlagPreallocated.
+	SegId     SegmentID
+	CreatedAt time.Time
+}
+
+func newSegmentHeader(id SegmentID, createdAt time.Time) *SegmentHeader {
+	return &SegmentHeader{
+		Version:   SegmentVersion,
+		Flags:     0,
+		SegId:     id,
+		CreatedAt: createdAt,
+	}
+}
+
+func (h *SegmentHeader) encode() []byte {
+	b := make([]byte, SegmentHeaderSize)
+	binary.LittleEndian.PutUint32(b[0:4], segmentMagic)
+	binary.LittleEndian.PutUint16(b[4:6], h.Version)
+	binary.LittleEndian.PutUint16(b[6:8], h.Flags)
+	binary.LittleEndian.PutUint32(b[8:12], h.SegId)
+	binary.LittleEndian.PutUint64(b[12:20], uint64(h.CreatedAt.UnixNano()))
+	binary.LittleEndian.PutUint32(b[28:32], crc32.ChecksumIEEE(b[:28]))
+	return b
+}
+
+// decodeSegmentHeader decodes and validates the header of a segment file.
+func decodeSegmentHeader(b []byte) (*SegmentHeader, error) {
+	if len(b) < SegmentHeaderSize || binary.LittleEndian.Uint32(b[0:4]) != segmentMagic {
+		return nil, ErrNoSegmentHeader
+	}
+	if crc32.ChecksumIEEE(b[:28]) != binary.LittleEndian.Uint32(b[28:32]) {
+		return nil, ErrInvalidSegmentHeader
+	}
+	h := &SegmentHeader{
+		Version:   binary.LittleEndian.Uint16(b[4:6]),
+		Flags:     binary.LittleEndian.Uint16(b[6:8]),
+		SegId:     binary.LittleEndian.Uint32(b[8:12]),
+		CreatedAt: time.Unix(0, int64(binary.LittleEndian.Uint64(b[12:20]))),
+	}
+	if h.Version != SegmentVersion || h.Flags&^supportedFlags != 0 {
+		return nil, fmt.Errorf("%w: version %d, flags %#x", ErrUnsupportedVersion, h.Version, h.Flags)
+	}
+	return h, nil
+}
+
+// readSegmentHeader reads the header of the segment file, and checks
+// that it belongs to the segment of the given id.
+func readSegmentHeader(fd vfs.File, id SegmentID) (*SegmentHeader, error) {
+	b := make([]byte, SegmentHeaderSize)
+	if _, err := fd.ReadAt(b, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	h, err := decodeSegmentHeader(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, fd.Name())
+	}
+	if h.SegId != id {
+		return nil, fmt.Errorf("%w: %s has segment id %d", ErrInvalidSegmentHeader, fd.Name(), h.SegId)
+	}
+	return h, nil
+}
+
+// isTornHeader reports whether the file of the given size, which is
+// smaller than the header, is a partially written header, rather than
+// a legacy segment file without the header.
+func isTornHeader(fd vfs.File, size int64) bool {
+	b := make([]byte, size)
+	if _, err := fd.ReadAt(b, 0); err != nil && err != io.EOF {
+		return false
+	}
+	magic := make([]byte, 4)
+	binary.LittleEndian.PutUint32(magic, segmentMagic)
+	n := len(b)
+	if n > len(magic) {
+		n = len(magic)
+	}
+	return bytes.Equal(b[:n], magic[:n])
+}
+
+// encodeSegmentFooter encodes the footer of a sealed preallocated
+// segment file, the size is the size of the data before the footer.
+//
+//	+---------+--------+-------+
+//	|  magic  |  size  |  crc  |
+//	+--- 4 ---+-- 8 ---+-- 4 --+
+func encodeSegmentFooter(size int64) []byte {
+	b := make([]byte, segmentFooterSize)
+	binary.LittleEndian.PutUint32(b[0:4], footerMagic)
+	binary.LittleEndian.PutUint64(b[4:12], uint64(size))
+	binary.LittleEndian.PutUint32(b[12:16], crc32.ChecksumIEEE(b[:12]))
+	return b
+}
+
+// readSegmentFooter reads the footer at the end of the data of the
+// given size, and reports whether it's a valid footer, returns the
+// size of the data before it.
+func readSegmentFooter(fd vfs.File, dataSize int64) (int64, bool) {
+	if dataSize < segmentFooterSize {
+		return 0, false
+	}
+	b := make([]byte, segmentFooterSize)
+	if _, err := fd.ReadAt(b, SegmentHeaderSize+dataSize-segmentFooterSize); err != nil {
+		return 0, false
+	}
+	size := int64(binary.LittleEndian.Uint64(b[4:12]))
+	if binary.LittleEndian.Uint32(b[0:4]) != footerMagic ||
+		crc32.ChecksumIEEE(b[:12]) != binary.LittleEndian.Uint32(b[12:16]) ||
+		size != dataSize-segmentFooterSize {
+		return 0, false
+	}
+	return size, true
+}
+
+// ReadSegmentHeader reads the header of the given segment file.
+func ReadSegmentHeader(fs vfs.FS, path string) (*SegmentHeader, error) {
+	fd, err := vfs.Open(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+	b := make([]byte, SegmentHeaderSize)
+	if _, err := fd.ReadAt(b, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	h, err := decodeSegmentHeader(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, path)
+	}
+	return h, nil
+}
+
+// SegmentDataSize returns the size of the data in the given segment file,
+// excluding the header. The file size of a preallocated segment is not
+// the end of the data, which is found by the footer, or by scanning the
+// chunks if the segment is not sealed.
+func SegmentDataSize(fs vfs.FS, path string) (int64, error) {
+	fd, err := vfs.Open(fs, path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+	stat, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := stat.Size() - SegmentHeaderSize
+	if size <= 0 {
+		return 0, nil
+	}
+
+	b := make([]byte, SegmentHeaderSize)
+	if _, err := fd.ReadAt(b, 0); err != nil {
+		return 0, err
+	}
+	h, err := decodeSegmentHeader(b)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", err, path)
+	}
+	if h.Flags&FlagPreallocated == 0 {
+		return size, nil
+	}
+	if end, ok := readSegmentFooter(fd, size); ok {
+		return end, nil
+	}
+	return scanSegmentEnd(fd, size)
+}
+
+// Upgrade upgrades the segment files with the given extension in the
+// directory, which are written by an old version without the header.
+// Every such file is rewritten with a header into a temporary file,
+// which then replaces the old one, so it's safe to run it again after
+// a crash. The files with a valid header are left untouched.
+//
+// The upgraded files are marked by FlagUpgraded, and a new empty segment
+// is created after them if the last one is upgraded, so the chunks written
+// later never share a segment with the chunks written by the old version.
+// The WAL must not be opened while upgrading.
+func Upgrade(fs vfs.FS, dirPath, extName string) error {
+	entries, err := fs.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	var upgraded bool
+	var lastId SegmentID
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var id SegmentID
+		if _, err := fmt.Sscanf(entry.Name(), "%d"+extName, &id); err != nil {
+			continue
+		}
+		ok, err := upgradeSegmentFile(fs, filepath.Join(dirPath, entry.Name()), id)
+		if err != nil {
+			return err
+		}
+		upgraded = upgraded || ok
+		if id > lastId {
+			lastId = id
+		}
+	}
+
+	// the last segment may be upgraded in a run interrupted by a crash
+	// before the new one is created, so it's checked even if nothing is
+	// upgraded this time.
+	if lastId > 0 {
+		// an empty file gets its header when it's opened.
+		h, err := ReadSegmentHeader(fs, SegmentFileName(dirPath, extName, lastId))
+		if err != nil && !errors.Is(err, ErrNoSegmentHeader) {
+			return err
+		}
+		if err == nil && h.Flags&FlagUpgraded != 0 {
+			if err = createSegmentFile(fs, dirPath, extName, lastId+1); err != nil {
+				return err
+			}
+			upgraded = true
+		}
+	}
+	if upgraded {
+		return fs.SyncDir(dirPath)
+	}
+	return nil
+}
+
+// createSegmentFile creates an empty segment file with the header, which
+// is written into a temporary file first, so the file is never torn.
+func createSegmentFile(fs vfs.FS, dirPath, extName string, id SegmentID) error {
+	path := SegmentFileName(dirPath, extName, id)
+	tmpPath := path + ".upgrade"
+	fd, err := fs.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fileModePerm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = fd.Close()
+		_ = fs.Remove(tmpPath)
+	}()
+	if _, err = fd.Write(newSegmentHeader(id, time.Now()).encode()); err != nil {
+		return err
+	}
+	if err = fd.Sync(); err != nil {
+		return err
+	}
+	return fs.Rename(tmpPath, path)
+}
+
+// upgradeSegmentFile adds the header to a legacy segment file.
+// Returns whether the file is rewritten.
+func upgradeSegmentFile(fs vfs.FS, path string, id SegmentID) (bool, error) {
+	src, err := vfs.Open(fs, path)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+
+	stat, err := src.Stat()
+	if err != nil {
+		return false, err
+	}
+	// an empty file gets its header when it's opened
+	if stat.Size() == 0 {
+		return false, nil
+	}
+	b := make([]byte, SegmentHeaderSize)
+	if _, err := src.ReadAt(b, 0); err != nil && err != io.EOF {
+		return false, err
+	}
+	if _, err := decodeSegmentHeader(b); !errors.Is(err, ErrNoSegmentHeader) {
+		if err != nil {
+			return false, fmt.Errorf("%w: %s", err, path)
+		}
+		return false, nil
+	}
+
+	tmpPath := path + ".upgrade"
+	dst, err := fs.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fileModePerm)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = dst.Close()
+		_ = fs.Remove(tmpPath)
+	}()
+	header := newSegmentHeader(id, stat.ModTime())
+	header.Flags |= FlagUpgraded
+	if _, err := dst.Write(header.encode()); err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		return false, err
+	}
+	if err := dst.Sync(); err != nil {
+		return false, err
+	}
+	if err := fs.Rename(tmpPath, path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -1,6 +1,11 @@
 package wal
 
-import "os"
+import (
+	"os"
+	"time"
+
+	"github.com/berylyvos/yojoudb/vfs"
+)
 
 // Options represents the configuration options for a Write-Ahead Log (WAL).
 type Options struct {
@@ -35,6 +40,78 @@ type Options struct {
 
 	// BytesPerSync specifies the number of bytes to write before calling fsync.
 	BytesPerSync uint32
+
+	// SyncPolicy specifies when the active segment file is synced.
+	// If it's SyncNever, the policy is decided by the Sync and BytesPerSync
+	// options for compatibility, i.e. SyncEveryWrite if Sync is true.
+	SyncPolicy SyncPolicy
+
+	// SyncInterval specifies the interval of the background sync
+	// when SyncPolicy is SyncInterval.
+	SyncInterval time.Duration
+
+	// FS is the file system of the segment files, nil means vfs.Default.
+	FS vfs.FS
+
+	// BeforeSync is called before the active segment file is synced, both
+	// by the sync policy and by WAL.Sync, i.e. to sync the files that the
+	// data refers to first. The sync fails with its error. It must not
+	// call back into the WAL. Could be nil.
+	BeforeSync func() error
+
+	// Preallocate specifies whether to allocate the disk space of a new
+	// segment file up front, i.e. fallocate on Linux, so that the writes
+	// don't update the file size, and the sync doesn't have to flush
+	// the metadata of the file every time. The end of the data is
+	// then recorded by a footer when the segment file is full.
+	Preallocate bool
+
+	// MmapReads specifies whether to map the sealed segment files into
+	// memory read-only, so that the reads of them are served by slicing
+	// the mapping instead of a read system call. See also WAL.ReadView.
+	MmapReads bool
+
+	// MaxOpenSegments specifies the maximum number of the open segment
+	// files, including the active one. Beyond it, the files of the least
+	// recently read sealed segments are closed, and they are reopened
+	// when read again. The limit is per WAL, it's not shared with the
+	// other WALs in the same process. 0 means no limit.
+	MaxOpenSegments int
+}
+
+// SyncPolicy specifies when the writes are synced to stable storage.
+type SyncPolicy = uint8
+
+const (
+	// SyncNever leaves the writes in the os buffer cache, they are
+	// flushed by the operating system or when a segment file is full.
+	SyncNever SyncPolicy = iota
+
+	// SyncEveryWrite syncs after every write (or batch of writes).
+	SyncEveryWrite
+
+	// SyncEveryN syncs after every BytesPerSync bytes are written.
+	SyncEveryN
+
+	// SyncInterval syncs in a background goroutine every SyncInterval.
+	SyncInterval
+)
+
+// preallocSize returns the size of the data to preallocate
+// for a new segment file, or 0 if it's not preallocated.
+func (opt *Options) preallocSize() int64 {
+	if opt.Preallocate {
+		return opt.SegmentSize
+	}
+	return 0
+}
+
+// fs returns the file system of the options.
+func (opt *Options) fs() vfs.FS {
+	if opt.FS != nil {
+		return opt.FS
+	}
+	return vfs.Default
 }
 
 const (
@@ -1,15 +1,20 @@
 package wal
 
 import (
+	"container/list"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/berylyvos/yojoudb/vfs"
 	"github.com/valyala/bytebufferpool"
 )
 
@@ -38,6 +43,8 @@ const (
 var (
 	ErrClosed     = errors.New("the segment file is closed")
 	ErrInvalidCRC = errors.New("invalid crc, the data may be corrupted")
+
+	ErrInvalidChunkLoc = errors.New("the location is not the start of a chunk")
 )
 
 // segment represents a single segment file in WAL.
@@ -45,12 +52,44 @@ var (
 // Each block is 32KB, and the data is written in chunks.
 type segment struct {
 	id            SegmentID
-	fd            *os.File
+	fs            vfs.FS
+	path          string
 	curBlockIndex uint32
 	curBlockSize  uint32
 	closed        bool
+	synced        atomic.Bool // whether the directory entry is synced.
+	meta          *SegmentHeader
 	header        []byte
 	blockPool     sync.Pool
+	prealloc      int64 // the size of the data preallocated, or 0.
+
+	// the readers holding the segment, if it's removed from the WAL,
+	// the file is deleted after all of them release it.
+	refMu    sync.Mutex
+	refs     int
+	obsolete bool
+	unlinked bool // the file is deleted before it's released, see unlink.
+
+	// the mapping of the sealed segment file, see Options.MmapReads.
+	// The dropped mappings are unmapped after all readers release it.
+	mapped atomic.Pointer[mapping]
+	stale  []*mapping
+
+	// the file of a sealed segment may be closed by the cache, and it's
+	// reopened when read again, see Options.MaxOpenSegments. The reads
+	// hold fdMu to keep the file open. The elem and managed are guarded
+	// by cache.mu.
+	fdMu    sync.RWMutex
+	fd      vfs.File // nil if it's closed by the cache.
+	cache   *fdCache // nil if the open files are not bounded.
+	elem    *list.Element
+	managed bool
+}
+
+// mapping is the read-only memory mapping of a segment file.
+type mapping struct {
+	data  []byte
+	unmap func() error
 }
 
 // segmentReader is used to iterate all the data from segment file.
@@ -78,12 +117,13 @@ type ChunkLoc struct {
 }
 
 // openSegmentFile opens a segment file.
-func openSegmentFile(dirPath, extName string, id SegmentID) (*segment, error) {
-	fd, err := os.OpenFile(
-		SegmentFileName(dirPath, extName, id),
-		os.O_CREATE|os.O_RDWR|os.O_APPEND,
-		fileModePerm,
-	)
+// The header is written if the file is newly created, otherwise
+// it's validated, the blocks are located right after the header.
+// If prealloc is positive, the newly created file is preallocated
+// to hold the data of that size, see Options.Preallocate.
+func openSegmentFile(fs vfs.FS, dirPath, extName string, id SegmentID, prealloc int64) (*segment, error) {
+	path := SegmentFileName(dirPath, extName, id)
+	fd, err := fs.OpenFile(path, os.O_CREATE|os.O_RDWR, fileModePerm)
 	if err != nil {
 		return nil, err
 	}
@@ -93,16 +133,178 @@ func openSegmentFile(dirPath, extName string, id SegmentID) (*segment, error) {
 		panic(fmt.Errorf("seek to the end of segment file %d%s failed: %v", id, extName, err))
 	}
 
+	// the header is torn by a crash right after the file is created.
+	if offset > 0 && offset < SegmentHeaderSize && isTornHeader(fd, offset) {
+		if err = fd.Truncate(0); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+		if offset, err = fd.Seek(0, io.SeekStart); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+	}
+
+	var meta *SegmentHeader
+	if offset == 0 {
+		meta = newSegmentHeader(id, time.Now())
+		if prealloc > 0 {
+			meta.Flags |= FlagPreallocated
+		}
+		if _, err = fd.Write(meta.encode()); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+		if prealloc > 0 {
+			if err = vfs.Preallocate(fd, SegmentHeaderSize+prealloc); err != nil {
+				_ = fd.Close()
+				return nil, err
+			}
+		}
+	} else {
+		if meta, err = readSegmentHeader(fd, id); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+		offset -= SegmentHeaderSize
+		// the file size of a preallocated segment is not the end of the
+		// data, which is found by the footer if it's sealed, otherwise
+		// by scanning the chunks.
+		if meta.Flags&FlagPreallocated != 0 {
+			if size, ok := readSegmentFooter(fd, offset); ok {
+				offset = size
+			} else if offset, err = scanSegmentEnd(fd, offset); err != nil {
+				_ = fd.Close()
+				return nil, err
+			}
+		} else {
+			prealloc = 0
+		}
+	}
+
+	// the chunks are written at the end of the data.
+	if _, err = fd.Seek(SegmentHeaderSize+offset, io.SeekStart); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+
 	return &segment{
 		id:            id,
+		fs:            fs,
+		path:          path,
 		fd:            fd,
 		curBlockIndex: uint32(offset / blockSize),
 		curBlockSize:  uint32(offset % blockSize),
+		meta:          meta,
 		header:        make([]byte, chunkHeaderSize),
 		blockPool:     sync.Pool{New: newBlockAndHeader},
+		prealloc:      prealloc,
 	}, nil
 }
 
+// scanSegmentEnd returns the end of the data in a preallocated segment
+// file, which is the end of the last valid chunk, the rest of the file
+// is either zeros or torn by a crash. It returns ErrInvalidCRC if the
+// invalid chunk is followed by more data, see tornAt.
+func scanSegmentEnd(fd vfs.File, dataSize int64) (int64, error) {
+	var (
+		end   int64
+		block = make([]byte, blockSize)
+	)
+	for blockStart := int64(0); blockStart < dataSize; blockStart += blockSize {
+		n := dataSize - blockStart
+		if n > blockSize {
+			n = blockSize
+		}
+		if _, err := fd.ReadAt(block[:n], SegmentHeaderSize+blockStart); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for off := int64(0); off+chunkHeaderSize < blockSize; {
+			if off+chunkHeaderSize > n {
+				return end, nil
+			}
+			length := int64(binary.LittleEndian.Uint16(block[off+4 : off+6]))
+			chunkEnd := off + chunkHeaderSize + length
+			if chunkEnd > n || block[off+6] > ChunkTypeLast ||
+				crc32.ChecksumIEEE(block[off+4:chunkEnd]) != binary.LittleEndian.Uint32(block[off:off+4]) {
+				torn, err := tornAt(fd.ReadAt, blockStart+off, dataSize)
+				if err != nil {
+					return 0, err
+				}
+				if !torn {
+					return 0, ErrInvalidCRC
+				}
+				return end, nil
+			}
+			end = blockStart + chunkEnd
+			off = chunkEnd
+		}
+	}
+	return end, nil
+}
+
+// tornAt reports whether the invalid chunk at the offset of the data is
+// torn by a crash, that is nothing has been written after it. A torn
+// write only keeps a prefix of the data, so the rest of the block after
+// the chunk, as long as its header says, is zeros or beyond the end of
+// the data, and so is the header of the first chunk in the next block,
+// which must be there if the data goes on. Otherwise the chunk is
+// corrupted in the middle of the data.
+func tornAt(readAt func(b []byte, off int64) (int, error), offset, dataSize int64) (bool, error) {
+	blockEnd := (offset/blockSize + 1) * blockSize
+	end := blockEnd
+	header := make([]byte, chunkHeaderSize)
+	if offset+chunkHeaderSize <= dataSize {
+		if _, err := readAt(header, SegmentHeaderSize+offset); err != nil {
+			return false, err
+		}
+		length := int64(binary.LittleEndian.Uint16(header[4:6]))
+		if chunkEnd := offset + chunkHeaderSize + length; chunkEnd < end {
+			end = chunkEnd
+		}
+	}
+	if limit := blockEnd + chunkHeaderSize; dataSize > limit {
+		dataSize = limit
+	}
+	if end >= dataSize {
+		return true, nil
+	}
+	rest := make([]byte, dataSize-end)
+	if _, err := readAt(rest, SegmentHeaderSize+end); err != nil && err != io.EOF {
+		return false, err
+	}
+	for _, b := range rest {
+		if b != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// tornAt reports whether the data at the position, which fails to be
+// read with io.ErrUnexpectedEOF or ErrInvalidCRC, is torn by a crash.
+// The first invalid chunk of the data is checked, see tornAt.
+func (s *segment) tornAt(blockIndex uint32, chunkOffset int64) (bool, error) {
+	buf := make([]byte, blockSize)
+	for {
+		_, chunkType, err := s.readChunk(blockIndex, chunkOffset, buf)
+		if err == io.ErrUnexpectedEOF || err == ErrInvalidCRC {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		// the data is valid.
+		if chunkType == ChunkTypeFull || chunkType == ChunkTypeLast {
+			return false, nil
+		}
+		// the first and middle chunks fill up their blocks.
+		blockIndex++
+		chunkOffset = 0
+	}
+	return tornAt(s.readAt, int64(blockIndex)*blockSize+chunkOffset, s.Size())
+}
+
 // SegmentFileName returns the file name of a segment file.
 func SegmentFileName(dirPath, extName string, id SegmentID) string {
 	return filepath.Join(dirPath, fmt.Sprintf("%09d"+extName, id))
@@ -123,120 +325,494 @@ func (s *segment) NewReader() *segmentReader {
 	}
 }
 
+// Sync syncs the segment file. The first sync is a full fsync
+// along with the directory, to make sure the newly created file
+// can be found after a crash. Then it only needs fdatasync,
+// since the file only grows by appending.
 func (s *segment) Sync() error {
 	if s.closed {
 		return nil
 	}
+	if s.synced.Load() {
+		return vfs.Datasync(s.fd)
+	}
+	if err := s.fd.Sync(); err != nil {
+		return err
+	}
+	if err := s.fs.SyncDir(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	s.synced.Store(true)
+	return nil
+}
+
+// syncFile syncs the segment file without w.mu held, so it may run along
+// with the writes, or the segment may be sealed meanwhile. The file is
+// kept open while it's synced. If it's closed by the cache, the sealed
+// segment has been synced before.
+func (s *segment) syncFile() error {
+	s.fdMu.RLock()
+	defer s.fdMu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.fd == nil {
+		return nil
+	}
+	return s.Sync()
+}
+
+// seal discards the preallocated space after the data, and appends
+// a footer recording the end of the data, so that it needn't be
+// found by scanning when the file is opened again. The segment
+// won't be written anymore, unless it's truncated.
+func (s *segment) seal() error {
+	if s.closed || s.meta.Flags&FlagPreallocated == 0 {
+		return nil
+	}
+	// the file is truncated before the footer is written, it's
+	// fine if a crash happens in between.
+	size := s.Size()
+	if err := s.fd.Truncate(SegmentHeaderSize + size); err != nil {
+		return err
+	}
+	if _, err := s.fd.Seek(SegmentHeaderSize+size, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := s.fd.Write(encodeSegmentFooter(size)); err != nil {
+		return err
+	}
 	return s.fd.Sync()
 }
 
 func (s *segment) Close() error {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	return s.closeFile()
+}
+
+// closeFile closes the segment file, the mapping of it is unmapped
+// once no reader holds the segment. The caller must hold s.refMu.
+func (s *segment) closeFile() error {
 	if s.closed {
 		return nil
 	}
+	if s.cache != nil {
+		s.cache.unmanage(s)
+	}
+	s.fdMu.Lock()
+	defer s.fdMu.Unlock()
 	s.closed = true
-	return s.fd.Close()
+	s.dropMapping()
+	var err error
+	if s.refs == 0 {
+		err = s.unmapStale()
+	}
+	if s.fd != nil {
+		if e := s.fd.Close(); e != nil && err == nil {
+			err = e
+		}
+		s.fd = nil
+	}
+	return err
 }
 
-func (s *segment) Remove() error {
-	if !s.closed {
-		s.closed = true
+// closeIdleFile closes the file of the sealed segment evicted by the
+// cache, it's reopened when read again. The mapping is kept.
+func (s *segment) closeIdleFile() {
+	s.fdMu.Lock()
+	defer s.fdMu.Unlock()
+	if s.fd != nil {
 		_ = s.fd.Close()
+		s.fd = nil
+	}
+}
+
+// reopen opens the segment file again if it's closed by the cache.
+func (s *segment) reopen() error {
+	s.fdMu.Lock()
+	defer s.fdMu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.fd != nil {
+		return nil
+	}
+	fd, err := s.fs.OpenFile(s.path, os.O_RDWR, fileModePerm)
+	if err != nil {
+		return err
+	}
+	s.fd = fd
+	return nil
+}
+
+// readAt reads the segment file at the offset, the file is reopened
+// if it's closed by the cache.
+func (s *segment) readAt(b []byte, off int64) (int, error) {
+	for {
+		s.fdMu.RLock()
+		if s.fd != nil {
+			break
+		}
+		s.fdMu.RUnlock()
+		if err := s.reopen(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.fd.ReadAt(b, off)
+	s.fdMu.RUnlock()
+	if s.cache != nil {
+		s.cache.touch(s)
+	}
+	return n, err
+}
+
+func (s *segment) Remove() error {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	return s.remove()
+}
+
+// remove closes and deletes the segment file.
+// The caller must hold s.refMu.
+func (s *segment) remove() error {
+	_ = s.closeFile()
+	return s.fs.Remove(s.path)
+}
+
+// acquire holds the segment for a reader, the segment file won't be
+// deleted until it's released.
+func (s *segment) acquire() {
+	s.refMu.Lock()
+	s.refs++
+	s.refMu.Unlock()
+}
+
+// release releases the segment held by a reader, the segment file is
+// deleted if it's obsolete and no one holds it anymore.
+func (s *segment) release() error {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	if s.obsolete {
+		if s.unlinked {
+			return s.closeFile()
+		}
+		return s.removeAndSync()
+	}
+	return s.unmapStale()
+}
+
+// markObsolete marks the segment removed from the WAL, the segment
+// file is deleted right now if no reader holds it.
+func (s *segment) markObsolete() error {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	s.obsolete = true
+	if s.refs == 0 {
+		return s.removeAndSync()
+	}
+	return nil
+}
+
+// unlink marks the segment removed from the WAL, and deletes the file
+// right away even if it's held by the readers, which keep reading the
+// open file until they release it. The caller syncs the directory.
+func (s *segment) unlink() error {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	// the file can't be reopened once it's deleted.
+	if s.refs > 0 {
+		if s.cache != nil {
+			s.cache.unmanage(s)
+		}
+		_ = s.reopen()
+	}
+	// the segment is kept as it is if the file fails to be deleted.
+	if err := s.fs.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.obsolete = true
+	if s.refs > 0 {
+		s.unlinked = true
+		return nil
+	}
+	return s.closeFile()
+}
+
+// removeAndSync deletes the segment file, along with syncing
+// the directory to make the deletion durable.
+// The caller must hold s.refMu.
+func (s *segment) removeAndSync() error {
+	if err := s.remove(); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.fs.SyncDir(filepath.Dir(s.path))
+}
+
+// mapFile maps the sealed segment file into memory to serve the reads,
+// the file is read as usual if the file system doesn't support it.
+func (s *segment) mapFile() error {
+	size := s.Size()
+	if s.closed || size == 0 || s.mapped.Load() != nil {
+		return nil
+	}
+	data, unmap, err := vfs.Mmap(s.fd, SegmentHeaderSize+size)
+	if err == vfs.ErrMmapUnsupported {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.mapped.Store(&mapping{data: data, unmap: unmap})
+	return nil
+}
+
+// unmapFile unmaps the segment file before it's truncated, which would
+// fault the readers of the mapped data beyond the new end. It returns
+// ErrMappedInUse if a reader may still hold the mapped data.
+func (s *segment) unmapFile() error {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	if s.refs > 0 && (s.mapped.Load() != nil || len(s.stale) > 0) {
+		return ErrMappedInUse
+	}
+	s.dropMapping()
+	return s.unmapStale()
+}
+
+// dropMapping stops serving the reads by the mapping.
+// The caller must hold s.refMu.
+func (s *segment) dropMapping() {
+	if m := s.mapped.Swap(nil); m != nil {
+		s.stale = append(s.stale, m)
+	}
+}
+
+// unmapStale unmaps the dropped mappings, which no reader holds.
+// The caller must hold s.refMu.
+func (s *segment) unmapStale() error {
+	var err error
+	for _, m := range s.stale {
+		if e := m.unmap(); e != nil && err == nil {
+			err = e
+		}
 	}
-	return os.Remove(s.fd.Name())
+	s.stale = nil
+	return err
 }
 
+// Size returns the size of the data in the segment file, excluding the header.
 func (s *segment) Size() int64 {
 	return int64(s.curBlockIndex)*blockSize + int64(s.curBlockSize)
 }
 
 func (s *segment) Write(data []byte) (*ChunkLoc, error) {
+	locs, err := s.WriteAll([][]byte{data})
+	if err != nil {
+		return nil, err
+	}
+	return locs[0], nil
+}
+
+// WriteAll writes all the data into the segment file with a single write.
+// Returns the locations of the data in order.
+func (s *segment) WriteAll(data [][]byte) ([]*ChunkLoc, error) {
 	if s.closed {
 		return nil, ErrClosed
 	}
 
+	// init chunk buffer
+	chunkBuf := bytebufferpool.Get()
+	defer func() {
+		chunkBuf.Reset()
+		bytebufferpool.Put(chunkBuf)
+	}()
+
+	var (
+		locs       = make([]*ChunkLoc, len(data))
+		blockIndex = s.curBlockIndex
+		blockOff   = s.curBlockSize
+	)
+	for i := range data {
+		locs[i] = s.appendChunks(chunkBuf, data[i], &blockIndex, &blockOff)
+	}
+
+	if _, err := s.fd.Write(chunkBuf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// update current write offset
+	s.curBlockIndex, s.curBlockSize = blockIndex, blockOff
+	return locs, nil
+}
+
+// appendChunks appends the data as chunks to the buffer, the data will be
+// at the given block position, which is then moved to the end of the chunks.
+func (s *segment) appendChunks(buf *bytebufferpool.ByteBuffer, data []byte,
+	blockIndex, blockOff *uint32) *ChunkLoc {
 	// not enough block space for a chunk header
-	if s.curBlockSize+chunkHeaderSize >= blockSize {
+	if *blockOff+chunkHeaderSize >= blockSize {
 		// padding if necessary
-		if s.curBlockSize < blockSize {
-			padding := make([]byte, blockSize-s.curBlockSize)
-			if _, err := s.fd.Write(padding); err != nil {
-				return nil, err
-			}
+		if *blockOff < blockSize {
+			buf.B = append(buf.B, make([]byte, blockSize-*blockOff)...)
 		}
 		// new block
-		s.curBlockSize = 0
-		s.curBlockIndex++
+		*blockOff = 0
+		*blockIndex++
 	}
 
 	// chunk location for reading
 	loc := &ChunkLoc{
 		SegId:       s.id,
-		BlockIndex:  s.curBlockIndex,
-		ChunkOffset: int64(s.curBlockSize),
+		BlockIndex:  *blockIndex,
+		ChunkOffset: int64(*blockOff),
 	}
 
 	dataSize := uint32(len(data))
 
-	// init chunk buffer
-	chunkBuf := bytebufferpool.Get()
-	defer func() {
-		chunkBuf.Reset()
-		bytebufferpool.Put(chunkBuf)
-	}()
-
 	// if the whole data can fit into current block, stuff a full chunk in
-	if s.curBlockSize+dataSize+chunkHeaderSize <= blockSize {
-		s.appendChunkBuffer(chunkBuf, data, ChunkTypeFull)
-		if err := s.writeChunkBuffer(chunkBuf); err != nil {
-			return nil, err
-		}
+	if *blockOff+dataSize+chunkHeaderSize <= blockSize {
+		s.appendChunkBuffer(buf, data, ChunkTypeFull)
 		loc.ChunkSize = dataSize + chunkHeaderSize
-		return loc, nil
+	} else {
+		// if the size of the data exceeds the block size, should be written in batches.
+		var (
+			leftSize             = dataSize
+			chunkCount    uint32 = 0
+			currBlockSize        = *blockOff
+		)
+		for leftSize > 0 {
+			chunkSize := blockSize - currBlockSize - chunkHeaderSize
+			if chunkSize > leftSize {
+				chunkSize = leftSize
+			}
+
+			start := dataSize - leftSize
+			end := start + chunkSize
+			if end > dataSize {
+				end = dataSize
+			}
+
+			var chunkType ChunkType
+			switch leftSize {
+			case dataSize:
+				chunkType = ChunkTypeFirst
+			case chunkSize:
+				chunkType = ChunkTypeLast
+			default:
+				chunkType = ChunkTypeMiddle
+			}
+			s.appendChunkBuffer(buf, data[start:end], chunkType)
+
+			leftSize -= chunkSize
+			chunkCount++
+			currBlockSize = (currBlockSize + chunkSize + chunkHeaderSize) % blockSize
+		}
+		loc.ChunkSize = chunkCount*chunkHeaderSize + dataSize
+	}
+
+	// move the block position
+	*blockOff += loc.ChunkSize
+	if *blockOff >= blockSize {
+		*blockIndex += *blockOff / blockSize
+		*blockOff = *blockOff % blockSize
+	}
+	return loc
+}
+
+// writeStream writes the data of the given size read from r as the
+// chunks of a single data, like appendChunks. A chunk is written once
+// it's read, so the data is never held in memory as a whole. Only called
+// on the segment of a StreamWriter, which may be closed meanwhile.
+func (s *segment) writeStream(r io.Reader, size int64) (*ChunkLoc, error) {
+	// the ChunkSize of the location must not overflow.
+	if size+(size/(blockSize-chunkHeaderSize)+2)*chunkHeaderSize > math.MaxUint32 {
+		return nil, errors.New("the data size is too large")
 	}
 
-	// if the size of the data exceeds the block size, should be written in batches.
 	var (
-		leftSize             = dataSize
-		chunkCount    uint32 = 0
-		currBlockSize        = s.curBlockSize
+		buf        = make([]byte, blockSize)
+		blockIndex = s.curBlockIndex
+		blockOff   = s.curBlockSize
+		written    int64
+		chunkCount uint32
 	)
-	for leftSize > 0 {
-		chunkSize := blockSize - currBlockSize - chunkHeaderSize
-		if chunkSize > leftSize {
-			chunkSize = leftSize
+	if blockOff+chunkHeaderSize >= blockSize {
+		if err := s.writeFile(make([]byte, blockSize-blockOff)); err != nil {
+			return nil, err
 		}
+		blockOff = 0
+		blockIndex++
+	}
+	loc := &ChunkLoc{
+		SegId:       s.id,
+		BlockIndex:  blockIndex,
+		ChunkOffset: int64(blockOff),
+	}
 
-		start := dataSize - leftSize
-		end := start + chunkSize
-		if end > dataSize {
-			end = dataSize
+	for first := true; first || written < size; first = false {
+		chunkSize := int64(blockSize - blockOff - chunkHeaderSize)
+		if chunkSize > size-written {
+			chunkSize = size - written
 		}
+		last := written+chunkSize == size
 
 		var chunkType ChunkType
-		switch leftSize {
-		case dataSize:
+		switch {
+		case first && last:
+			chunkType = ChunkTypeFull
+		case first:
 			chunkType = ChunkTypeFirst
-		case chunkSize:
+		case last:
 			chunkType = ChunkTypeLast
 		default:
 			chunkType = ChunkTypeMiddle
 		}
-		s.appendChunkBuffer(chunkBuf, data[start:end], chunkType)
 
-		leftSize -= chunkSize
-		chunkCount++
-		currBlockSize = (currBlockSize + chunkSize + chunkHeaderSize) % blockSize
-	}
+		chunk := buf[:chunkHeaderSize+chunkSize]
+		if _, err := io.ReadFull(r, chunk[chunkHeaderSize:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		binary.LittleEndian.PutUint16(chunk[4:6], uint16(chunkSize))
+		chunk[6] = chunkType
+		binary.LittleEndian.PutUint32(chunk[:4], crc32.ChecksumIEEE(chunk[4:]))
+		if err := s.writeFile(chunk); err != nil {
+			return nil, err
+		}
 
-	if err := s.writeChunkBuffer(chunkBuf); err != nil {
-		return nil, err
+		written += chunkSize
+		chunkCount++
+		blockOff += uint32(len(chunk))
+		if blockOff >= blockSize {
+			blockIndex++
+			blockOff = 0
+		}
 	}
+	loc.ChunkSize = chunkCount*chunkHeaderSize + uint32(size)
 
-	loc.ChunkSize = chunkCount*chunkHeaderSize + dataSize
+	s.curBlockIndex, s.curBlockSize = blockIndex, blockOff
 	return loc, nil
 }
 
+// writeFile appends b to the segment file, it fails with ErrClosed if
+// the segment is closed.
+func (s *segment) writeFile(b []byte) error {
+	s.fdMu.RLock()
+	defer s.fdMu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	_, err := s.fd.Write(b)
+	return err
+}
+
 func (s *segment) appendChunkBuffer(buf *bytebufferpool.ByteBuffer, data []byte, chunkType ChunkType) {
 	// Length    2B:4-5
 	binary.LittleEndian.PutUint16(s.header[4:6], uint16(len(data)))
@@ -252,30 +828,36 @@ func (s *segment) appendChunkBuffer(buf *bytebufferpool.ByteBuffer, data []byte,
 	buf.B = append(buf.B, data...)
 }
 
-func (s *segment) writeChunkBuffer(buf *bytebufferpool.ByteBuffer) error {
-	if s.curBlockSize > blockSize {
-		panic("can not exceed the max block size")
-	}
-
-	if _, err := s.fd.Write(buf.Bytes()); err != nil {
-		return err
-	}
-
-	// update current write offset
-	s.curBlockSize += uint32(buf.Len())
-	if s.curBlockSize >= blockSize {
-		s.curBlockIndex += s.curBlockSize / blockSize
-		s.curBlockSize = s.curBlockSize % blockSize
-	}
-
-	return nil
-}
-
 func (s *segment) Read(blockIndex uint32, chunkOffset int64) ([]byte, error) {
 	val, _, err := s.readInternal(blockIndex, chunkOffset)
 	return val, err
 }
 
+// readView reads the data at the given position, it's a slice of the
+// mapping if the data is a single full chunk of the mapped segment,
+// otherwise it's copied. Reports whether the data is borrowed from the
+// mapping, which is only valid while the segment is held.
+func (s *segment) readView(blockIndex uint32, chunkOffset int64) ([]byte, bool, error) {
+	if s.closed {
+		return nil, false, ErrClosed
+	}
+	offset := int64(blockIndex)*blockSize + chunkOffset
+	if mapped := s.mapped.Load(); mapped != nil && chunkOffset >= 0 &&
+		chunkOffset+chunkHeaderSize <= blockSize && offset+chunkHeaderSize <= s.Size() {
+		chunk := mapped.data[SegmentHeaderSize+offset:]
+		length := int64(binary.LittleEndian.Uint16(chunk[4:6]))
+		end := chunkHeaderSize + length
+		if chunk[6] == ChunkTypeFull && chunkOffset+end <= blockSize && offset+end <= s.Size() {
+			if crc32.ChecksumIEEE(chunk[4:end]) != binary.LittleEndian.Uint32(chunk[:4]) {
+				return nil, false, ErrInvalidCRC
+			}
+			return chunk[chunkHeaderSize:end:end], true, nil
+		}
+	}
+	data, err := s.Read(blockIndex, chunkOffset)
+	return data, false, err
+}
+
 func (s *segment) readInternal(blockIndex uint32, chunkOffset int64) ([]byte, *ChunkLoc, error) {
 	if s.closed {
 		return nil, nil, ErrClosed
@@ -286,6 +868,7 @@ func (s *segment) readInternal(blockIndex uint32, chunkOffset int64) ([]byte, *C
 		bh        = s.blockPool.Get().(*blockAndHeader)
 		segSize   = s.Size()
 		nextChunk = &ChunkLoc{SegId: s.id}
+		mapped    = s.mapped.Load()
 	)
 	defer func() {
 		s.blockPool.Put(bh)
@@ -300,16 +883,29 @@ func (s *segment) readInternal(blockIndex uint32, chunkOffset int64) ([]byte, *C
 		}
 
 		if chunkOffset >= sz {
+			// the rest chunks of the data are torn.
+			if res != nil {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
 			return nil, nil, io.EOF
 		}
 
-		// read an entire block
-		if _, err := s.fd.ReadAt(bh.block[0:sz], offset); err != nil {
+		// read an entire block, or slice it from the mapping.
+		block := bh.block[0:sz]
+		if mapped != nil {
+			block = mapped.data[SegmentHeaderSize+offset : SegmentHeaderSize+offset+sz]
+		} else if _, err := s.readAt(block, SegmentHeaderSize+offset); err != nil {
 			return nil, nil, err
 		}
 
+		// the chunk is torn, i.e. the segment file is not fully
+		// written before a crash.
+		if chunkOffset+chunkHeaderSize > sz {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+
 		// header
-		copy(bh.header, bh.block[chunkOffset:chunkOffset+chunkHeaderSize])
+		copy(bh.header, block[chunkOffset:chunkOffset+chunkHeaderSize])
 
 		// length
 		length := binary.LittleEndian.Uint16(bh.header[4:6])
@@ -317,10 +913,13 @@ func (s *segment) readInternal(blockIndex uint32, chunkOffset int64) ([]byte, *C
 		// copy data
 		start := chunkOffset + chunkHeaderSize
 		end := start + int64(length)
-		res = append(res, bh.block[start:end]...)
+		if end > sz {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		res = append(res, block[start:end]...)
 
 		// check sum
-		checksum := crc32.ChecksumIEEE(bh.block[chunkOffset+4 : end])
+		checksum := crc32.ChecksumIEEE(block[chunkOffset+4 : end])
 		savedSum := binary.LittleEndian.Uint32(bh.header[:4])
 		if savedSum != checksum {
 			return nil, nil, ErrInvalidCRC
@@ -349,6 +948,125 @@ func (s *segment) readInternal(blockIndex uint32, chunkOffset int64) ([]byte, *C
 	return res, nextChunk, nil
 }
 
+// readChunk reads the single chunk at the given position and checks
+// its checksum. Returns the data of the chunk and its type, the data is
+// read into buf, which must be a block large, or sliced from the mapping.
+func (s *segment) readChunk(blockIndex uint32, chunkOffset int64, buf []byte) ([]byte, ChunkType, error) {
+	if s.closed {
+		return nil, 0, ErrClosed
+	}
+	offset := int64(blockIndex)*blockSize + chunkOffset
+	segSize := s.Size()
+	if chunkOffset < 0 || chunkOffset+chunkHeaderSize > blockSize || offset+chunkHeaderSize > segSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	mapped := s.mapped.Load()
+	header := buf[:chunkHeaderSize]
+	if mapped != nil {
+		header = mapped.data[SegmentHeaderSize+offset : SegmentHeaderSize+offset+chunkHeaderSize]
+	} else if _, err := s.readAt(header, SegmentHeaderSize+offset); err != nil {
+		return nil, 0, err
+	}
+	end := chunkHeaderSize + int64(binary.LittleEndian.Uint16(header[4:6]))
+	if chunkOffset+end > blockSize || offset+end > segSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	data := buf[chunkHeaderSize:end]
+	if mapped != nil {
+		data = mapped.data[SegmentHeaderSize+offset+chunkHeaderSize : SegmentHeaderSize+offset+end]
+	} else if _, err := s.readAt(data, SegmentHeaderSize+offset+chunkHeaderSize); err != nil {
+		return nil, 0, err
+	}
+
+	checksum := crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, data)
+	if checksum != binary.LittleEndian.Uint32(header[:4]) {
+		return nil, 0, ErrInvalidCRC
+	}
+	return data, header[6], nil
+}
+
+// checkChunkStart checks that the position is the end of the segment,
+// or the start of a chunk, that is the first or full chunk of the data
+// with a valid checksum.
+func (s *segment) checkChunkStart(blockIndex uint32, chunkOffset int64) error {
+	if s.closed {
+		return ErrClosed
+	}
+	offset := int64(blockIndex)*blockSize + chunkOffset
+	segSize := s.Size()
+	if offset == segSize {
+		return nil
+	}
+	if chunkOffset < 0 || chunkOffset+chunkHeaderSize >= blockSize || offset > segSize {
+		return ErrInvalidChunkLoc
+	}
+
+	header := make([]byte, chunkHeaderSize)
+	if _, err := s.readAt(header, SegmentHeaderSize+offset); err != nil {
+		return err
+	}
+	length := int64(binary.LittleEndian.Uint16(header[4:6]))
+	chunkType := header[6]
+	if chunkType != ChunkTypeFull && chunkType != ChunkTypeFirst ||
+		chunkOffset+chunkHeaderSize+length > blockSize ||
+		offset+chunkHeaderSize+length > segSize {
+		return ErrInvalidChunkLoc
+	}
+
+	data := make([]byte, length)
+	if _, err := s.readAt(data, SegmentHeaderSize+offset+chunkHeaderSize); err != nil {
+		return err
+	}
+	sum := crc32.ChecksumIEEE(header[4:])
+	sum = crc32.Update(sum, crc32.IEEETable, data)
+	if sum != binary.LittleEndian.Uint32(header[:4]) {
+		return ErrInvalidChunkLoc
+	}
+	return nil
+}
+
+// chunkEnd returns the position right after the chunk at the given
+// position, which must be the start of a chunk or the end of the segment.
+func (s *segment) chunkEnd(blockIndex uint32, chunkOffset int64) (*ChunkLoc, error) {
+	if err := s.checkChunkStart(blockIndex, chunkOffset); err != nil {
+		return nil, err
+	}
+	if int64(blockIndex)*blockSize+chunkOffset == s.Size() {
+		return &ChunkLoc{SegId: s.id, BlockIndex: blockIndex, ChunkOffset: chunkOffset}, nil
+	}
+	_, next, err := s.readInternal(blockIndex, chunkOffset)
+	return next, err
+}
+
+// truncate discards the data after the given position and syncs the
+// segment file, the padding of the last block is filled if needed.
+// A preallocated segment file is allocated again after the position,
+// which is filled with zeros. The file is reopened if it's closed
+// by the cache.
+func (s *segment) truncate(end *ChunkLoc) error {
+	if err := s.reopen(); err != nil {
+		return err
+	}
+	size := int64(end.BlockIndex)*blockSize + end.ChunkOffset
+	if err := s.fd.Truncate(SegmentHeaderSize + size); err != nil {
+		return err
+	}
+	if s.prealloc > 0 {
+		if err := vfs.Preallocate(s.fd, SegmentHeaderSize+s.prealloc); err != nil {
+			return err
+		}
+	}
+	if _, err := s.fd.Seek(SegmentHeaderSize+size, io.SeekStart); err != nil {
+		return err
+	}
+	if err := s.fd.Sync(); err != nil {
+		return err
+	}
+	s.curBlockIndex, s.curBlockSize = uint32(size/blockSize), uint32(size%blockSize)
+	return nil
+}
+
 func (sr *segmentReader) Next() ([]byte, *ChunkLoc, error) {
 	if sr.seg.closed {
 		return nil, nil, ErrClosed
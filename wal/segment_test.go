@@ -7,12 +7,13 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/berylyvos/yojoudb/vfs"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestSegment_Write_FULL1(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "seg-test-full1")
-	seg, err := openSegmentFile(dir, ".SEG", 1)
+	seg, err := openSegmentFile(vfs.Default, dir, ".SEG", 1, 0)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -46,7 +47,7 @@ func TestSegment_Write_FULL1(t *testing.T) {
 
 func TestSegment_Write_FULL2(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "seg-test-full2")
-	seg, err := openSegmentFile(dir, ".SEG", 1)
+	seg, err := openSegmentFile(vfs.Default, dir, ".SEG", 1, 0)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -74,7 +75,7 @@ func TestSegment_Write_FULL2(t *testing.T) {
 
 func TestSegment_Write_Padding(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "seg-test-padding")
-	seg, err := openSegmentFile(dir, ".SEG", 1)
+	seg, err := openSegmentFile(vfs.Default, dir, ".SEG", 1, 0)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -97,7 +98,7 @@ func TestSegment_Write_Padding(t *testing.T) {
 
 func TestSegment_Write_NOT_FULL(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "seg-test-not-full")
-	seg, err := openSegmentFile(dir, ".SEG", 1)
+	seg, err := openSegmentFile(vfs.Default, dir, ".SEG", 1, 0)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -135,7 +136,7 @@ func TestSegment_Write_NOT_FULL(t *testing.T) {
 
 func TestSegment_Reader_FULL(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "seg-test-reader-full")
-	seg, err := openSegmentFile(dir, ".SEG", 1)
+	seg, err := openSegmentFile(vfs.Default, dir, ".SEG", 1, 0)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -167,7 +168,7 @@ func TestSegment_Reader_FULL(t *testing.T) {
 
 func TestSegment_Reader_Padding(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "seg-test-reader-padding")
-	seg, err := openSegmentFile(dir, ".SEG", 1)
+	seg, err := openSegmentFile(vfs.Default, dir, ".SEG", 1, 0)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -201,7 +202,7 @@ func TestSegment_Reader_Padding(t *testing.T) {
 
 func TestSegment_Reader_NOT_FULL(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "seg-test-reader-not-full")
-	seg, err := openSegmentFile(dir, ".SEG", 1)
+	seg, err := openSegmentFile(vfs.Default, dir, ".SEG", 1, 0)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -247,7 +248,7 @@ func TestSegment_Reader_NOT_FULL(t *testing.T) {
 
 func TestSegment_Reader_ManyChunks_FULL(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "seg-test-reader-ManyChunks_FULL")
-	seg, err := openSegmentFile(dir, ".SEG", 1)
+	seg, err := openSegmentFile(vfs.Default, dir, ".SEG", 1, 0)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -285,7 +286,7 @@ func TestSegment_Reader_ManyChunks_FULL(t *testing.T) {
 
 func TestSegment_Reader_ManyChunks_NOT_FULL(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "seg-test-reader-ManyChunks_NOT_FULL")
-	seg, err := openSegmentFile(dir, ".SEG", 1)
+	seg, err := openSegmentFile(vfs.Default, dir, ".SEG", 1, 0)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -335,7 +336,7 @@ func TestSegment_Write_LargeSize(t *testing.T) {
 
 func testSegmentReaderLargeSize(t *testing.T, size int, count int) {
 	dir, _ := os.MkdirTemp("", "seg-test-reader-ManyChunks_large_size")
-	seg, err := openSegmentFile(dir, ".SEG", 1)
+	seg, err := openSegmentFile(vfs.Default, dir, ".SEG", 1, 0)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
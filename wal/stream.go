@@ -0,0 +1,205 @@
+package wal
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// StreamWriter writes a single large data into a new segment of its own,
+// chunk by chunk as it's read, without holding the whole data in memory.
+// The segment is not a part of the WAL until it's committed, so it's
+// never seen by the readers or removed while being written.
+// A StreamWriter is not safe for concurrent use.
+type StreamWriter struct {
+	wal     *WAL
+	seg     *segment
+	written bool
+}
+
+// NewStreamWriter creates a new segment for the data to be streamed by
+// the returned writer. The active segment is rotated past it, so the
+// other writes go on meanwhile, or replaced if it's empty, so that the
+// streams in a row don't leave the empty segment files behind. Either
+// Commit or Abort must be called after the data is written.
+func (w *WAL) NewStreamWriter() (*StreamWriter, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, ErrClosed
+	}
+
+	seg, err := w.openSegment(w.lastSegID + 1)
+	if err != nil {
+		return nil, err
+	}
+	if w.activeSeg.Size() == 0 {
+		err = w.replaceActiveSeg(seg.id + 1)
+	} else {
+		err = w.rotateActiveSegTo(seg.id + 1)
+	}
+	if err != nil {
+		_ = seg.Remove()
+		return nil, err
+	}
+	w.streams[seg.id] = seg
+	return &StreamWriter{wal: w, seg: seg}, nil
+}
+
+// Write writes the data of the given size read from r, which is split
+// into chunks like the other data, and syncs the segment file. Exactly
+// size bytes are read from r, io.ErrUnexpectedEOF is returned if r ends
+// earlier. Returns the location of the data, which can be read after
+// the segment is committed. It can only be called once.
+func (sw *StreamWriter) Write(r io.Reader, size int64) (*ChunkLoc, error) {
+	if sw.written {
+		return nil, errors.New("the stream has been written")
+	}
+	if size < 0 {
+		return nil, errors.New("the data size is negative")
+	}
+	sw.written = true
+
+	loc, err := sw.seg.writeStream(r, size)
+	if err != nil {
+		return nil, err
+	}
+	// the segment is sealed right away, it's never written again.
+	seg := sw.seg
+	seg.fdMu.RLock()
+	defer seg.fdMu.RUnlock()
+	if seg.closed {
+		return nil, ErrClosed
+	}
+	if err := seg.seal(); err != nil {
+		return nil, err
+	}
+	if err := seg.Sync(); err != nil {
+		return nil, err
+	}
+	return loc, nil
+}
+
+// Commit adds the written segment to the WAL as a sealed one.
+func (sw *StreamWriter) Commit() error {
+	w := sw.wal
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if w.streams[sw.seg.id] != sw.seg {
+		return errors.New("the stream is not pending")
+	}
+
+	if w.options.MmapReads {
+		if err := sw.seg.mapFile(); err != nil {
+			return err
+		}
+	}
+	delete(w.streams, sw.seg.id)
+	w.olderSegs[sw.seg.id] = sw.seg
+	if w.fds != nil {
+		w.fds.manage(sw.seg)
+	}
+	return nil
+}
+
+// Abort deletes the segment if it's not committed.
+func (sw *StreamWriter) Abort() error {
+	w := sw.wal
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.streams[sw.seg.id] != sw.seg {
+		return nil
+	}
+	delete(w.streams, sw.seg.id)
+	return sw.seg.Remove()
+}
+
+// StreamReader reads the data at a location chunk by chunk, the checksum
+// of a chunk is checked when it's read. The segment is held until the
+// reader is closed, so it can be read even if it's removed meanwhile.
+// A StreamReader is not safe for concurrent use.
+type StreamReader struct {
+	seg      *segment
+	blockIdx uint32 // the position of the next chunk.
+	chunkOff int64
+	block    []byte
+	data     []byte // the unread data of the current chunk.
+	started  bool
+	done     bool // whether the last chunk has been read.
+	once     sync.Once
+}
+
+// NewStreamReader returns a reader of the data at the given location,
+// which must be the start of a chunk.
+func (w *WAL) NewStreamReader(loc *ChunkLoc) (*StreamReader, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return nil, ErrClosed
+	}
+	seg, err := w.segmentOf(loc)
+	if err != nil {
+		return nil, err
+	}
+	seg.acquire()
+	return &StreamReader{
+		seg:      seg,
+		blockIdx: loc.BlockIndex,
+		chunkOff: loc.ChunkOffset,
+		block:    make([]byte, blockSize),
+	}, nil
+}
+
+// Read reads the data into p, it returns io.EOF at the end of the data.
+func (r *StreamReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// next reads the next chunk of the data.
+func (r *StreamReader) next() error {
+	if r.seg == nil {
+		return ErrClosed
+	}
+	data, chunkType, err := r.seg.readChunk(r.blockIdx, r.chunkOff, r.block)
+	if err != nil {
+		return err
+	}
+	if !r.started && chunkType != ChunkTypeFull && chunkType != ChunkTypeFirst {
+		return ErrInvalidChunkLoc
+	}
+	r.started = true
+	r.data = data
+	r.done = chunkType == ChunkTypeFull || chunkType == ChunkTypeLast
+
+	// the rest of the block is padding if a chunk header doesn't fit.
+	r.chunkOff += chunkHeaderSize + int64(len(data))
+	if r.chunkOff+chunkHeaderSize >= blockSize {
+		r.blockIdx++
+		r.chunkOff = 0
+	}
+	return nil
+}
+
+// Close releases the segment held by the reader.
+func (r *StreamReader) Close() error {
+	var err error
+	r.once.Do(func() {
+		err = r.seg.release()
+		r.seg = nil
+		r.data = nil
+	})
+	return err
+}
@@ -0,0 +1,200 @@
+package wal
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrInvalidSyncPolicy = errors.New("invalid sync policy")
+
+// syncPolicy returns the effective sync policy of the options.
+func (opt *Options) syncPolicy() SyncPolicy {
+	if opt.SyncPolicy != SyncNever {
+		return opt.SyncPolicy
+	}
+	if opt.Sync {
+		return SyncEveryWrite
+	}
+	if opt.BytesPerSync > 0 {
+		return SyncEveryN
+	}
+	return SyncNever
+}
+
+func checkSyncPolicy(policy SyncPolicy, bytesPerSync uint32, interval time.Duration) error {
+	switch policy {
+	case SyncNever, SyncEveryWrite:
+		return nil
+	case SyncEveryN:
+		if bytesPerSync > 0 {
+			return nil
+		}
+	case SyncInterval:
+		if interval > 0 {
+			return nil
+		}
+	}
+	return ErrInvalidSyncPolicy
+}
+
+// SyncPolicy returns the current sync policy of the WAL.
+func (w *WAL) SyncPolicy() SyncPolicy {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.options.syncPolicy()
+}
+
+// SetSyncPolicy changes the sync policy at runtime. The bytesPerSync is
+// only used by SyncEveryN, and the interval is only used by SyncInterval.
+func (w *WAL) SetSyncPolicy(policy SyncPolicy, bytesPerSync uint32, interval time.Duration) error {
+	if err := checkSyncPolicy(policy, bytesPerSync, interval); err != nil {
+		return err
+	}
+
+	if policy != SyncEveryN {
+		bytesPerSync = 0
+	}
+
+	w.syncerMu.Lock()
+	defer w.syncerMu.Unlock()
+	w.stopSyncer()
+
+	w.mu.Lock()
+	w.options.Sync = policy == SyncEveryWrite
+	w.options.SyncPolicy = policy
+	w.options.BytesPerSync = bytesPerSync
+	w.options.SyncInterval = interval
+	closed := w.closed
+	w.mu.Unlock()
+
+	if policy == SyncInterval && !closed {
+		w.startSyncer(interval)
+	}
+	return nil
+}
+
+// DurableLoc returns the end location of the durable data in the WAL,
+// all data written before it has been synced to stable storage.
+func (w *WAL) DurableLoc() *ChunkLoc {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	loc := w.durableLoc
+	return &loc
+}
+
+// syncActiveSeg syncs the active segment file if there's any data
+// written since the last sync. The caller must hold w.mu, it's used
+// by the writes, see syncUnlocked for the others.
+func (w *WAL) syncActiveSeg() error {
+	seg := w.activeSeg
+	if w.durableLoc.SegId == seg.id &&
+		w.durableLoc.BlockIndex == seg.curBlockIndex &&
+		w.durableLoc.ChunkOffset == int64(seg.curBlockSize) {
+		return nil
+	}
+	if err := w.beforeSync(); err != nil {
+		return err
+	}
+	if err := seg.Sync(); err != nil {
+		return err
+	}
+	w.bytesWrite = 0
+	w.durableLoc = ChunkLoc{
+		SegId:       seg.id,
+		BlockIndex:  seg.curBlockIndex,
+		ChunkOffset: int64(seg.curBlockSize),
+	}
+	return nil
+}
+
+// syncUnlocked syncs the active segment file like syncActiveSeg, but the
+// fsync runs without w.mu held, so that the reads and writes aren't
+// blocked by it. The segment is held meanwhile, and the end of the data
+// at the time is durable after the sync, unless it's truncated.
+// The caller must not hold w.mu.
+func (w *WAL) syncUnlocked() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	seg := w.activeSeg
+	end := ChunkLoc{
+		SegId:       seg.id,
+		BlockIndex:  seg.curBlockIndex,
+		ChunkOffset: int64(seg.curBlockSize),
+	}
+	truncGen := w.truncGen
+	if !locBefore(&w.durableLoc, &end) {
+		w.mu.Unlock()
+		return nil
+	}
+	seg.acquire()
+	w.mu.Unlock()
+
+	err := w.beforeSync()
+	if err == nil {
+		err = seg.syncFile()
+	}
+	if e := seg.release(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// the data before the end may be discarded and written again.
+	if w.truncGen == truncGen && locBefore(&w.durableLoc, &end) {
+		w.durableLoc = end
+		if seg == w.activeSeg && seg.Size() == int64(end.BlockIndex)*blockSize+end.ChunkOffset {
+			w.bytesWrite = 0
+		}
+	}
+	return nil
+}
+
+// beforeSync calls Options.BeforeSync if it's set.
+func (w *WAL) beforeSync() error {
+	if w.options.BeforeSync == nil {
+		return nil
+	}
+	return w.options.BeforeSync()
+}
+
+// startSyncer starts a background goroutine syncing the active
+// segment file every interval. The caller must hold w.syncerMu.
+func (w *WAL) startSyncer(interval time.Duration) {
+	stop, done := make(chan struct{}), make(chan struct{})
+	w.syncerStop, w.syncerDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// the error is reported by the next call of Sync.
+				if err := w.syncUnlocked(); err != nil && err != ErrClosed {
+					w.mu.Lock()
+					w.syncErr = err
+					w.mu.Unlock()
+				}
+			}
+		}
+	}()
+}
+
+// stopSyncer stops the background sync goroutine if it's running.
+// The caller must hold w.syncerMu, but not w.mu.
+func (w *WAL) stopSyncer() {
+	if w.syncerStop == nil {
+		return
+	}
+	close(w.syncerStop)
+	<-w.syncerDone
+	w.syncerStop, w.syncerDone = nil, nil
+}
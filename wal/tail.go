@@ -0,0 +1,164 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+)
+
+// TailReader reads the chunks of the WAL from a location, and waits for
+// the new chunks once it reaches the end, following the rotation of the
+// active segment. It only reads the chunks which are completely written,
+// so it can be used to consume the WAL as a queue or a replication log.
+// The segment being read is held until the reader moves on or is closed.
+// A TailReader is not safe for concurrent use, and it must be closed.
+type TailReader struct {
+	wal      *WAL
+	pos      ChunkLoc // location of the next chunk.
+	seg      *segment // the segment of pos held by the reader, or nil.
+	truncGen uint64   // the last truncation checked, see WAL.TruncateAfter.
+}
+
+// NewTailReader returns a tail reader starting from the given chunk
+// location, which is included, see NewReaderWithLoc for the valid
+// locations. If from is nil, it starts from the first chunk of the WAL.
+func (w *WAL) NewTailReader(from *ChunkLoc) (r *TailReader, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, ErrClosed
+	}
+
+	r = &TailReader{wal: w, truncGen: w.truncGen}
+	defer func() {
+		if err == nil {
+			w.tails[r] = struct{}{}
+		}
+	}()
+	if from != nil {
+		if from.SegId > w.activeSeg.id {
+			return nil, ErrInvalidChunkLoc
+		}
+		seg := w.olderSegs[from.SegId]
+		if from.SegId == w.activeSeg.id {
+			seg = w.activeSeg
+		}
+		if seg != nil {
+			if err := seg.checkChunkStart(from.BlockIndex, from.ChunkOffset); err != nil {
+				return nil, err
+			}
+			r.pos = ChunkLoc{
+				SegId:       from.SegId,
+				BlockIndex:  from.BlockIndex,
+				ChunkOffset: from.ChunkOffset,
+			}
+			return r, nil
+		}
+		if from.SegId > w.firstSegID() {
+			return nil, fmt.Errorf("segment file %d%s not found", from.SegId, w.options.SegmentFileExt)
+		}
+	}
+	r.pos.SegId = w.firstSegID()
+	return r, nil
+}
+
+// Pos returns the location of the next chunk to read, a new tail
+// reader can resume from it.
+func (r *TailReader) Pos() *ChunkLoc {
+	pos := r.pos
+	return &pos
+}
+
+// Next returns the next chunk data with location. If there's no data,
+// it blocks until a new chunk is written, the context is done, or the
+// WAL is closed, which returns the error of the context or ErrClosed.
+func (r *TailReader) Next(ctx context.Context) ([]byte, *ChunkLoc, error) {
+	for {
+		data, loc, appended, err := r.next()
+		if err != nil || appended == nil {
+			return data, loc, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+// Close releases the segment held by the reader.
+func (r *TailReader) Close() {
+	w := r.wal
+	w.mu.Lock()
+	delete(w.tails, r)
+	w.trimTruncs()
+	w.mu.Unlock()
+	r.releaseSeg()
+}
+
+// releaseSeg releases the segment held by the reader if any.
+func (r *TailReader) releaseSeg() {
+	if r.seg != nil {
+		_ = r.seg.release()
+		r.seg = nil
+	}
+}
+
+// next reads the next chunk if it's written, otherwise returns
+// a channel which is closed when there are new chunks.
+func (r *TailReader) next() ([]byte, *ChunkLoc, <-chan struct{}, error) {
+	w := r.wal
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	for {
+		if w.closed {
+			return nil, nil, nil, ErrClosed
+		}
+		// the chunks after pos may be discarded and rewritten.
+		for _, t := range w.truncs {
+			if t.gen > r.truncGen && locBefore(&t.end, &r.pos) {
+				return nil, nil, nil, ErrTruncated
+			}
+		}
+		// it's read by trimTruncs, which holds w.mu locked.
+		r.truncGen = w.truncGen
+
+		if r.seg == nil {
+			seg := w.olderSegs[r.pos.SegId]
+			if r.pos.SegId == w.activeSeg.id {
+				seg = w.activeSeg
+			}
+			if seg == nil {
+				return nil, nil, nil, fmt.Errorf("segment file %d%s not found", r.pos.SegId, w.options.SegmentFileExt)
+			}
+			seg.acquire()
+			r.seg = seg
+		}
+		seg := r.seg
+
+		// the size of a segment is updated after its chunks are written.
+		offset := int64(r.pos.BlockIndex)*blockSize + r.pos.ChunkOffset
+		if offset >= seg.Size() {
+			if seg == w.activeSeg {
+				return nil, nil, w.appended, nil
+			}
+			// the segment is sealed, go on with the next one.
+			r.releaseSeg()
+			r.pos = ChunkLoc{SegId: w.nextSegID(seg.id)}
+			continue
+		}
+
+		data, next, err := seg.readInternal(r.pos.BlockIndex, r.pos.ChunkOffset)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		loc := &ChunkLoc{
+			SegId:       seg.id,
+			BlockIndex:  r.pos.BlockIndex,
+			ChunkOffset: r.pos.ChunkOffset,
+			ChunkSize:   uint32(int64(next.BlockIndex)*blockSize + next.ChunkOffset - offset),
+		}
+		r.pos = *next
+		return data, loc, nil, nil
+	}
+}
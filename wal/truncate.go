@@ -0,0 +1,320 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/berylyvos/yojoudb/vfs"
+)
+
+// truncatedFileName is the name of the file recording the id of the
+// oldest segment kept by TruncateBefore, followed by the extension of
+// the segment files, so the WALs in the same directory don't share it.
+const truncatedFileName = "TRUNCATED"
+
+var (
+	ErrTruncated   = errors.New("the chunks after the location are truncated")
+	ErrMappedInUse = errors.New("the mapped data of the segment is held by a reader")
+)
+
+// TruncateBefore removes the sealed segments whose id is less than the
+// given segId, the active segment is never removed. The segments are
+// removed from the WAL at once, but the files held by the readers are
+// deleted after they are released. The id of the oldest segment kept
+// is saved before, so the files left by a crash are deleted by Open.
+func (w *WAL) TruncateBefore(segId SegmentID) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+
+	var removed []*segment
+	for id, seg := range w.olderSegs {
+		if id < segId {
+			removed = append(removed, seg)
+			delete(w.olderSegs, id)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	// the streams being written are kept as well.
+	first := w.firstSegID()
+	for id := range w.streams {
+		if id < first {
+			first = id
+		}
+	}
+	if err := writeTruncated(w.options.fs(), w.options.DirPath, w.options.SegmentFileExt, first); err != nil {
+		return err
+	}
+	return removeSegments(removed)
+}
+
+// writeTruncated saves the id of the oldest segment kept by TruncateBefore.
+// It's written into a temporary file first, which then replaces the old
+// one, so it's never torn by a crash.
+func writeTruncated(fs vfs.FS, dirPath, extName string, id SegmentID) error {
+	path := filepath.Join(dirPath, truncatedFileName+extName)
+	tmpPath := path + ".tmp"
+	fd, err := fs.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fileModePerm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = fd.Close()
+		_ = fs.Remove(tmpPath)
+	}()
+
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b, id)
+	binary.LittleEndian.PutUint32(b[4:], crc32.ChecksumIEEE(b[:4]))
+	if _, err = fd.Write(b); err != nil {
+		return err
+	}
+	if err = fd.Sync(); err != nil {
+		return err
+	}
+	if err = fs.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return fs.SyncDir(dirPath)
+}
+
+// readTruncated reads the id of the oldest segment kept by TruncateBefore,
+// 0 if the WAL is never truncated.
+func readTruncated(fs vfs.FS, dirPath, extName string) (SegmentID, error) {
+	path := filepath.Join(dirPath, truncatedFileName+extName)
+	fd, err := vfs.Open(fs, path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+
+	b := make([]byte, 8)
+	if _, err = io.ReadFull(fd, b); err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if crc32.ChecksumIEEE(b[:4]) != binary.LittleEndian.Uint32(b[4:]) {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidCRC, path)
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// RemoveSegments removes the sealed segments of the given ids, the
+// active segment and the ids not in the WAL are skipped. Like
+// TruncateBefore, the files held by the readers are deleted after
+// they are released, but such a file may come back if the process
+// crashes before it's deleted.
+func (w *WAL) RemoveSegments(ids ...SegmentID) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+
+	var removed []*segment
+	for _, id := range ids {
+		if seg, ok := w.olderSegs[id]; ok {
+			removed = append(removed, seg)
+			delete(w.olderSegs, id)
+		}
+	}
+	return removeSegments(removed)
+}
+
+// TruncateAfter discards all the chunks after the given location, the
+// chunk at the location is kept. The segment of the location becomes the
+// active segment, the files of the later segments are deleted before it's
+// truncated, even if they are held by the readers, and their ids are never
+// reused.
+// The location must be the start of a chunk, or the end of a segment,
+// see NewReaderWithLoc. The tail readers after the location will get
+// ErrTruncated. With Options.MmapReads, it returns ErrMappedInUse if
+// the mapped data of the segment is held by a reader or a view.
+func (w *WAL) TruncateAfter(loc *ChunkLoc) error {
+	if loc == nil {
+		return errors.New("truncate location is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+
+	seg, err := w.segmentOf(loc)
+	if err != nil {
+		return err
+	}
+	end, err := seg.chunkEnd(loc.BlockIndex, loc.ChunkOffset)
+	if err != nil {
+		return err
+	}
+	return w.truncateAt(seg, end)
+}
+
+// TruncateAt discards the chunk at the given location and all the
+// chunks after it, the location only needs to be within the written
+// data, it's used to repair a torn tail after a crash, of which the
+// chunk is corrupted. Otherwise, it's the same as TruncateAfter.
+func (w *WAL) TruncateAt(loc *ChunkLoc) error {
+	if loc == nil {
+		return errors.New("truncate location is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+
+	seg, err := w.segmentOf(loc)
+	if err != nil {
+		return err
+	}
+	offset := int64(loc.BlockIndex)*blockSize + loc.ChunkOffset
+	if loc.ChunkOffset < 0 || loc.ChunkOffset >= blockSize || offset > seg.Size() {
+		return ErrInvalidChunkLoc
+	}
+	return w.truncateAt(seg, &ChunkLoc{
+		SegId:       seg.id,
+		BlockIndex:  loc.BlockIndex,
+		ChunkOffset: loc.ChunkOffset,
+	})
+}
+
+// truncation is the new end of the WAL after a truncation, gen is the
+// number of truncations including it.
+type truncation struct {
+	gen uint64
+	end ChunkLoc
+}
+
+// segmentOf returns the segment of the location.
+// The caller must hold w.mu.
+func (w *WAL) segmentOf(loc *ChunkLoc) (*segment, error) {
+	seg := w.olderSegs[loc.SegId]
+	if loc.SegId == w.activeSeg.id {
+		seg = w.activeSeg
+	}
+	if seg == nil {
+		return nil, fmt.Errorf("segment file %d%s not found", loc.SegId, w.options.SegmentFileExt)
+	}
+	return seg, nil
+}
+
+// truncateAt discards the data of the segment after the end position,
+// and removes the later segments, the segment becomes the active one.
+// The caller must hold w.mu.
+func (w *WAL) truncateAt(seg *segment, end *ChunkLoc) error {
+	// the file can't be shrunk under the mapped data being read, the
+	// segment may be mapped before it became the active one again.
+	if err := seg.unmapFile(); err != nil {
+		return err
+	}
+	// the sealed segment will be written again, its file must be
+	// kept open.
+	if seg != w.activeSeg && w.fds != nil {
+		w.fds.unmanage(seg)
+	}
+
+	// the later segments, including the active one, are deleted from the
+	// newest before the segment is truncated, so that the discarded chunks
+	// never come back after a crash. The WAL is changed once both are done.
+	var removed []*segment
+	for id, s := range w.olderSegs {
+		if id > seg.id {
+			removed = append(removed, s)
+		}
+	}
+	if w.activeSeg != seg {
+		removed = append(removed, w.activeSeg)
+	}
+	if err := unlinkSegments(w.options.fs(), w.options.DirPath, removed); err != nil {
+		return err
+	}
+	if err := seg.truncate(end); err != nil {
+		return err
+	}
+	for _, s := range removed {
+		delete(w.olderSegs, s.id)
+	}
+	if w.activeSeg != seg {
+		delete(w.olderSegs, seg.id)
+		w.activeSeg = seg
+	}
+
+	if locBefore(end, &w.durableLoc) {
+		w.durableLoc = *end
+	}
+	w.truncGen++
+	w.truncs = append(w.truncs, truncation{gen: w.truncGen, end: *end})
+	w.trimTruncs()
+	w.notifyAppended()
+	return nil
+}
+
+// trimTruncs drops the truncations checked by all open tail readers,
+// the later tail readers only check the later truncations.
+// The caller must hold w.mu.
+func (w *WAL) trimTruncs() {
+	checked := w.truncGen
+	for r := range w.tails {
+		if r.truncGen < checked {
+			checked = r.truncGen
+		}
+	}
+	i := 0
+	for i < len(w.truncs) && w.truncs[i].gen <= checked {
+		i++
+	}
+	w.truncs = append(w.truncs[:0], w.truncs[i:]...)
+}
+
+// removeSegments marks the segments obsolete from the oldest one.
+func removeSegments(segs []*segment) error {
+	sortSegments(segs)
+	for _, seg := range segs {
+		if err := seg.markObsolete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlinkSegments deletes the files of the segments from the newest one,
+// then syncs the directory, see segment.unlink.
+func unlinkSegments(fs vfs.FS, dirPath string, segs []*segment) error {
+	if len(segs) == 0 {
+		return nil
+	}
+	sortSegments(segs)
+	for i := len(segs) - 1; i >= 0; i-- {
+		if err := segs[i].unlink(); err != nil {
+			return err
+		}
+	}
+	return fs.SyncDir(dirPath)
+}
+
+// locBefore reports whether the position a is before b.
+func locBefore(a, b *ChunkLoc) bool {
+	if a.SegId != b.SegId {
+		return a.SegId < b.SegId
+	}
+	if a.BlockIndex != b.BlockIndex {
+		return a.BlockIndex < b.BlockIndex
+	}
+	return a.ChunkOffset < b.ChunkOffset
+}
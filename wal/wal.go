@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"sync"
 )
@@ -28,30 +29,66 @@ type WAL struct {
 	options    Options
 	mu         sync.RWMutex
 	bytesWrite uint32
+	closed     bool
+	durableLoc ChunkLoc      // end of the synced data.
+	appended   chan struct{} // closed when new chunks are written, see TailReader.
+	truncGen   uint64        // the number of truncations by TruncateAfter.
+	syncErr    error         // error of the background sync.
+	fds        *fdCache      // open files of the sealed segments, nil if not bounded.
+	lastSegID  SegmentID     // the largest segment id ever opened, the ids are never reused.
+
+	// the truncations not yet checked by every open tail reader.
+	truncs []truncation
+	tails  map[*TailReader]struct{}
+
+	// the segments being written by the StreamWriters, they join the
+	// olderSegs when committed.
+	streams map[SegmentID]*segment
+
+	// background sync goroutine for SyncInterval.
+	syncerMu   sync.Mutex
+	syncerStop chan struct{}
+	syncerDone chan struct{}
 }
 
 // Reader represents a reader for WAL.
 // The readers are *segmentReader for every segment,
 // sorted by segment id.
 // And the currIdx points to current segment reader.
+//
+// The segments are held by the reader until it has read them through,
+// so they can be read even if they are truncated meanwhile. Call Close
+// to release them if the reader is abandoned halfway.
 type Reader struct {
 	readers []*segmentReader
 	currIdx int
 }
 
 func Open(opt Options) (*WAL, error) {
+	if err := checkSyncPolicy(opt.syncPolicy(), opt.BytesPerSync, opt.SyncInterval); err != nil {
+		return nil, err
+	}
+
 	wal := &WAL{
 		options:   opt,
 		olderSegs: make(map[SegmentID]*segment),
+		streams:   make(map[SegmentID]*segment),
+		tails:     make(map[*TailReader]struct{}),
+		appended:  make(chan struct{}),
+	}
+	if opt.MaxOpenSegments > 0 {
+		// the file of the active segment is always open.
+		wal.fds = newFDCache(opt.MaxOpenSegments - 1)
 	}
 
 	// create directory if not exists
-	if err := os.MkdirAll(opt.DirPath, os.ModePerm); err != nil {
+	fs := opt.fs()
+	if err := fs.MkdirAll(opt.DirPath, os.ModePerm); err != nil {
 		return nil, err
 	}
 
 	// iterate the dir and open all segment files
-	entries, err := os.ReadDir(opt.DirPath)
+	entries, err := fs.ReadDir(opt.DirPath)
 	if err != nil {
 		return nil, err
 	}
@@ -69,9 +106,30 @@ func Open(opt Options) (*WAL, error) {
 		segIds = append(segIds, id)
 	}
 
+	// the segments removed by TruncateBefore may be left by a crash
+	// before their files are deleted.
+	truncated, err := readTruncated(fs, opt.DirPath, opt.SegmentFileExt)
+	if err != nil {
+		return nil, err
+	}
+	var kept []int
+	for _, id := range segIds {
+		if SegmentID(id) >= truncated {
+			kept = append(kept, id)
+		} else if err = fs.Remove(SegmentFileName(opt.DirPath, opt.SegmentFileExt, SegmentID(id))); err != nil {
+			return nil, err
+		}
+	}
+	if len(kept) < len(segIds) {
+		if err = fs.SyncDir(opt.DirPath); err != nil {
+			return nil, err
+		}
+	}
+	segIds = kept
+
 	// empty dir, just initialize a new segment file
 	if len(segIds) == 0 {
-		seg, err := openSegmentFile(opt.DirPath, opt.SegmentFileExt, initialSegmentID)
+		seg, err := wal.openSegment(initialSegmentID)
 		if err != nil {
 			return nil, err
 		}
@@ -80,88 +138,188 @@ func Open(opt Options) (*WAL, error) {
 		// open segment files in order, the last one is active segment file
 		sort.Ints(segIds)
 		for i, sid := range segIds {
-			seg, err := openSegmentFile(opt.DirPath, opt.SegmentFileExt, SegmentID(sid))
+			seg, err := wal.openSegment(SegmentID(sid))
 			if err != nil {
+				for _, opened := range wal.olderSegs {
+					_ = opened.Close()
+				}
 				return nil, err
 			}
 			if i == len(segIds)-1 {
 				wal.activeSeg = seg
 			} else {
 				wal.olderSegs[seg.id] = seg
+				if opt.MmapReads {
+					if err = seg.mapFile(); err != nil {
+						for _, opened := range wal.olderSegs {
+							_ = opened.Close()
+						}
+						return nil, err
+					}
+				}
+				if wal.fds != nil {
+					wal.fds.manage(seg)
+				}
 			}
 		}
 	}
 
+	// the existing data is regarded as durable.
+	wal.durableLoc = ChunkLoc{
+		SegId:       wal.activeSeg.id,
+		BlockIndex:  wal.activeSeg.curBlockIndex,
+		ChunkOffset: int64(wal.activeSeg.curBlockSize),
+	}
+	if opt.syncPolicy() == SyncInterval {
+		wal.startSyncer(opt.SyncInterval)
+	}
+
 	return wal, nil
 }
 
+// openSegment opens the segment file of the given id.
+func (w *WAL) openSegment(id SegmentID) (*segment, error) {
+	seg, err := openSegmentFile(w.options.fs(), w.options.DirPath,
+		w.options.SegmentFileExt, id, w.options.preallocSize())
+	if err != nil {
+		return nil, err
+	}
+	seg.cache = w.fds
+	if id > w.lastSegID {
+		w.lastSegID = id
+	}
+	return seg, nil
+}
+
 // OpenNewActiveSeg opens a new segment file and sets it
 // as the active segment file regardless of the old one.
 // Calling it in merge process.
 func (w *WAL) OpenNewActiveSeg() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if err := w.activeSeg.Sync(); err != nil {
+	return w.rotateActiveSeg()
+}
+
+// rotateActiveSeg syncs and seals the active segment file, and
+// opens a new one as the active segment file.
+func (w *WAL) rotateActiveSeg() error {
+	return w.rotateActiveSegTo(w.lastSegID + 1)
+}
+
+// rotateActiveSegTo is like rotateActiveSeg, but the new active segment
+// file takes the given id, which is larger than the old one.
+func (w *WAL) rotateActiveSegTo(id SegmentID) error {
+	if err := w.syncActiveSeg(); err != nil {
+		return err
+	}
+	if err := w.activeSeg.seal(); err != nil {
 		return err
 	}
-	seg, err := openSegmentFile(w.options.DirPath,
-		w.options.SegmentFileExt, w.activeSeg.id+1)
+	if w.options.MmapReads {
+		if err := w.activeSeg.mapFile(); err != nil {
+			return err
+		}
+	}
+	seg, err := w.openSegment(id)
 	if err != nil {
 		return err
 	}
 	w.olderSegs[w.activeSeg.id] = w.activeSeg
+	if w.fds != nil {
+		w.fds.manage(w.activeSeg)
+	}
 	w.activeSeg = seg
 	return nil
 }
 
+// replaceActiveSeg opens a new active segment file of the given id, and
+// removes the old one, which must be empty. Like TruncateBefore, the
+// file held by the readers is deleted after they release it.
+func (w *WAL) replaceActiveSeg(id SegmentID) error {
+	seg, err := w.openSegment(id)
+	if err != nil {
+		return err
+	}
+	old := w.activeSeg
+	w.activeSeg = seg
+	return old.markObsolete()
+}
+
 // Write writes the data to the WAL.
 // Actually, it writes the data to the active segment file.
 // Returns the location of the data in the WAL.
 func (w *WAL) Write(data []byte) (*ChunkLoc, error) {
+	locs, err := w.WriteBatch([][]byte{data})
+	if err != nil {
+		return nil, err
+	}
+	return locs[0], nil
+}
+
+// WriteBatch writes all the data to the WAL, the data fitting into the
+// active segment file is written with a single buffered write. If the
+// active segment file is full in the middle of the batch, it will be
+// synced and a new one is created for the rest data.
+// Returns the locations of the data in the WAL in order.
+func (w *WAL) WriteBatch(data [][]byte) ([]*ChunkLoc, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	dataSize := int64(len(data))
-	if dataSize+chunkHeaderSize > w.options.SegmentSize {
-		return nil, errors.New("the data size larger than max segment size")
+	for _, d := range data {
+		if int64(len(d))+chunkHeaderSize > w.options.SegmentSize {
+			return nil, errors.New("the data size larger than max segment size")
+		}
 	}
 
-	// if the active segment file is full, sync it and create a new one.
-	if w.isFull(dataSize) {
-		if err := w.activeSeg.Sync(); err != nil {
-			return nil, err
+	locs := make([]*ChunkLoc, 0, len(data))
+	for start := 0; start < len(data); {
+		// the data in [start, end) fits into the active segment file
+		end := start
+		var pending int64
+		for ; end < len(data); end++ {
+			delta := int64(len(data[end]))
+			if w.isFull(pending + delta) {
+				break
+			}
+			pending += chunkHeaderSize + delta
 		}
-		w.bytesWrite = 0
-		seg, err := openSegmentFile(w.options.DirPath, w.options.SegmentFileExt,
-			w.activeSeg.id+1)
+
+		// if the active segment file is full, sync it and create a new one.
+		if end == start {
+			if err := w.rotateActiveSeg(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// write the data to the active segment file
+		segLocs, err := w.activeSeg.WriteAll(data[start:end])
 		if err != nil {
 			return nil, err
 		}
-		w.olderSegs[w.activeSeg.id] = w.activeSeg
-		w.activeSeg = seg
-	}
-
-	// write the data to the active segment file
-	loc, err := w.activeSeg.Write(data)
-	if err != nil {
-		return nil, err
+		w.notifyAppended()
+		for _, loc := range segLocs {
+			w.bytesWrite += loc.ChunkSize
+		}
+		locs = append(locs, segLocs...)
+		start = end
 	}
 
-	w.bytesWrite += loc.ChunkSize
-
 	// sync the active segment file if needed
-	var needSync = w.options.Sync
-	if !needSync && w.options.BytesPerSync > 0 {
+	var needSync bool
+	switch w.options.syncPolicy() {
+	case SyncEveryWrite:
+		needSync = true
+	case SyncEveryN:
 		needSync = w.bytesWrite >= w.options.BytesPerSync
 	}
 	if needSync {
-		if err = w.activeSeg.Sync(); err != nil {
+		if err := w.syncActiveSeg(); err != nil {
 			return nil, err
 		}
-		w.bytesWrite = 0
 	}
 
-	return loc, nil
+	return locs, nil
 }
 
 // Read reads the data in the given chunk location from the WAL.
@@ -184,22 +342,77 @@ func (w *WAL) Read(loc *ChunkLoc) ([]byte, error) {
 	return seg.Read(loc.BlockIndex, loc.ChunkOffset)
 }
 
+// ReadView reads the data at the given location like Read, but without
+// copying it if possible, i.e. with Options.MmapReads, the data of a
+// sealed segment is a slice of the mapping. The data must not be
+// modified, and is only valid until release is called, which must be
+// called once if the error is nil. The segment file is held until then.
+func (w *WAL) ReadView(loc *ChunkLoc) (data []byte, release func(), err error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	var seg *segment
+	if loc.SegId == w.activeSeg.id {
+		seg = w.activeSeg
+	} else {
+		seg = w.olderSegs[loc.SegId]
+	}
+
+	if seg == nil {
+		return nil, nil, fmt.Errorf("segment file %d%s not found", loc.SegId, w.options.SegmentFileExt)
+	}
+
+	seg.acquire()
+	data, borrowed, err := seg.readView(loc.BlockIndex, loc.ChunkOffset)
+	if err != nil || !borrowed {
+		_ = seg.release()
+		if err != nil {
+			return nil, nil, err
+		}
+		return data, func() {}, nil
+	}
+	var once sync.Once
+	return data, func() {
+		once.Do(func() {
+			_ = seg.release()
+		})
+	}, nil
+}
+
 // NewReaderLE returns a new reader for WAL which only read
 // data from the segment whose id is less than or equal to
 // the given segId.
 // If segId is 0, meaning read from all segments.
 // You may also call it in the merge process.
 func (w *WAL) NewReaderLE(segId SegmentID) *Reader {
+	return w.newReader(func(id SegmentID) bool {
+		return segId == 0 || id <= segId
+	})
+}
+
+// NewReaderGE returns a new reader for WAL which only read
+// data from the segment whose id is greater than or equal to
+// the given segId.
+func (w *WAL) NewReaderGE(segId SegmentID) *Reader {
+	return w.newReader(func(id SegmentID) bool {
+		return id >= segId
+	})
+}
+
+// newReader returns a reader of the segments accepted by the filter.
+func (w *WAL) newReader(filter func(SegmentID) bool) *Reader {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
 
 	var readers []*segmentReader
 	for _, seg := range w.olderSegs {
-		if segId == 0 || seg.id <= segId {
+		if filter(seg.id) {
+			seg.acquire()
 			readers = append(readers, seg.NewReader())
 		}
 	}
-	if segId == 0 || w.activeSeg.id <= segId {
+	if filter(w.activeSeg.id) {
+		w.activeSeg.acquire()
 		readers = append(readers, w.activeSeg.NewReader())
 	}
 
@@ -214,36 +427,35 @@ func (w *WAL) NewReaderLE(segId SegmentID) *Reader {
 }
 
 // NewReaderWithLoc returns a new reader for WAL which only read
-// data from the given chunk location.
+// data from the given chunk location. It seeks to the location directly,
+// which must be the start of a chunk or the end of a segment, otherwise
+// ErrInvalidChunkLoc is returned. A location before the first segment
+// reads from the first chunk.
 func (w *WAL) NewReaderWithLoc(loc *ChunkLoc) (*Reader, error) {
 	if loc == nil {
 		return nil, errors.New("start location is nil")
 	}
+	if loc.SegId > w.ActiveSegID() {
+		return nil, ErrInvalidChunkLoc
+	}
+
+	reader := w.NewReaderGE(loc.SegId)
 	w.mu.RLock()
 	defer w.mu.RUnlock()
-
-	reader := w.NewReader()
-	for {
-		// skip the segment whose id is less than loc.SegId
-		if reader.CurrSegId() < loc.SegId {
-			reader.Skip()
-			continue
-		}
-		// skip the chunk whose location is less than loc
-		curLoc := reader.CurrChunkLoc()
-		if curLoc.BlockIndex >= loc.BlockIndex &&
-			curLoc.ChunkOffset >= loc.ChunkOffset {
-			break
-		}
-		// call Next()
-		if _, _, err := reader.Next(); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
+	if len(reader.readers) == 0 || reader.CurrSegId() != loc.SegId {
+		if loc.SegId < w.firstSegID() {
+			return reader, nil
 		}
+		reader.Close()
+		return nil, fmt.Errorf("segment file %d%s not found", loc.SegId, w.options.SegmentFileExt)
 	}
 
+	first := reader.readers[0]
+	if err := first.seg.checkChunkStart(loc.BlockIndex, loc.ChunkOffset); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	first.blockIdx, first.chunkOff = loc.BlockIndex, loc.ChunkOffset
 	return reader, nil
 }
 
@@ -252,9 +464,49 @@ func (w *WAL) NewReader() *Reader {
 	return w.NewReaderLE(0)
 }
 
+// NewReadersGT returns one reader for each segment whose id is
+// greater than the given segId, sorted by segment id.
+// Every reader only reads its own segment, so they can be
+// consumed concurrently, i.e. rebuilding the index in parallel.
+func (w *WAL) NewReadersGT(segId SegmentID) []*Reader {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	var readers []*Reader
+	for _, seg := range w.olderSegs {
+		if seg.id > segId {
+			seg.acquire()
+			readers = append(readers, &Reader{
+				readers: []*segmentReader{seg.NewReader()},
+			})
+		}
+	}
+	if w.activeSeg.id > segId {
+		w.activeSeg.acquire()
+		readers = append(readers, &Reader{
+			readers: []*segmentReader{w.activeSeg.NewReader()},
+		})
+	}
+
+	sort.Slice(readers, func(i, j int) bool {
+		return readers[i].readers[0].seg.id < readers[j].readers[0].seg.id
+	})
+	return readers
+}
+
 // Skip skips the current segment.
 func (r *Reader) Skip() {
-	r.currIdx++
+	if r.currIdx < len(r.readers) {
+		_ = r.readers[r.currIdx].seg.release()
+		r.currIdx++
+	}
+}
+
+// Close releases the segments which are not read through yet.
+func (r *Reader) Close() {
+	for r.currIdx < len(r.readers) {
+		r.Skip()
+	}
 }
 
 // CurrSegId returns the id of current segment.
@@ -262,6 +514,11 @@ func (r *Reader) CurrSegId() SegmentID {
 	return r.readers[r.currIdx].seg.id
 }
 
+// CurrSegHeader returns the header of current segment.
+func (r *Reader) CurrSegHeader() SegmentHeader {
+	return *r.readers[r.currIdx].seg.meta
+}
+
 // CurrChunkLoc returns the location of current chunk.
 func (r *Reader) CurrChunkLoc() *ChunkLoc {
 	curReader := r.readers[r.currIdx]
@@ -272,6 +529,15 @@ func (r *Reader) CurrChunkLoc() *ChunkLoc {
 	}
 }
 
+// TornTail reports whether the data at the current location, which Next
+// fails to read with io.ErrUnexpectedEOF or ErrInvalidCRC, is the tail of
+// the segment torn by a crash, i.e. nothing has been written after it.
+// Otherwise the segment is corrupted in the middle.
+func (r *Reader) TornTail() (bool, error) {
+	curReader := r.readers[r.currIdx]
+	return curReader.seg.tornAt(curReader.blockIdx, curReader.chunkOff)
+}
+
 // Next returns the next chunk data with location.
 // If there's no data, io.EOF will be returned.
 func (r *Reader) Next() ([]byte, *ChunkLoc, error) {
@@ -281,7 +547,7 @@ func (r *Reader) Next() ([]byte, *ChunkLoc, error) {
 
 	data, loc, err := r.readers[r.currIdx].Next()
 	if err == io.EOF {
-		r.currIdx++
+		r.Skip()
 		return r.Next()
 	}
 	return data, loc, err
@@ -289,15 +555,28 @@ func (r *Reader) Next() ([]byte, *ChunkLoc, error) {
 
 // Close closes the WAL.
 func (w *WAL) Close() error {
+	w.syncerMu.Lock()
+	w.stopSyncer()
+	w.syncerMu.Unlock()
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	if !w.closed {
+		close(w.appended)
+	}
+	w.closed = true
 	for _, seg := range w.olderSegs {
 		if err := seg.Close(); err != nil {
 			return err
 		}
 	}
 	w.olderSegs = nil
+	for _, seg := range w.streams {
+		if err := seg.Close(); err != nil {
+			return err
+		}
+	}
 
 	return w.activeSeg.Close()
 }
@@ -313,16 +592,35 @@ func (w *WAL) Delete() error {
 		}
 	}
 	w.olderSegs = nil
+	for id, seg := range w.streams {
+		if err := seg.Remove(); err != nil {
+			return err
+		}
+		delete(w.streams, id)
+	}
+	err := w.options.fs().Remove(filepath.Join(w.options.DirPath, truncatedFileName+w.options.SegmentFileExt))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
 	return w.activeSeg.Remove()
 }
 
 // Sync syncs the active segment file to stable storage like disk.
+// It's a no-op if nothing has been written since the last sync.
+// The error of the background sync is also returned if any.
 func (w *WAL) Sync() error {
 	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	return w.activeSeg.Sync()
+	err := w.syncErr
+	w.syncErr = nil
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = w.syncUnlocked(); err == ErrClosed {
+		return nil
+	}
+	return err
 }
 
 // ActiveSegID returns the current active segment id.
@@ -332,6 +630,40 @@ func (w *WAL) ActiveSegID() SegmentID {
 	return w.activeSeg.id
 }
 
+// ActiveSegSize returns the size of the data in the active segment file.
+func (w *WAL) ActiveSegSize() int64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.activeSeg.Size()
+}
+
+// EndLoc returns the end location of the data in the WAL, where the next
+// chunk is written, unless the active segment is full.
+func (w *WAL) EndLoc() *ChunkLoc {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return &ChunkLoc{
+		SegId:       w.activeSeg.id,
+		BlockIndex:  w.activeSeg.curBlockIndex,
+		ChunkOffset: int64(w.activeSeg.curBlockSize),
+	}
+}
+
+// SegmentIDs returns the ids of all segments in order, the last one
+// is the active segment.
+func (w *WAL) SegmentIDs() []SegmentID {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	ids := make([]SegmentID, 0, len(w.olderSegs)+1)
+	for id := range w.olderSegs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return append(ids, w.activeSeg.id)
+}
+
 // IsEmpty returns whether the WAL is empty.
 // Only when there is only one active segment, and it's empty.
 func (w *WAL) IsEmpty() bool {
@@ -341,6 +673,45 @@ func (w *WAL) IsEmpty() bool {
 	return len(w.olderSegs) == 0 && w.activeSeg.Size() == 0
 }
 
+// notifyAppended wakes up the tail readers waiting for new chunks.
+// The caller must hold w.mu.
+func (w *WAL) notifyAppended() {
+	close(w.appended)
+	w.appended = make(chan struct{})
+}
+
+// sortSegments sorts the segments by id.
+func sortSegments(segs []*segment) {
+	sort.Slice(segs, func(i, j int) bool {
+		return segs[i].id < segs[j].id
+	})
+}
+
+// firstSegID returns the smallest segment id.
+// The caller must hold w.mu.
+func (w *WAL) firstSegID() SegmentID {
+	first := w.activeSeg.id
+	for id := range w.olderSegs {
+		if id < first {
+			first = id
+		}
+	}
+	return first
+}
+
+// nextSegID returns the id of the segment following the given one, the
+// ids may have gaps left by the removed segments and the streams.
+// The caller must hold w.mu.
+func (w *WAL) nextSegID(id SegmentID) SegmentID {
+	next := w.activeSeg.id
+	for older := range w.olderSegs {
+		if older > id && older < next {
+			next = older
+		}
+	}
+	return next
+}
+
 func (w *WAL) isFull(delta int64) bool {
 	return w.activeSeg.Size()+chunkHeaderSize+delta > w.options.SegmentSize
 }
@@ -1,11 +1,19 @@
 package wal
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/berylyvos/yojoudb/vfs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -208,12 +216,1128 @@ func TestWAL_ReaderWithLoc(t *testing.T) {
 	assert.Equal(t, pos2.BlockIndex, uint32(0))
 	assert.Equal(t, pos2.ChunkOffset, int64(0))
 
-	reader3, err := wal.NewReaderWithLoc(&ChunkLoc{SegId: 3, BlockIndex: 5, ChunkOffset: 0})
+	// find a chunk in the middle of a segment
+	var loc *ChunkLoc
+	reader := wal.NewReader()
+	for {
+		_, pos, err := reader.Next()
+		assert.Nil(t, err)
+		if pos.SegId == 3 && pos.BlockIndex >= 5 {
+			loc = pos
+			break
+		}
+	}
+	reader3, err := wal.NewReaderWithLoc(loc)
 	assert.Nil(t, err)
 	_, pos3, err := reader3.Next()
 	assert.Nil(t, err)
-	assert.Equal(t, pos3.SegId, uint32(3))
-	assert.Equal(t, pos3.BlockIndex, uint32(5))
+	assert.Equal(t, loc, pos3)
+	_, pos4, err := reader.Next()
+	assert.Nil(t, err)
+	_, pos5, err := reader3.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, pos4, pos5)
+
+	// not the start of a chunk
+	_, err = wal.NewReaderWithLoc(&ChunkLoc{SegId: 3, BlockIndex: loc.BlockIndex, ChunkOffset: loc.ChunkOffset + 1})
+	assert.Equal(t, ErrInvalidChunkLoc, err)
+	_, err = wal.NewReaderWithLoc(&ChunkLoc{SegId: 3, BlockIndex: 1 << 20})
+	assert.Equal(t, ErrInvalidChunkLoc, err)
+	_, err = wal.NewReaderWithLoc(&ChunkLoc{SegId: wal.ActiveSegID() + 1})
+	assert.Equal(t, ErrInvalidChunkLoc, err)
+
+	// the end of the active segment
+	end := &ChunkLoc{
+		SegId:       wal.activeSeg.id,
+		BlockIndex:  wal.activeSeg.curBlockIndex,
+		ChunkOffset: int64(wal.activeSeg.curBlockSize),
+	}
+	reader6, err := wal.NewReaderWithLoc(end)
+	assert.Nil(t, err)
+	_, _, err = reader6.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWAL_WriteBatch(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wal-test-write-batch")
+	opts := Options{
+		DirPath:        dir,
+		SegmentFileExt: DotSEG,
+		SegmentSize:    MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyWAL(wal)
+
+	locs, err := wal.WriteBatch(nil)
+	assert.Nil(t, err)
+	assert.Empty(t, locs)
+
+	// rotate in the middle of the batch
+	var data [][]byte
+	for i := 0; i < 1000; i++ {
+		data = append(data, []byte(strings.Repeat(string(rune('a'+i%26)), 3*KB+i)))
+	}
+	locs, err = wal.WriteBatch(data)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), len(locs))
+	assert.True(t, wal.ActiveSegID() > 3)
+	for i, loc := range locs {
+		val, err := wal.Read(loc)
+		assert.Nil(t, err)
+		assert.Equal(t, data[i], val)
+	}
+
+	_, err = wal.WriteBatch([][]byte{[]byte("ok"), make([]byte, MB)})
+	assert.NotNil(t, err)
+
+	// reopen
+	err = wal.Close()
+	assert.Nil(t, err)
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	var i int
+	reader := wal.NewReader()
+	for {
+		val, loc, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, data[i], val)
+		assert.Equal(t, locs[i].SegId, loc.SegId)
+		assert.Equal(t, locs[i].BlockIndex, loc.BlockIndex)
+		assert.Equal(t, locs[i].ChunkOffset, loc.ChunkOffset)
+		i++
+	}
+	assert.Equal(t, len(data), i)
+}
+
+func TestWAL_SyncPolicy(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wal-test-sync-policy")
+	opts := Options{
+		DirPath:        dir,
+		SegmentFileExt: DotSEG,
+		SegmentSize:    MB,
+		SyncPolicy:     SyncEveryN,
+	}
+	_, err := Open(opts)
+	assert.Equal(t, ErrInvalidSyncPolicy, err)
+
+	opts.BytesPerSync = 4 * KB
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyWAL(wal)
+	assert.Equal(t, SyncEveryN, wal.SyncPolicy())
+
+	// not synced until BytesPerSync is reached
+	_, err = wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), wal.DurableLoc().ChunkOffset)
+	_, err = wal.Write(make([]byte, 4*KB))
+	assert.Nil(t, err)
+	durable := wal.DurableLoc()
+	assert.Equal(t, wal.activeSeg.Size(), int64(durable.BlockIndex)*blockSize+durable.ChunkOffset)
+
+	// synced by the background syncer
+	err = wal.SetSyncPolicy(SyncInterval, 0, 0)
+	assert.Equal(t, ErrInvalidSyncPolicy, err)
+	err = wal.SetSyncPolicy(SyncInterval, 0, 10*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, SyncInterval, wal.SyncPolicy())
+	_, err = wal.Write([]byte("world"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return wal.DurableLoc().ChunkOffset == durable.ChunkOffset+chunkHeaderSize+5
+	}, time.Second, 5*time.Millisecond)
+
+	// synced by every write
+	err = wal.SetSyncPolicy(SyncEveryWrite, 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, wal.syncerStop)
+	loc, err := wal.Write([]byte("!"))
+	assert.Nil(t, err)
+	assert.Equal(t, loc.ChunkOffset+chunkHeaderSize+1, wal.DurableLoc().ChunkOffset)
+
+	err = wal.SetSyncPolicy(SyncNever, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, SyncNever, wal.SyncPolicy())
+}
+
+func TestWAL_BeforeSync(t *testing.T) {
+	var calls int
+	var hookErr error
+	wal, err := Open(Options{
+		DirPath:        "/wal-test-before-sync",
+		SegmentFileExt: DotSEG,
+		SegmentSize:    MB,
+		SyncPolicy:     SyncEveryWrite,
+		FS:             vfs.NewMem(),
+		BeforeSync: func() error {
+			calls++
+			return hookErr
+		},
+	})
+	assert.Nil(t, err)
+	defer func() {
+		_ = wal.Close()
+	}()
+
+	_, err = wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, calls)
+	// nothing to sync
+	assert.Nil(t, wal.Sync())
+	assert.Equal(t, 1, calls)
+
+	// the data isn't synced if the hook fails.
+	hookErr = errors.New("hook failed")
+	assert.Nil(t, wal.SetSyncPolicy(SyncNever, 0, 0))
+	_, err = wal.Write([]byte("world"))
+	assert.Nil(t, err)
+	durable := wal.DurableLoc()
+	assert.Equal(t, hookErr, wal.Sync())
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, durable, wal.DurableLoc())
+
+	hookErr = nil
+	assert.Nil(t, wal.Sync())
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, wal.EndLoc(), wal.DurableLoc())
+}
+
+// blockingSyncFS blocks the first Sync of a file after hold is set,
+// until release is closed.
+type blockingSyncFS struct {
+	vfs.FS
+	hold    atomic.Bool
+	entered chan struct{}
+	release chan struct{}
+}
+
+type blockingSyncFile struct {
+	vfs.File
+	fs *blockingSyncFS
+}
+
+func (fs *blockingSyncFS) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	f, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &blockingSyncFile{File: f, fs: fs}, nil
+}
+
+func (f *blockingSyncFile) Sync() error {
+	if f.fs.hold.CompareAndSwap(true, false) {
+		close(f.fs.entered)
+		<-f.fs.release
+	}
+	return f.File.Sync()
+}
+
+func TestWAL_Sync_Unlocked(t *testing.T) {
+	fs := &blockingSyncFS{
+		FS:      vfs.NewMem(),
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	assert.Nil(t, fs.MkdirAll("/wal", os.ModePerm))
+	wal, err := Open(Options{
+		DirPath:        "/wal",
+		SegmentFileExt: DotSEG,
+		SegmentSize:    MB,
+		FS:             fs,
+	})
+	assert.Nil(t, err)
+	defer func() {
+		_ = wal.Close()
+	}()
+
+	loc, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	end := wal.EndLoc()
+	fs.hold.Store(true)
+	synced := make(chan error, 1)
+	go func() {
+		synced <- wal.Sync()
+	}()
+	<-fs.entered
+
+	// the reads and writes go on while the file is being synced.
+	data, err := wal.Read(loc)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+	_, err = wal.Write([]byte("world"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), wal.DurableLoc().ChunkOffset)
+
+	close(fs.release)
+	assert.Nil(t, <-synced)
+	assert.Equal(t, end, wal.DurableLoc())
+	assert.Nil(t, wal.Sync())
+	assert.Equal(t, wal.EndLoc(), wal.DurableLoc())
+}
+
+func TestWAL_TruncateBefore_Crash(t *testing.T) {
+	fs := vfs.NewFault(1)
+	opts := Options{
+		DirPath:        "/wal-test-truncate-crash",
+		SegmentFileExt: DotSEG,
+		SegmentSize:    64 * KB,
+		FS:             fs,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	var locs []*ChunkLoc
+	for i := 0; i < 300; i++ {
+		loc, err := wal.Write([]byte(strings.Repeat(fmt.Sprintf("%05d", i), 200)))
+		assert.Nil(t, err)
+		locs = append(locs, loc)
+	}
+	assert.Nil(t, wal.Sync())
+
+	// the files held by the reader are not deleted before the crash,
+	// they are deleted on reopen.
+	reader := wal.NewReader()
+	defer reader.Close()
+	assert.Nil(t, wal.TruncateBefore(3))
+	crashed := fs.Crash()
+	opts.FS = crashed
+	wal2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = wal2.Close()
+	}()
+	assert.Equal(t, SegmentID(3), wal2.SegmentIDs()[0])
+	for id := SegmentID(1); id < 3; id++ {
+		_, err = crashed.Stat(SegmentFileName(opts.DirPath, DotSEG, id))
+		assert.True(t, os.IsNotExist(err), "segment %d", id)
+	}
+	var first int
+	for locs[first].SegId < 3 {
+		first++
+	}
+	reader2 := wal2.NewReader()
+	defer reader2.Close()
+	_, loc, err := reader2.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, locs[first], loc)
+}
+
+func TestWAL_TruncateAfter_Crash(t *testing.T) {
+	fs := vfs.NewFault(1)
+	opts := Options{
+		DirPath:        "/wal-test-truncate-after-crash",
+		SegmentFileExt: DotSEG,
+		SegmentSize:    64 * KB,
+		FS:             fs,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = wal.Close()
+	}()
+	var locs []*ChunkLoc
+	for wal.ActiveSegID() < 3 {
+		loc, err := wal.Write([]byte(strings.Repeat("x", 20*KB)))
+		assert.Nil(t, err)
+		locs = append(locs, loc)
+	}
+	assert.Nil(t, wal.Sync())
+
+	countChunks := func(wal *WAL) int {
+		reader := wal.NewReader()
+		defer reader.Close()
+		var n int
+		for {
+			_, _, err := reader.Next()
+			if err != nil {
+				assert.Equal(t, io.EOF, err)
+				return n
+			}
+			n++
+		}
+	}
+	reopen := func() *WAL {
+		opts := opts
+		opts.FS = fs.Crash()
+		wal, err := Open(opts)
+		assert.Nil(t, err)
+		return wal
+	}
+
+	// nothing is truncated if a later segment fails to be removed.
+	fs.FailNext(vfs.OpRemove)
+	assert.NotNil(t, wal.TruncateAfter(locs[0]))
+	assert.Equal(t, []SegmentID{1, 2, 3}, wal.SegmentIDs())
+	assert.Equal(t, len(locs), countChunks(wal))
+	crashed := reopen()
+	assert.Equal(t, len(locs), countChunks(crashed))
+	assert.Nil(t, crashed.Close())
+
+	// the discarded chunks never come back.
+	assert.Nil(t, wal.TruncateAfter(locs[0]))
+	assert.Equal(t, []SegmentID{1}, wal.SegmentIDs())
+	crashed = reopen()
+	assert.Equal(t, []SegmentID{1}, crashed.SegmentIDs())
+	assert.Equal(t, 1, countChunks(crashed))
+	assert.Nil(t, crashed.Close())
+}
+
+func TestWAL_TruncateAfter_TailReader(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wal-test-truncate-after-tail")
+	opts := Options{
+		DirPath:        dir,
+		SegmentFileExt: DotSEG,
+		SegmentSize:    64 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyWAL(wal)
+	value := func(i int) []byte {
+		return []byte(strings.Repeat(fmt.Sprintf("%05d", i), 4*KB))
+	}
+	var locs []*ChunkLoc
+	for i := 0; wal.ActiveSegID() < 3; i++ {
+		loc, err := wal.Write(value(i))
+		assert.Nil(t, err)
+		locs = append(locs, loc)
+	}
+
+	// the tail reader holds the later segments
+	tail, err := wal.NewTailReader(locs[0])
+	assert.Nil(t, err)
+	defer tail.Close()
+	for range locs {
+		_, _, err = tail.Next(context.Background())
+		assert.Nil(t, err)
+	}
+	var kept int
+	for locs[kept].SegId == 1 {
+		kept++
+	}
+	assert.Nil(t, wal.TruncateAfter(locs[kept-1]))
+	_, _, err = tail.Next(context.Background())
+	assert.Equal(t, ErrTruncated, err)
+
+	// the ids of the removed segments are not reused
+	var expected [][]byte
+	for i := 0; i < kept; i++ {
+		expected = append(expected, value(i))
+	}
+	for i := 100; wal.ActiveSegID() == 1 || len(wal.SegmentIDs()) < 3; i++ {
+		_, err := wal.Write(value(i))
+		assert.Nil(t, err)
+		expected = append(expected, value(i))
+	}
+	assert.Equal(t, []SegmentID{1, 4, 5}, wal.SegmentIDs())
+
+	check := func(wal *WAL) {
+		reader := wal.NewReader()
+		defer reader.Close()
+		for _, val := range expected {
+			data, _, err := reader.Next()
+			assert.Nil(t, err)
+			assert.Equal(t, val, data)
+		}
+		_, _, err := reader.Next()
+		assert.Equal(t, io.EOF, err)
+	}
+	check(wal)
+	tail.Close()
+	check(wal)
+	assert.Nil(t, wal.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []SegmentID{1, 4, 5}, wal.SegmentIDs())
+	check(wal)
+}
+
+func TestWAL_SegmentHeader(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wal-test-segment-header")
+	opts := Options{
+		DirPath:        dir,
+		SegmentFileExt: DotSEG,
+		SegmentSize:    MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, wal.IsEmpty())
+	var locs []*ChunkLoc
+	for i := 0; i < 100; i++ {
+		loc, err := wal.Write([]byte(strings.Repeat("x", 32*KB)))
+		assert.Nil(t, err)
+		locs = append(locs, loc)
+	}
+	assert.Nil(t, wal.Close())
+
+	h, err := ReadSegmentHeader(vfs.Default, SegmentFileName(dir, DotSEG, 2))
+	assert.Nil(t, err)
+	assert.Equal(t, SegmentVersion, h.Version)
+	assert.Equal(t, SegmentID(2), h.SegId)
+	assert.WithinDuration(t, time.Now(), h.CreatedAt, time.Minute)
+
+	// strip the headers to make a legacy directory
+	for id := SegmentID(1); id <= 4; id++ {
+		name := SegmentFileName(dir, DotSEG, id)
+		data, err := os.ReadFile(name)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(name, data[SegmentHeaderSize:], fileModePerm))
+	}
+	_, err = Open(opts)
+	assert.ErrorIs(t, err, ErrNoSegmentHeader)
+
+	assert.Nil(t, Upgrade(vfs.Default, dir, DotSEG))
+	assert.Nil(t, Upgrade(vfs.Default, dir, DotSEG))
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyWAL(wal)
+	for _, loc := range locs {
+		val, err := wal.Read(loc)
+		assert.Nil(t, err)
+		assert.Equal(t, 32*KB, len(val))
+	}
+	// the chunks written later go to a new segment
+	loc, err := wal.Write([]byte("after upgrade"))
+	assert.Nil(t, err)
+	assert.Equal(t, SegmentID(5), loc.SegId)
+	readers := wal.NewReadersGT(0)
+	assert.Equal(t, 5, len(readers))
+	for i, reader := range readers {
+		assert.Equal(t, i < 4, reader.CurrSegHeader().Flags&FlagUpgraded != 0)
+		reader.Close()
+	}
+
+	// unknown version
+	name := SegmentFileName(dir, DotSEG, 1)
+	fd, err := os.OpenFile(name, os.O_RDWR, fileModePerm)
+	assert.Nil(t, err)
+	h = newSegmentHeader(1, time.Now())
+	h.Version = SegmentVersion + 1
+	_, err = fd.WriteAt(h.encode(), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+	_, err = ReadSegmentHeader(vfs.Default, name)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+	assert.ErrorIs(t, Upgrade(vfs.Default, dir, DotSEG), ErrUnsupportedVersion)
+}
+
+func TestWAL_TailReader(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wal-test-tail")
+	opts := Options{
+		DirPath:        dir,
+		SegmentFileExt: DotSEG,
+		SegmentSize:    64 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyWAL(wal)
+
+	const total = 500
+	value := func(i int) []byte {
+		return []byte(strings.Repeat(fmt.Sprintf("%05d", i), 200))
+	}
+	for i := 0; i < 100; i++ {
+		_, err = wal.Write(value(i))
+		assert.Nil(t, err)
+	}
+
+	tail, err := wal.NewTailReader(nil)
+	assert.Nil(t, err)
+	go func() {
+		for i := 100; i < total; i++ {
+			_, _ = wal.Write(value(i))
+		}
+	}()
+	var resume *ChunkLoc
+	for i := 0; i < total; i++ {
+		data, loc, err := tail.Next(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, value(i), data)
+		if i == 300 {
+			resume = loc
+		}
+	}
+	assert.True(t, tail.Pos().SegId > 1)
+
+	// nothing more to read
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = tail.Next(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// resume from a location
+	tail2, err := wal.NewTailReader(resume)
+	assert.Nil(t, err)
+	data, _, err := tail2.Next(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, value(300), data)
+
+	// woken up by close
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = wal.Close()
+	}()
+	_, _, err = tail.Next(context.Background())
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestWAL_Truncate(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wal-test-truncate")
+	opts := Options{
+		DirPath:        dir,
+		SegmentFileExt: DotSEG,
+		SegmentSize:    64 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyWAL(wal)
+
+	value := func(i int) []byte {
+		return []byte(strings.Repeat(fmt.Sprintf("%05d", i), 200))
+	}
+	var locs []*ChunkLoc
+	for i := 0; i < 300; i++ {
+		loc, err := wal.Write(value(i))
+		assert.Nil(t, err)
+		locs = append(locs, loc)
+	}
+	activeId := wal.ActiveSegID()
+	assert.True(t, activeId > 3)
+
+	// a reader holds the truncated segments
+	reader := wal.NewReader()
+	assert.Nil(t, wal.TruncateBefore(3))
+	_, err = os.Stat(SegmentFileName(dir, DotSEG, 1))
+	assert.Nil(t, err)
+	_, err = wal.Read(locs[0])
+	assert.NotNil(t, err)
+	for i := 0; i < 300; i++ {
+		data, _, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, value(i), data)
+	}
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+	_, err = os.Stat(SegmentFileName(dir, DotSEG, 1))
+	assert.True(t, os.IsNotExist(err))
+
+	// the given sealed segments are removed, but not the active one.
+	ids := wal.SegmentIDs()
+	assert.Equal(t, SegmentID(3), ids[0])
+	assert.Equal(t, activeId, ids[len(ids)-1])
+	assert.Nil(t, wal.RemoveSegments(4, activeId, activeId+1))
+	assert.Equal(t, append([]SegmentID{3}, ids[2:]...), wal.SegmentIDs())
+	_, err = os.Stat(SegmentFileName(dir, DotSEG, 4))
+	assert.True(t, os.IsNotExist(err))
+
+	// the segments are released if the reader fails to be created, so
+	// they are deleted once truncated.
+	_, err = wal.NewReaderWithLoc(&ChunkLoc{SegId: 3, ChunkOffset: 1})
+	assert.Equal(t, ErrInvalidChunkLoc, err)
+	_, err = wal.NewReaderWithLoc(&ChunkLoc{SegId: 4})
+	assert.NotNil(t, err)
+	assert.Nil(t, wal.TruncateBefore(activeId))
+	for _, id := range ids[:len(ids)-1] {
+		_, err = os.Stat(SegmentFileName(dir, DotSEG, id))
+		assert.True(t, os.IsNotExist(err), "segment %d", id)
+	}
+
+	// the active segment is kept
+	assert.Nil(t, wal.TruncateBefore(activeId+1))
+	assert.Equal(t, activeId, wal.ActiveSegID())
+	assert.Equal(t, activeId, wal.NewReader().CurrSegId())
+
+	// discard the tail
+	wal2, err := Open(Options{DirPath: dir + "2", SegmentFileExt: DotSEG, SegmentSize: 64 * KB})
+	assert.Nil(t, err)
+	defer destroyWAL(wal2)
+	locs = locs[:0]
+	for i := 0; i < 300; i++ {
+		loc, err := wal2.Write(value(i))
+		assert.Nil(t, err)
+		locs = append(locs, loc)
+	}
+	tail, err := wal2.NewTailReader(locs[60])
+	assert.Nil(t, err)
+	defer tail.Close()
+	assert.Equal(t, ErrInvalidChunkLoc, wal2.TruncateAfter(&ChunkLoc{SegId: locs[50].SegId, BlockIndex: locs[50].BlockIndex, ChunkOffset: locs[50].ChunkOffset + 1}))
+	assert.Nil(t, wal2.TruncateAfter(locs[50]))
+	assert.Equal(t, locs[50].SegId, wal2.ActiveSegID())
+	_, _, err = tail.Next(context.Background())
+	assert.Equal(t, ErrTruncated, err)
+
+	// the truncations are kept only until every open tail reader checks them.
+	assert.Equal(t, 1, len(wal2.truncs))
+	tail.Close()
+	assert.Equal(t, 0, len(wal2.truncs))
+	tail3, err := wal2.NewTailReader(locs[40])
+	assert.Nil(t, err)
+	for i := 40; i < 50; i++ {
+		assert.Nil(t, wal2.TruncateAfter(locs[50]))
+		assert.Equal(t, 1, len(wal2.truncs))
+		data, _, err := tail3.Next(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, value(i), data)
+	}
+	tail3.Close()
+	assert.Equal(t, 0, len(wal2.truncs))
+
+	for i := 51; i < 60; i++ {
+		_, err = wal2.Write([]byte(fmt.Sprint(i)))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, wal2.Close())
+	wal2, err = Open(wal2.options)
+	assert.Nil(t, err)
+	reader = wal2.NewReader()
+	for i := 0; i < 60; i++ {
+		data, _, err := reader.Next()
+		assert.Nil(t, err)
+		if i <= 50 {
+			assert.Equal(t, value(i), data)
+		} else {
+			assert.Equal(t, fmt.Sprint(i), string(data))
+		}
+	}
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWAL_MemFS(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := Options{
+		DirPath:        "/wal-test-mem",
+		SegmentFileExt: DotSEG,
+		SegmentSize:    64 * KB,
+		Sync:           true,
+		FS:             fs,
+		MmapReads:      true, // falls back to ReadAt.
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	testWriteAndIterate(t, wal, 1000, 512)
+	assert.True(t, wal.ActiveSegID() > 1)
+	assert.Nil(t, wal.TruncateBefore(2))
+	assert.Nil(t, wal.Close())
+
+	// nothing on the disk
+	_, err = os.Stat(opts.DirPath)
+	assert.True(t, os.IsNotExist(err))
+
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = wal.Close()
+	}()
+	assert.Equal(t, SegmentID(2), wal.NewReader().CurrSegId())
+	// along with the id of the oldest segment kept
+	entries, err := fs.ReadDir(opts.DirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, int(wal.ActiveSegID()-1)+1, len(entries))
+}
+
+func TestWAL_Preallocate(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wal-test-preallocate")
+	opts := Options{
+		DirPath:        dir,
+		SegmentFileExt: DotSEG,
+		SegmentSize:    64 * KB,
+		Preallocate:    true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyWAL(wal)
+
+	fileSize := func(id SegmentID) int64 {
+		stat, err := os.Stat(SegmentFileName(dir, DotSEG, id))
+		assert.Nil(t, err)
+		return stat.Size()
+	}
+	assert.Equal(t, int64(SegmentHeaderSize+64*KB), fileSize(1))
+
+	// the sealed segments end with the footer.
+	testWriteAndIterate(t, wal, 100, 512)
+	assert.True(t, wal.ActiveSegID() > 1)
+	assert.Equal(t, SegmentHeaderSize+wal.olderSegs[1].Size()+segmentFooterSize, fileSize(1))
+	active := wal.ActiveSegID()
+	assert.Equal(t, int64(SegmentHeaderSize+64*KB), fileSize(active))
+	size, sealed := wal.activeSeg.Size(), wal.olderSegs[1].Size()
+	assert.Nil(t, wal.Close())
+
+	// the data size is found by the footer, or by scanning.
+	dataSize, err := SegmentDataSize(vfs.Default, SegmentFileName(dir, DotSEG, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, sealed, dataSize)
+	dataSize, err = SegmentDataSize(vfs.Default, SegmentFileName(dir, DotSEG, active))
+	assert.Nil(t, err)
+	assert.Equal(t, size, dataSize)
+
+	// the end of the active segment is found by scanning.
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, size, wal.activeSeg.Size())
+	assert.Equal(t, sealed, wal.olderSegs[1].Size())
+	_, err = wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	var count int
+	reader := wal.NewReader()
+	for {
+		_, _, err := reader.Next()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		count++
+	}
+	assert.Equal(t, 101, count)
+	assert.Equal(t, int64(SegmentHeaderSize+64*KB), fileSize(active))
+
+	// the truncated data is zeroed, and won't be found again.
+	assert.Nil(t, wal.TruncateBefore(active))
+	loc, err := wal.Write([]byte("world"))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.TruncateAt(loc))
+	size = wal.activeSeg.Size()
+	assert.Nil(t, wal.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, size, wal.activeSeg.Size())
+}
+
+func TestWAL_MmapReads(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wal-test-mmap")
+	opts := Options{
+		DirPath:        dir,
+		SegmentFileExt: DotSEG,
+		SegmentSize:    64 * KB,
+		MmapReads:      true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyWAL(wal)
+
+	testWriteAndIterate(t, wal, 200, 512)
+	large := []byte(strings.Repeat("x", 40*KB))
+	largeLoc, err := wal.Write(large)
+	assert.Nil(t, err)
+	loc, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.OpenNewActiveSeg())
+	for id, seg := range wal.olderSegs {
+		assert.NotNil(t, seg.mapped.Load(), "segment %d", id)
+	}
+	assert.Nil(t, wal.activeSeg.mapped.Load())
+
+	// a full chunk is borrowed, while the large data is copied.
+	data, release, err := wal.ReadView(loc)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.Equal(t, 1, wal.olderSegs[loc.SegId].refs)
+	release()
+	release()
+	assert.Equal(t, 0, wal.olderSegs[loc.SegId].refs)
+	data, release, err = wal.ReadView(largeLoc)
+	assert.Nil(t, err)
+	assert.Equal(t, large, data)
+	assert.Equal(t, 0, wal.olderSegs[largeLoc.SegId].refs)
+	release()
+	data, err = wal.Read(largeLoc)
+	assert.Nil(t, err)
+	assert.Equal(t, large, data)
+
+	// the sealed segments are mapped when opened again.
+	assert.Nil(t, wal.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	seg := wal.olderSegs[loc.SegId]
+	assert.NotNil(t, seg.mapped.Load())
+	var count int
+	reader := wal.NewReader()
+	for {
+		if _, _, err := reader.Next(); err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		count++
+	}
+	assert.Equal(t, 202, count)
+
+	// the mapped data being read can't be truncated.
+	data, release, err = wal.ReadView(loc)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrMappedInUse, wal.TruncateAfter(largeLoc))
+	assert.Equal(t, "hello", string(data))
+	assert.NotNil(t, seg.mapped.Load())
+	release()
+	assert.Nil(t, wal.TruncateAfter(largeLoc))
+	assert.Equal(t, loc.SegId, wal.ActiveSegID())
+	assert.Nil(t, seg.mapped.Load())
+	assert.Equal(t, 0, len(seg.stale))
+	loc, err = wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.OpenNewActiveSeg())
+	seg = wal.olderSegs[loc.SegId]
+	assert.NotNil(t, seg.mapped.Load())
+
+	// the mapping is kept until the borrowed data is released.
+	data, release, err = wal.ReadView(loc)
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+	assert.Nil(t, seg.mapped.Load())
+	assert.Equal(t, 1, len(seg.stale))
+	assert.Equal(t, "hello", string(data))
+	release()
+	assert.Equal(t, 0, len(seg.stale))
+}
+
+func TestWAL_MaxOpenSegments(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wal-test-max-open")
+	opts := Options{
+		DirPath:         dir,
+		SegmentFileExt:  DotSEG,
+		SegmentSize:     8 * KB,
+		MaxOpenSegments: 4,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyWAL(wal)
+
+	values := make([][]byte, 200)
+	locs := make([]*ChunkLoc, len(values))
+	for i := range values {
+		values[i] = []byte(strings.Repeat(fmt.Sprintf("%04d", i), 256))
+		locs[i], err = wal.Write(values[i])
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(wal.olderSegs) > 20)
+	assert.True(t, openSegments(wal) <= 4)
+
+	// the closed files are reopened when read.
+	for i := len(values) - 1; i >= 0; i -= 7 {
+		data, err := wal.Read(locs[i])
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], data)
+		assert.True(t, openSegments(wal) <= 4)
+	}
+
+	// the file of the segment held by a reader may be closed meanwhile.
+	reader := wal.NewReader()
+	var count int
+	for {
+		data, _, err := reader.Next()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		assert.Equal(t, values[count], data)
+		_, err = wal.Read(locs[len(values)-1-count])
+		assert.Nil(t, err)
+		count++
+	}
+	assert.Equal(t, len(values), count)
+	assert.True(t, openSegments(wal) <= 4)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < len(values); i += 3 {
+				data, err := wal.Read(locs[i])
+				assert.Nil(t, err)
+				assert.Equal(t, values[i], data)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// the closed segment is reopened to be written again.
+	for _, i := range []int{50, 100, 150} {
+		_, err = wal.Read(locs[i])
+		assert.Nil(t, err)
+	}
+	seg := wal.olderSegs[locs[0].SegId]
+	assert.Nil(t, seg.fd)
+	assert.Nil(t, wal.TruncateAfter(locs[0]))
+	loc, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, locs[0].SegId, loc.SegId)
+	data, err := wal.Read(loc)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.Nil(t, wal.Close())
+	assert.Nil(t, seg.fd)
+
+	opts.MaxOpenSegments = 1
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, wal.OpenNewActiveSeg())
+	assert.Equal(t, 1, openSegments(wal))
+	data, err = wal.Read(loc)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.Equal(t, 1, openSegments(wal))
+}
+
+// openSegments returns the number of the open segment files.
+func TestWAL_Stream(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wal-test-stream")
+	opts := Options{
+		DirPath:        dir,
+		SegmentFileExt: DotSEG,
+		SegmentSize:    64 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyWAL(wal)
+
+	small := []byte(strings.Repeat("wal", 100))
+	var values [][]byte
+	var locs []*ChunkLoc
+	write := func() {
+		loc, err := wal.Write(small)
+		assert.Nil(t, err)
+		values = append(values, small)
+		locs = append(locs, loc)
+	}
+	stream := func(value []byte) {
+		sw, err := wal.NewStreamWriter()
+		assert.Nil(t, err)
+		// the other writes go on meanwhile, after the stream segment.
+		other, err := wal.Write(small)
+		assert.Nil(t, err)
+		loc, err := sw.Write(bytes.NewReader(value), int64(len(value)))
+		assert.Nil(t, err)
+		assert.Nil(t, sw.Commit())
+		values = append(values, value, small)
+		locs = append(locs, loc, other)
+	}
+
+	write()
+	// larger than SegmentSize, a full chunk, an empty one, and the
+	// data ends at the end of a block.
+	stream([]byte(strings.Repeat("0123456789", 30*KB)))
+	stream([]byte(strings.Repeat("s", KB)))
+	stream(nil)
+	stream([]byte(strings.Repeat("b", 2*blockSize-2*chunkHeaderSize)))
+	write()
+
+	// a short reader aborts the stream, and the segment is deleted.
+	sw, err := wal.NewStreamWriter()
+	assert.Nil(t, err)
+	_, err = sw.Write(strings.NewReader("short"), 100)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Nil(t, sw.Abort())
+	_, err = os.Stat(SegmentFileName(dir, DotSEG, sw.seg.id))
+	assert.True(t, os.IsNotExist(err))
+	write()
+
+	// the empty active segment is replaced by the streams in a row,
+	// rather than left behind.
+	ids := len(wal.SegmentIDs())
+	for i := 0; i < 3; i++ {
+		sw, err := wal.NewStreamWriter()
+		assert.Nil(t, err)
+		loc, err := sw.Write(bytes.NewReader(small), int64(len(small)))
+		assert.Nil(t, err)
+		assert.Nil(t, sw.Commit())
+		values = append(values, small)
+		locs = append(locs, loc)
+	}
+	assert.Equal(t, ids+4, len(wal.SegmentIDs()))
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, ids+4, len(entries))
+	write()
+
+	check := func(wal *WAL) {
+		for i, loc := range locs {
+			data, err := wal.Read(loc)
+			assert.Nil(t, err)
+			assert.Equal(t, values[i], data)
+
+			r, err := wal.NewStreamReader(loc)
+			assert.Nil(t, err)
+			data, err = io.ReadAll(r)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(values[i], data))
+			assert.Nil(t, r.Close())
+		}
+
+		// the stream segments are read in the order of the ids.
+		reader := wal.NewReader()
+		tail, err := wal.NewTailReader(nil)
+		assert.Nil(t, err)
+		defer tail.Close()
+		var count int
+		for {
+			data, pos, err := reader.Next()
+			if err != nil {
+				assert.Equal(t, io.EOF, err)
+				break
+			}
+			assert.True(t, bytes.Equal(values[count], data))
+			assert.Equal(t, *locs[count], *pos)
+			data, _, err = tail.Next(context.Background())
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(values[count], data))
+			count++
+		}
+		assert.Equal(t, len(values), count)
+	}
+	check(wal)
+
+	// the stream segments are plain segments when opened again.
+	assert.Nil(t, wal.Close())
+	opts.MmapReads = true
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	check(wal)
+
+	// the checksum of every chunk is checked.
+	big := locs[1]
+	path := SegmentFileName(dir, DotSEG, big.SegId)
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("x"), SegmentHeaderSize+3*blockSize+100)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	assert.Nil(t, wal.Close())
+	opts.MmapReads = false
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	r, err := wal.NewStreamReader(big)
+	assert.Nil(t, err)
+	n, err := io.Copy(io.Discard, r)
+	assert.Equal(t, ErrInvalidCRC, err)
+	assert.Equal(t, int64(3*(blockSize-chunkHeaderSize)), n)
+	assert.Nil(t, r.Close())
+
+	// the pending segment is closed along with the WAL.
+	sw, err = wal.NewStreamWriter()
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+	_, err = sw.Write(strings.NewReader("closed"), 6)
+	assert.Equal(t, ErrClosed, err)
+	assert.Nil(t, sw.Abort())
+	_, err = os.Stat(SegmentFileName(dir, DotSEG, sw.seg.id))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func openSegments(wal *WAL) int {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	n := 1
+	for _, seg := range wal.olderSegs {
+		seg.fdMu.RLock()
+		if seg.fd != nil {
+			n++
+		}
+		seg.fdMu.RUnlock()
+	}
+	return n
 }
 
 func testWriteAndIterate(t *testing.T, wal *WAL, size int, valueSize int) {